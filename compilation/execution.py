@@ -1,3 +1,6 @@
+import base64
+import gzip
+import hashlib
 import json
 import os
 import random
@@ -5,10 +8,18 @@ import redis
 import docker
 from typing import Optional
 import subprocess
+import socket
+import threading
+import time
+from datetime import datetime, timezone
 
 redisHost = os.getenv('REDIS_ADDRESS') or 'err no host'
 redisPassword = os.getenv('REDIS_PASSWORD') or 'err no pw'
 redisPort = os.getenv('REDIS_PORT') or 'err no port'
+# See RedisNamespace in orchestrator/redis.go
+redisNamespace = os.getenv('REDIS_NAMESPACE') or ''
+def key(name: str) -> str:
+    return f"{redisNamespace}:{name}" if redisNamespace else name
 r = redis.Redis(host=redisHost, port=int(redisPort), password=redisPassword, decode_responses=True)
 
 dockerClient = docker.from_env()
@@ -21,13 +32,84 @@ job = os.getenv("JOB")
 jobs = ["compilation-engine", "goal-compilation-engine"]
 if job not in jobs:
     raise RuntimeError(f"Invalid job: {job}. Must be one of: {jobs}")
+job = key(job)
 
 params=None
 
+# See WorkerHeartbeat in orchestrator/engine-workers.go
+worker_name = f"{socket.gethostname()}-{os.getpid()}"
+held_task_ids = []
+
+def heartbeat_loop():
+    while True:
+        try:
+            r.hset(f"{job}:workers", worker_name, json.dumps({
+                "name": worker_name,
+                "last_heartbeat": datetime.now(timezone.utc).isoformat(),
+                "task_ids": list(held_task_ids),
+            }))
+        except Exception as e:
+            print(f"Error sending heartbeat: {e}")
+        time.sleep(5)
+
+# See BPriorityPopLPush in orchestrator/queue-backend.go (keep the script in sync)
+pop_task_script = r.register_script("""
+while true do
+    local top = redis.call("ZREVRANGE", KEYS[1], 0, 0)
+    if not top[1] then
+        return false
+    end
+    local band = KEYS[1] .. ":" .. top[1]
+    local val = redis.call("RPOPLPUSH", band, KEYS[2])
+    if redis.call("LLEN", band) == 0 then
+        redis.call("ZREM", KEYS[1], top[1])
+    end
+    if val then
+        return val
+    end
+end
+""")
+
+def pop_task(timeout: float | None = None) -> str | None:
+    # redis can't block inside a script, so poll until the timeout (forever if None)
+    deadline = None if timeout is None else time.time() + timeout
+    while True:
+        task = pop_task_script(keys=[f"{job}:tasks", f"{job}:processing"])
+        if task is not None or (deadline is not None and time.time() >= deadline):
+            return task
+        time.sleep(0.1)
+
+# See PayloadCodec in orchestrator/engine-payload.go
+PAYLOAD_OFFLOAD_THRESHOLD = 16 * 1024
+PAYLOAD_OFFLOAD_TTL_SECONDS = 24 * 60 * 60
+
+def decode_payload(msg: dict, field: str) -> str:
+    version = msg.get("payload_version", 0)
+    if version == 0:
+        return msg[field]
+    if version != 1:
+        raise RuntimeError(f"Unknown payload version {version}")
+    body = msg[field]
+    if msg.get("payload_ref"):
+        body = r.get(msg["payload_ref"])
+        if body is None:
+            raise RuntimeError(f"Offloaded payload {msg['payload_ref']} has expired")
+    return gzip.decompress(base64.b64decode(body)).decode("utf-8")
+
+def encode_result(task_id: str, result: str, version: int) -> dict:
+    if version == 0:
+        return {"task_id": task_id, "result": result}
+    body = base64.b64encode(gzip.compress(result.encode("utf-8"), mtime=0)).decode("ascii")
+    if len(body) <= PAYLOAD_OFFLOAD_THRESHOLD:
+        return {"task_id": task_id, "result": body, "payload_version": version}
+    ref = f"{job}:payload:{hashlib.sha256(result.encode('utf-8')).hexdigest()}"
+    r.set(ref, body, nx=True, ex=PAYLOAD_OFFLOAD_TTL_SECONDS)
+    return {"task_id": task_id, "result": "", "payload_version": version, "payload_ref": ref}
+
 def update_params():
     global params
     params = {
-        "repo_url": r.get("execution:repo_url"),
+        "repo_url": r.get(key("execution:repo_url")),
     }
 
 def execGit(cmd: str, cwd: str | None):
@@ -152,18 +234,53 @@ def restore_permissions():
     for file_path, mode in original_permissions_map.items():
         os.chmod(file_path, mode)
 
-def execute(task: dict) -> dict:
+# how often a running command checks whether its task was cancelled
+CANCEL_POLL_SECONDS = 2
+
+class TaskCancelled(Exception):
+    pass
+
+def is_cancelled(task_id: str) -> bool:
+    # See Engine.Cancel in orchestrator/engine-cancel.go
+    return r.hexists(f"{job}:cancelled", task_id)
+
+# container.exec_run, but the command is killed (and TaskCancelled raised) if the task is cancelled while it runs
+def exec_cancellable(cmd: str, task_id: str):
+    result = {}
+    def run():
+        try:
+            result["value"] = container.exec_run(cmd=cmd, workdir="/home/ubuntu/repo")
+        except Exception as e:
+            result["error"] = e
+    thread = threading.Thread(target=run, daemon=True)
+    thread.start()
+    while thread.is_alive():
+        thread.join(CANCEL_POLL_SECONDS)
+        if thread.is_alive() and is_cancelled(task_id):
+            # signals everything in the container except its init (pid 1) & the kill itself
+            container.exec_run(cmd="/bin/bash -c 'kill -KILL -1'")
+            thread.join()
+            raise TaskCancelled(task_id)
+    if "error" in result:
+        raise result["error"]
+    return result["value"]
+
+def execute(task: dict, task_id: str) -> dict:
     global container
     if not container:
         raise RuntimeError("Container not initialized")
 
     print("Executing task")
     print(task)
-    results = []
-
 
     lockdown_permissions(allow_test_lean=job == "goal-compilation-engine")
+    try:
+        return execute_commands(task, task_id)
+    finally:
+        restore_permissions()
 
+def execute_commands(task: dict, task_id: str) -> dict:
+    results = []
     # Execute each pre-command
     hasFailed = False
     for cmd in task["pre_commands"]:
@@ -184,10 +301,9 @@ def execute(task: dict) -> dict:
             script = script.replace("/dev/stdin", "/dev/zero")
             # Escape single quotes in the script to prevent quote issues
             script = script.replace("'", "'\"'\"'")
-            exit_code, output = container.exec_run(
-                cmd=f"/bin/bash -c '{script}'",
-                workdir="/home/ubuntu/repo"
-            )
+            exit_code, output = exec_cancellable(f"/bin/bash -c '{script}'", task_id)
+        except TaskCancelled:
+            raise
         except Exception as e:  
             print(f"Command {cmd['name']} failed with error: {e}")
             exit_code = 1
@@ -209,10 +325,9 @@ def execute(task: dict) -> dict:
         try:
             # Escape single quotes in the compilation script to prevent quote issues
             compilation_script = task['compilation_script'].replace("'", "'\"'\"'")
-            exit_code, output = container.exec_run(
-                cmd=f"/bin/bash -c '{compilation_script}'",
-                workdir="/home/ubuntu/repo"
-            )
+            exit_code, output = exec_cancellable(f"/bin/bash -c '{compilation_script}'", task_id)
+        except TaskCancelled:
+            raise
         except Exception as e:
             print(f"Compilation script failed with error: {e}")
             exit_code = 1
@@ -231,8 +346,6 @@ def execute(task: dict) -> dict:
             "exit_code": 1
         }
 
-    restore_permissions()
-
     return {
         "pre_commands_results": results,
         "compilation_result": compilation_result
@@ -241,33 +354,40 @@ def execute(task: dict) -> dict:
 def main():
     try:
         startup()
+        threading.Thread(target=heartbeat_loop, daemon=True).start()
         while True:
-            task = r.brpoplpush(f"{job}:tasks", f"{job}:processing")
+            task = pop_task()
             if task:
                 try:
                     task_msg = json.loads(task)
                     task_id = task_msg["task_id"]
-                    compilation_task = json.loads(task_msg["task"])
+                    if is_cancelled(task_id):
+                        print(f"Skipping cancelled task {task_id}")
+                        continue
+                    held_task_ids[:] = [task_id]
+                    compilation_task = json.loads(decode_payload(task_msg, "task"))
                     old_branch_name = compilation_task["branch_name"]
                     new_branch_name = compilation_task["new_branch_name"]
                     git_checkout(old_branch_name)
                     git_create_branch(new_branch_name)
                     git_clean()
-                    result = execute(compilation_task)
+                    result = execute(compilation_task, task_id)
                     git_commit("compilation")
                     git_push(new_branch_name)
 
                     result["branch_name"] = new_branch_name
 
-                    result_msg = {
-                        "task_id": task_id,
-                        "result": json.dumps(result)
-                    }
+                    result_msg = encode_result(task_id, json.dumps(result), task_msg.get("payload_version", 0))
                     # Store the result back in Redis
                     r.lpush(f"{job}:results", json.dumps(result_msg))
+                except TaskCancelled:
+                    # dropped without a result. See Engine.Cancel in orchestrator/engine-cancel.go
+                    print(f"Killed cancelled task {task_id}")
                 except Exception as e:
                     # Fine -- it will be requeued.
                     print(f"Error executing task {task_id}: {e}")
+                finally:
+                    held_task_ids.clear()
             else:
                 print("no tasks, should not be possible to reach here")
                 exit(1)
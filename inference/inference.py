@@ -3,10 +3,16 @@ from vllm import LLM, SamplingParams
 import redis
 import os
 import json
+import base64
+import gzip
+import hashlib
 import gc
 from vllm.sampling_params import GuidedDecodingParams
 from vllm.lora.request import LoRARequest
 import re
+import socket
+import threading
+from datetime import datetime, timezone
 import torch
 # was crashing. This terrifies me.
 import torch._dynamo
@@ -15,10 +21,86 @@ torch._dynamo.config.suppress_errors = True
 redisHost = os.getenv('REDIS_ADDRESS') or 'err no host'
 redisPassword = os.getenv('REDIS_PASSWORD') or 'err no pw'
 redisPort = os.getenv('REDIS_PORT') or 'err no port'
+# See RedisNamespace in orchestrator/redis.go
+redisNamespace = os.getenv('REDIS_NAMESPACE') or ''
+def key(name: str) -> str:
+    return f"{redisNamespace}:{name}" if redisNamespace else name
 r = redis.Redis(host=redisHost, port=int(redisPort), password=redisPassword, decode_responses=True)
 
 print("started")
 params=None
+job = key("inference-engine")
+
+# See WorkerHeartbeat in orchestrator/engine-workers.go
+worker_name = f"{socket.gethostname()}-{os.getpid()}"
+held_task_ids = []
+
+def heartbeat_loop():
+    while True:
+        try:
+            r.hset(f"{job}:workers", worker_name, json.dumps({
+                "name": worker_name,
+                "last_heartbeat": datetime.now(timezone.utc).isoformat(),
+                "task_ids": list(held_task_ids),
+            }))
+        except Exception as e:
+            print(f"Error sending heartbeat: {e}")
+        time.sleep(5)
+
+# See BPriorityPopLPush in orchestrator/queue-backend.go (keep the script in sync)
+pop_task_script = r.register_script("""
+while true do
+    local top = redis.call("ZREVRANGE", KEYS[1], 0, 0)
+    if not top[1] then
+        return false
+    end
+    local band = KEYS[1] .. ":" .. top[1]
+    local val = redis.call("RPOPLPUSH", band, KEYS[2])
+    if redis.call("LLEN", band) == 0 then
+        redis.call("ZREM", KEYS[1], top[1])
+    end
+    if val then
+        return val
+    end
+end
+""")
+
+def pop_task(timeout: float | None = None) -> str | None:
+    # redis can't block inside a script, so poll until the timeout (forever if None)
+    deadline = None if timeout is None else time.time() + timeout
+    while True:
+        task = pop_task_script(keys=[f"{job}:tasks", f"{job}:processing"])
+        if task is not None or (deadline is not None and time.time() >= deadline):
+            return task
+        time.sleep(0.1)
+
+# See PayloadCodec in orchestrator/engine-payload.go
+PAYLOAD_OFFLOAD_THRESHOLD = 16 * 1024
+PAYLOAD_OFFLOAD_TTL_SECONDS = 24 * 60 * 60
+
+def decode_payload(msg: dict, field: str) -> str:
+    version = msg.get("payload_version", 0)
+    if version == 0:
+        return msg[field]
+    if version != 1:
+        raise RuntimeError(f"Unknown payload version {version}")
+    body = msg[field]
+    if msg.get("payload_ref"):
+        body = r.get(msg["payload_ref"])
+        if body is None:
+            raise RuntimeError(f"Offloaded payload {msg['payload_ref']} has expired")
+    return gzip.decompress(base64.b64decode(body)).decode("utf-8")
+
+def encode_result(task_id: str, result: str, version: int) -> dict:
+    if version == 0:
+        return {"task_id": task_id, "result": result}
+    body = base64.b64encode(gzip.compress(result.encode("utf-8"), mtime=0)).decode("ascii")
+    if len(body) <= PAYLOAD_OFFLOAD_THRESHOLD:
+        return {"task_id": task_id, "result": body, "payload_version": version}
+    ref = f"{job}:payload:{hashlib.sha256(result.encode('utf-8')).hexdigest()}"
+    r.set(ref, body, nx=True, ex=PAYLOAD_OFFLOAD_TTL_SECONDS)
+    return {"task_id": task_id, "result": "", "payload_version": version, "payload_ref": ref}
+
 #pattern = r"<think>[^<]+</think><actions>.*</actions>"
 # I wonder if the the any hurts performance.
 grammar_str = r"""
@@ -39,17 +121,17 @@ def download_model(model_name:str):
 def update_params():
     global params
     params = {
-        "enabled": r.get("inference:enabled") == "true",
-        "base_model": r.get("inference:base_model"),
-        "stop_string": r.get("inference:stop_string"),
-        "adapter": r.get("inference:adapter"),
-        "load_format": empty_to_none(r.get("inference:load_format")), # ex: bitsandbytes or ""
-        "batch_size": int(r.get("inference:batch_size")),
-        "max_model_len": int(r.get("inference:max_model_len")),
-        "gpu_memory_utilization": float(r.get("inference:gpu_memory_utilization")),
-        "max_new_tokens": int(r.get("inference:max_new_tokens")),
-        "num_return_sequences": int(r.get("inference:num_return_sequences")),
-        "num_beams": int(r.get("inference:num_beams")),
+        "enabled": r.get(key("inference:enabled")) == "true",
+        "base_model": r.get(key("inference:base_model")),
+        "stop_string": r.get(key("inference:stop_string")),
+        "adapter": r.get(key("inference:adapter")),
+        "load_format": empty_to_none(r.get(key("inference:load_format"))), # ex: bitsandbytes or ""
+        "batch_size": int(r.get(key("inference:batch_size"))),
+        "max_model_len": int(r.get(key("inference:max_model_len"))),
+        "gpu_memory_utilization": float(r.get(key("inference:gpu_memory_utilization"))),
+        "max_new_tokens": int(r.get(key("inference:max_new_tokens"))),
+        "num_return_sequences": int(r.get(key("inference:num_return_sequences"))),
+        "num_beams": int(r.get(key("inference:num_beams"))),
     }
 
 
@@ -59,7 +141,15 @@ def local_model_dir(name:str):
 def local_adapter_dir(name:str, adapter_name:str):
     return f"{os.getenv('HOME')}/cache/models/{name}/{adapter_name}"
 
+# how often a running batch checks for cancelled tasks
+CANCEL_POLL_SECONDS = 2
+
+def cancelled_task_ids(task_ids) -> set:
+    # See Engine.Cancel in orchestrator/engine-cancel.go
+    return {task_id for task_id in task_ids if r.hexists(f"{job}:cancelled", task_id)}
+
 bid = 0
+# Returns task id -> RequestOutput. Tasks cancelled while the batch ran are aborted & left out.
 def process_batch(model, batch_prompts, batch_task_ids):
     global bid
     bid += 1
@@ -84,18 +174,38 @@ def process_batch(model, batch_prompts, batch_task_ids):
     )
     lora_request = LoRARequest(params["adapter"], bid, local_adapter_dir(params["base_model"], params["adapter"]))
 
+    # step the engine ourselves (instead of model.generate) so cancelled tasks can be aborted mid-batch
+    engine = model.llm_engine
+    generated = {}
     with torch.no_grad():
-        generated = model.generate(batch_prompts, sampling_params, lora_request=lora_request)
+        for task_id, prompt in zip(batch_task_ids, batch_prompts):
+            engine.add_request(task_id, prompt, sampling_params, lora_request=lora_request)
+        last_poll = time.time()
+        while engine.has_unfinished_requests():
+            for output in engine.step():
+                if output.finished:
+                    generated[output.request_id] = output
+            if time.time() - last_poll < CANCEL_POLL_SECONDS:
+                continue
+            last_poll = time.time()
+            cancelled = cancelled_task_ids([task_id for task_id in batch_task_ids if task_id not in generated])
+            if cancelled:
+                print(f"Aborting {len(cancelled)} cancelled tasks mid-batch")
+                engine.abort_request(list(cancelled))
+                held_task_ids[:] = [task_id for task_id in held_task_ids if task_id not in cancelled]
     return generated
 
-def send_results(generated, batch_prompts, batch_task_ids):
+def send_results(generated, batch_prompts, batch_task_ids, batch_payload_versions):
     global params
     num_sequences_per_prompt = params["num_return_sequences"]
     print("num_sequences_per_prompt", num_sequences_per_prompt)
     for i in range(len(batch_prompts)):
+        if batch_task_ids[i] not in generated:
+            # cancelled. See Engine.Cancel in orchestrator/engine-cancel.go
+            continue
         return_sequences = []
         for j in range(num_sequences_per_prompt):
-            model_output = generated[i].outputs[j].text
+            model_output = generated[batch_task_ids[i]].outputs[j].text
             prompt = batch_prompts[i]
             #print("=" * 5 + "prompt "+str(i))
             #print(prompt)
@@ -106,9 +216,9 @@ def send_results(generated, batch_prompts, batch_task_ids):
         inference_task_result = {
             "return_sequences": return_sequences,
         }
-        result = {'task_id': batch_task_ids[i], 'result': json.dumps(inference_task_result)}
+        result = encode_result(batch_task_ids[i], json.dumps(inference_task_result), batch_payload_versions.get(batch_task_ids[i], 0))
         result_string = json.dumps(result)
-        r.lpush("inference-engine:results", result_string)
+        r.lpush(f"{job}:results", result_string)
 
 def main():
     global params
@@ -163,20 +273,25 @@ def main():
     batch_size = params["batch_size"]
     batch_prompts = []
     batch_task_ids = []
+    # task id -> payload version to reply in
+    batch_payload_versions = {}
+    threading.Thread(target=heartbeat_loop, daemon=True).start()
 
     while True:
         print("=" * 40 + "Starting batch building")
         while len(batch_prompts) < batch_size:
-            task = r.brpoplpush("inference-engine:tasks","inference-engine:processing", timeout=5)  # timeout of 5 seconds
+            task = pop_task(timeout=5)
             if task:
                 # See orchestrator/inference.go & orchestrator/engine.go
                 task_msg = json.loads(task)
                 task_id = task_msg["task_id"]
-                inference_task = json.loads(task_msg["task"])
+                inference_task = json.loads(decode_payload(task_msg, "task"))
                 prompt = inference_task["prompt"]
 
                 batch_prompts.append(prompt)
                 batch_task_ids.append(task_id)
+                batch_payload_versions[task_id] = task_msg.get("payload_version", 0)
+                held_task_ids.append(task_id)
             else:
                 # Timeout reached, process whatever we have if it's not empty
                 if batch_prompts:
@@ -187,7 +302,8 @@ def main():
             if len(batch_prompts) > 0:
                 print("inference is disabled, abandoning batch")
                 for task_id in batch_task_ids:
-                    r.lpush("inference-engine:abandoned", task_id)
+                    r.lpush(f"{job}:abandoned", task_id)
+                held_task_ids.clear()
                 batch_prompts = []
                 batch_task_ids = []
             print("inference is disabled, waiting for it to be enabled")
@@ -196,20 +312,29 @@ def main():
 
 
 
+        cancelled = cancelled_task_ids(batch_task_ids)
+        if cancelled:
+            print(f"Dropping {len(cancelled)} cancelled tasks from batch")
+            batch_prompts = [p for p, t in zip(batch_prompts, batch_task_ids) if t not in cancelled]
+            batch_task_ids = [t for t in batch_task_ids if t not in cancelled]
+            held_task_ids[:] = batch_task_ids
+
         if not batch_prompts:
-            print("no prompts, should not be possible to reach here")
+            print("no prompts left in batch")
             continue  # No tasks, go back to waiting
 
         print("=" * 40 + "Starting batch. Len: " + str(len(batch_task_ids)))
         generated = process_batch(model, batch_prompts, batch_task_ids)
 
-        send_results(generated, batch_prompts, batch_task_ids)
+        send_results(generated, batch_prompts, batch_task_ids, batch_payload_versions)
+        held_task_ids.clear()
         del batch_prompts
         del batch_task_ids
         del generated
 
         batch_prompts=[]
         batch_task_ids=[]
+        batch_payload_versions.clear()
 
         gc.collect()
 
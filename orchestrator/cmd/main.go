@@ -28,6 +28,7 @@ func main() {
 			lambda.CreateLambdaCli(),
 			orchestrator.CreateOrchestratorCli(),
 			orchestrator.CreateGraphCreateCli(),
+			orchestrator.CreateGraphCli(),
 			orchestrator.CreateGoalFileCli(),
 			orchestrator.CreateGraphDataExportCli(),
 			orchestrator.CreateQuickfuncCli(),
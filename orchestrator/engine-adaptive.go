@@ -0,0 +1,76 @@
+package orchestrator
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+const (
+	// how far back to look when measuring throughput
+	adaptiveThroughputWindow = 10 * time.Minute
+	// below this many finished tasks in the window, throughput is estimated from the live workers instead
+	adaptiveMinFinishedTasks = 8
+)
+
+// QueueSizes returns the current MinTaskQueueSize & MaxTaskQueueSize.
+// These only differ from SchedulingParams if TargetQueueLatency is set.
+func (e *Engine) QueueSizes() (int, int) {
+	e.queueSizeMu.Lock()
+	defer e.queueSizeMu.Unlock()
+	return e.minTaskQueueSize, e.maxTaskQueueSize
+}
+
+// resizeQueue sizes the queue so a task waits about TargetQueueLatency before a worker picks it up.
+// By Little's law, queue length = throughput * latency.
+// Throughput is measured from finished tasks or (while there isn't enough data) estimated as live workers * batch size / processing time.
+// The sizes never drop below a batch per live worker (or the static MinTaskQueueSize): a smaller queue would starve workers,
+// and the lower throughput would then shrink the queue further.
+func (e *Engine) resizeQueue(ctx context.Context) {
+	params := e.schedulingParams
+	window := min(adaptiveThroughputWindow, time.Since(e.startedAt))
+	if window <= 0 {
+		return
+	}
+	stats := e.Stats(window)
+	batchSize := max(params.WorkerBatchSize, 1)
+
+	numLiveWorkers := 0
+	if workers, err := e.Workers(ctx); err != nil {
+		e.logger.Error().Err(err).Msg("Error reading workers for queue resizing")
+	} else {
+		for _, worker := range workers {
+			if worker.Alive {
+				numLiveWorkers++
+			}
+		}
+	}
+
+	var tasksPerSecond float64
+	switch {
+	case stats.TasksFinished >= adaptiveMinFinishedTasks:
+		tasksPerSecond = float64(stats.TasksFinished) / window.Seconds()
+	case numLiveWorkers > 0 && stats.ProcessingTime.P50 > 0:
+		tasksPerSecond = float64(numLiveWorkers*batchSize) / stats.ProcessingTime.P50.Seconds()
+	default:
+		// not enough information. Keep the current sizes.
+		return
+	}
+
+	maxSize := int(math.Ceil(tasksPerSecond * params.TargetQueueLatency.Seconds()))
+	// every live worker should be able to pick up a full batch immediately.
+	maxSize = max(maxSize, numLiveWorkers*batchSize, params.MinTaskQueueSize, 1)
+	if params.MaxAdaptiveQueueSize > 0 {
+		maxSize = min(maxSize, params.MaxAdaptiveQueueSize)
+	}
+	// keep the same headroom ratio as the static defaults (16/24).
+	minSize := min(max(maxSize*2/3, params.MinTaskQueueSize, 1), maxSize)
+
+	e.queueSizeMu.Lock()
+	changed := minSize != e.minTaskQueueSize || maxSize != e.maxTaskQueueSize
+	e.minTaskQueueSize, e.maxTaskQueueSize = minSize, maxSize
+	e.queueSizeMu.Unlock()
+	if changed {
+		e.logger.Info().Msgf("Resized task queue to min %d / max %d (%.3f tasks/s, %d live workers)", minSize, maxSize, tasksPerSecond, numLiveWorkers)
+	}
+}
@@ -0,0 +1,89 @@
+package orchestrator
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Cancel stops a task. No result will be delivered for it (unless the result was already on its way to the output channel).
+//
+// If no worker has picked the task up yet, it is removed from the tasks queue.
+// Otherwise its id is written to {job}:cancelled so workers can stop working on it. Workers check it before starting
+// a task and every few seconds while it runs (killing its compilation, or aborting it mid-batch for inference).
+// Workers that stop a cancelled task should drop it without pushing a result or abandoning it.
+//
+// Safe to call from any goroutine. The cancellation is applied on the camshaft's next tick.
+func (e *Engine) Cancel(id EngineTaskID) {
+	e.queuedTasksMu.Lock()
+	defer e.queuedTasksMu.Unlock()
+	if _, ok := e.cancelRequests[id]; !ok {
+		e.cancelRequests[id] = time.Now()
+	}
+}
+
+func (e *Engine) CancelledTableName() string {
+	return e.job.CancelledTableName()
+}
+
+// processCancellations applies the requests made through Cancel.
+// must only be called from the camshaft (it touches e.pending).
+func (e *Engine) processCancellations(ctx context.Context) int {
+	logger := zerolog.Ctx(ctx)
+	e.queuedTasksMu.Lock()
+	defer e.queuedTasksMu.Unlock()
+	numCancelled := 0
+	for id, requestedAt := range e.cancelRequests {
+		if e.pending.remove(id) {
+			numCancelled++
+			delete(e.cancelRequests, id)
+			continue
+		}
+		task, ok := e.queuedTasks[id]
+		if !ok {
+			if time.Since(requestedAt) < e.schedulingParams.TaskProcessingTimeout {
+				// probably still sitting in the input channel. Try again next tick.
+				continue
+			}
+			logger.Warn().Msgf("Giving up on cancelling unknown task %s", id)
+			delete(e.cancelRequests, id)
+			continue
+		}
+		if err := e.transport.RemoveTask(ctx, task.msg); err != nil {
+			logger.Error().Err(err).Msgf("Error removing cancelled task %s from the queue", id)
+			continue
+		}
+		if err := e.queue.HSet(ctx, e.job.CancelledTableName(), string(id), requestedAt.Format(time.RFC3339)); err != nil {
+			logger.Error().Err(err).Msgf("Error telling workers to cancel task %s", id)
+		}
+		delete(e.queuedTasks, id)
+		if e.schedulingParams.PersistInFlight {
+			if err := e.queue.HDel(ctx, e.job.InFlightTableName(), string(id)); err != nil {
+				logger.Error().Err(err).Msg("Error removing in-flight task")
+			}
+		}
+		numCancelled++
+		delete(e.cancelRequests, id)
+	}
+	return numCancelled
+}
+
+// pruneCancelledTable forgets cancellations that are old enough that no worker can still be holding the task.
+func (e *Engine) pruneCancelledTable(ctx context.Context) error {
+	cancelled, err := e.queue.HGetAll(ctx, e.job.CancelledTableName())
+	if err != nil {
+		return err
+	}
+	expired := []string{}
+	for id, raw := range cancelled {
+		cancelledAt, err := time.Parse(time.RFC3339, raw)
+		if err != nil || time.Since(cancelledAt) > e.schedulingParams.TaskProcessingTimeout {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	return e.queue.HDel(ctx, e.job.CancelledTableName(), expired...)
+}
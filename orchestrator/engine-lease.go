@@ -0,0 +1,73 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrEngineLeaseHeld is returned by Engine.Start if another engine is already driving the same queues.
+var ErrEngineLeaseHeld = errors.New("engine lease is held by another engine")
+
+// How long a lease outlives its holder. A crashed engine's queues can be taken over after this.
+const engineLeaseTTL = 30 * time.Second
+
+// key holding the id of the engine that currently owns {job}'s queues.
+func (j EngineJobName) LeaseKeyName() string {
+	return fmt.Sprintf("%s:lease", j)
+}
+
+func newEngineLeaseHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown-host"
+	}
+	return fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), NewEngineTaskID())
+}
+
+// acquireLease must succeed before the engine touches any queue (startup drops them).
+func (e *Engine) acquireLease(ctx context.Context) error {
+	ok, err := e.queue.SetNX(ctx, e.job.LeaseKeyName(), e.leaseHolder, engineLeaseTTL)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		holder, err := e.queue.Get(ctx, e.job.LeaseKeyName())
+		if err != nil {
+			holder = "unknown (" + err.Error() + ")"
+		}
+		return fmt.Errorf("%w: %s is held by %s. Stop it or wait up to %s for it to expire", ErrEngineLeaseHeld, e.job.LeaseKeyName(), holder, engineLeaseTTL)
+	}
+	return nil
+}
+
+// the lease keeper renews the lease until the engine stops, then releases it.
+func (e *Engine) createLeaseKeeper() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(engineLeaseTTL / 3)
+	ctx, cancel, logger := e.setupLoggerAndCtxForComponent("lease keeper")
+	defer cancel()
+	for {
+		select {
+		case <-e.shouldStopChan:
+			if _, err := e.queue.CompareAndDelete(ctx, e.job.LeaseKeyName(), e.leaseHolder); err != nil {
+				logger.Error().Err(err).Msg("Error releasing lease")
+			}
+			logger.Debug().Msg("Lease keeper stopping")
+			return
+		case <-ticker.C:
+		}
+		ok, err := e.queue.CompareAndExpire(ctx, e.job.LeaseKeyName(), e.leaseHolder, engineLeaseTTL)
+		if err != nil {
+			// the lease will survive a few failed renewals.
+			logger.Error().Err(err).Msg("Error renewing lease")
+			continue
+		}
+		if !ok {
+			// another engine may already be dropping our queues. Nothing we do from here is safe.
+			logger.Fatal().Msgf("Lost lease %s", e.job.LeaseKeyName())
+		}
+	}
+}
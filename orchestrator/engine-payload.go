@@ -0,0 +1,209 @@
+package orchestrator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Payload versions describe how the body (EngineTaskMsg.Task / EngineTaskResultMsg.Result) of a message is encoded.
+// Readers MUST accept every version; writers pick one with PayloadParams.Version (workers reply in the version of their task).
+const (
+	// the body is the raw string.
+	PayloadVersionPlain = 0
+	// the body is base64(gzip(raw)). If PayloadRef is set, the body is empty and
+	// the encoded body is stored under the {job}:payload:{sha256(raw)} key instead.
+	PayloadVersionGzip = 1
+)
+
+type PayloadParams struct {
+	Version int
+	// Encoded bodies longer than this are offloaded to a content-addressed key. 0 never offloads.
+	// Only used for PayloadVersionGzip and above.
+	OffloadThreshold int
+	// How long offloaded bodies are kept for. Should be far longer than a task can take (including requeues).
+	OffloadTTL time.Duration
+}
+
+func DefaultPayloadParams() PayloadParams {
+	return PayloadParams{
+		Version:          PayloadVersionGzip,
+		OffloadThreshold: 16 * 1024,
+		OffloadTTL:       24 * time.Hour,
+	}
+}
+
+// content-addressed (by the sha256 of the raw body) offloaded payloads. See PayloadVersionGzip.
+func (j EngineJobName) PayloadKeyName(hash string) string {
+	return fmt.Sprintf("%s:payload:%s", j, hash)
+}
+
+// PayloadCodec encodes & decodes message bodies. Shared by the engine (see PayloadTransport) and the Go workers.
+type PayloadCodec struct {
+	job    EngineJobName
+	queue  QueueBackend
+	params PayloadParams
+}
+
+func NewPayloadCodec(job EngineJobName, queue QueueBackend, params PayloadParams) *PayloadCodec {
+	return &PayloadCodec{job: job, queue: queue, params: params}
+}
+
+// EncodeTask encodes msg.Task with PayloadParams.Version. Encoding is deterministic.
+func (c *PayloadCodec) EncodeTask(ctx context.Context, msg EngineTaskMsg) (EngineTaskMsg, error) {
+	body, ref, err := c.encode(ctx, c.params.Version, msg.Task)
+	if err != nil {
+		return msg, err
+	}
+	msg.Task, msg.PayloadVersion, msg.PayloadRef = body, c.params.Version, ref
+	return msg, nil
+}
+
+func (c *PayloadCodec) DecodeTask(ctx context.Context, msg EngineTaskMsg) (EngineTaskMsg, error) {
+	body, err := c.decode(ctx, msg.PayloadVersion, msg.Task, msg.PayloadRef)
+	if err != nil {
+		return msg, err
+	}
+	msg.Task, msg.PayloadVersion, msg.PayloadRef = body, PayloadVersionPlain, ""
+	return msg, nil
+}
+
+// EncodeResult encodes msg.Result with version (normally the version of the task it answers).
+func (c *PayloadCodec) EncodeResult(ctx context.Context, msg EngineTaskResultMsg, version int) (EngineTaskResultMsg, error) {
+	body, ref, err := c.encode(ctx, version, msg.Result)
+	if err != nil {
+		return msg, err
+	}
+	msg.Result, msg.PayloadVersion, msg.PayloadRef = body, version, ref
+	return msg, nil
+}
+
+func (c *PayloadCodec) DecodeResult(ctx context.Context, msg EngineTaskResultMsg) (EngineTaskResultMsg, error) {
+	body, err := c.decode(ctx, msg.PayloadVersion, msg.Result, msg.PayloadRef)
+	if err != nil {
+		return msg, err
+	}
+	msg.Result, msg.PayloadVersion, msg.PayloadRef = body, PayloadVersionPlain, ""
+	return msg, nil
+}
+
+func (c *PayloadCodec) encode(ctx context.Context, version int, raw string) (body string, ref string, err error) {
+	switch version {
+	case PayloadVersionPlain:
+		return raw, "", nil
+	case PayloadVersionGzip:
+	default:
+		return "", "", fmt.Errorf("unknown payload version %d", version)
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(raw)); err != nil {
+		return "", "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", "", err
+	}
+	body = base64.StdEncoding.EncodeToString(buf.Bytes())
+	if c.params.OffloadThreshold == 0 || len(body) <= c.params.OffloadThreshold {
+		return body, "", nil
+	}
+	hash := sha256.Sum256([]byte(raw))
+	ref = c.job.PayloadKeyName(hex.EncodeToString(hash[:]))
+	// an identical payload may already be stored. Its ttl isn't extended, so OffloadTTL must be generous.
+	if _, err := c.queue.SetNX(ctx, ref, body, c.params.OffloadTTL); err != nil {
+		return "", "", err
+	}
+	zerolog.Ctx(ctx).Debug().Msgf("Offloaded %d byte payload to %s", len(body), ref)
+	return "", ref, nil
+}
+
+func (c *PayloadCodec) decode(ctx context.Context, version int, body string, ref string) (string, error) {
+	switch version {
+	case PayloadVersionPlain:
+		return body, nil
+	case PayloadVersionGzip:
+	default:
+		return "", fmt.Errorf("unknown payload version %d", version)
+	}
+	if ref != "" {
+		var err error
+		body, err = c.queue.Get(ctx, ref)
+		if errors.Is(err, ErrQueueEmpty) {
+			return "", fmt.Errorf("offloaded payload %s has expired", ref)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	compressed, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return "", err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// PayloadTransport encodes tasks before they reach the wrapped transport and decodes the results coming out of it.
+// It should be the innermost wrapper so everything else (ex: RecordingTransport) sees plain messages.
+type PayloadTransport struct {
+	EngineTransport
+	codec *PayloadCodec
+}
+
+var _ EngineTransport = &PayloadTransport{}
+
+func NewPayloadTransport(inner EngineTransport, job EngineJobName, queue QueueBackend, params PayloadParams) *PayloadTransport {
+	return &PayloadTransport{EngineTransport: inner, codec: NewPayloadCodec(job, queue, params)}
+}
+
+func (t *PayloadTransport) PushTask(ctx context.Context, msg EngineTaskMsg) (int64, error) {
+	encoded, err := t.codec.EncodeTask(ctx, msg)
+	if err != nil {
+		return 0, err
+	}
+	return t.EngineTransport.PushTask(ctx, encoded)
+}
+
+// RemoveTask re-encodes msg so it matches what was pushed.
+func (t *PayloadTransport) RemoveTask(ctx context.Context, msg EngineTaskMsg) error {
+	encoded, err := t.codec.EncodeTask(ctx, msg)
+	if err != nil {
+		return err
+	}
+	return t.EngineTransport.RemoveTask(ctx, encoded)
+}
+
+func (t *PayloadTransport) PopResults(ctx context.Context) ([]EngineTaskResultMsg, error) {
+	results, err := t.EngineTransport.PopResults(ctx)
+	if err != nil {
+		return results, err
+	}
+	decoded := make([]EngineTaskResultMsg, 0, len(results))
+	for _, result := range results {
+		d, err := t.codec.DecodeResult(ctx, result)
+		if err != nil {
+			// The task will time out & be requeued.
+			zerolog.Ctx(ctx).Error().Err(err).Msgf("Error decoding result for task %s", result.ID)
+			continue
+		}
+		decoded = append(decoded, d)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,67 @@
+package orchestrator
+
+import "container/heap"
+
+// pendingTasks is the camshaft's buffer between the input channel and the tasks queue.
+// Higher priority tasks are pushed to the workers first. Ties are FIFO.
+//
+// Only touched by the camshaft so it doesn't need a lock.
+type pendingTasks struct {
+	tasks   []pendingTask
+	nextSeq uint64
+}
+
+type pendingTask struct {
+	msg EngineTaskMsg
+	seq uint64
+}
+
+var _ heap.Interface = &pendingTasks{}
+
+func (p *pendingTasks) Len() int {
+	return len(p.tasks)
+}
+
+func (p *pendingTasks) Less(i, j int) bool {
+	if p.tasks[i].msg.Priority != p.tasks[j].msg.Priority {
+		return p.tasks[i].msg.Priority > p.tasks[j].msg.Priority
+	}
+	return p.tasks[i].seq < p.tasks[j].seq
+}
+
+func (p *pendingTasks) Swap(i, j int) {
+	p.tasks[i], p.tasks[j] = p.tasks[j], p.tasks[i]
+}
+
+// Push is for container/heap. Use add instead.
+func (p *pendingTasks) Push(x any) {
+	p.tasks = append(p.tasks, x.(pendingTask))
+}
+
+// Pop is for container/heap. Use next instead.
+func (p *pendingTasks) Pop() any {
+	last := p.tasks[len(p.tasks)-1]
+	p.tasks = p.tasks[:len(p.tasks)-1]
+	return last
+}
+
+func (p *pendingTasks) add(msg EngineTaskMsg) {
+	heap.Push(p, pendingTask{msg: msg, seq: p.nextSeq})
+	p.nextSeq++
+}
+
+// remove drops a task from the buffer. Returns false if it wasn't buffered.
+func (p *pendingTasks) remove(id EngineTaskID) bool {
+	for i, task := range p.tasks {
+		if task.msg.ID == id {
+			heap.Remove(p, i)
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the highest priority task. Must not be called if Len() == 0.
+func (p *pendingTasks) next() EngineTaskMsg {
+	return heap.Pop(p).(pendingTask).msg
+}
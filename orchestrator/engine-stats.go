@@ -0,0 +1,133 @@
+package orchestrator
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	// Stats are aggregated into buckets of this width. Windows are rounded up to a whole number of buckets.
+	statsBucketWidth = 10 * time.Second
+	// The longest window Engine.Stats can answer for. Older stats are dropped.
+	StatsMaxWindow = time.Hour
+	// Percentiles are exact as long as a bucket sees fewer tasks than this.
+	maxDurationSamplesPerBucket = 512
+)
+
+// statsRing is a fixed-size ring of time buckets covering StatsMaxWindow.
+// Guarded by Engine.statsMu.
+type statsRing struct {
+	buckets []statsBucket
+}
+
+type statsBucket struct {
+	// zero if the bucket has never been used
+	start           time.Time
+	merged          EngineStatEvent
+	numEvents       int
+	processingTimes []time.Duration
+	queueTimes      []time.Duration
+}
+
+func newStatsRing() *statsRing {
+	return &statsRing{
+		buckets: make([]statsBucket, StatsMaxWindow/statsBucketWidth),
+	}
+}
+
+func (r *statsRing) record(event EngineStatEvent) {
+	start := event.timestamp.Truncate(statsBucketWidth)
+	bucket := &r.buckets[int(start.UnixNano()/int64(statsBucketWidth))%len(r.buckets)]
+	if !bucket.start.Equal(start) {
+		// recycle the bucket from the last time around the ring
+		*bucket = statsBucket{
+			start:           start,
+			processingTimes: bucket.processingTimes[:0],
+			queueTimes:      bucket.queueTimes[:0],
+		}
+	}
+	bucket.merged.add(event)
+	bucket.numEvents++
+	if event.tasksFinished > 0 && len(bucket.processingTimes) < maxDurationSamplesPerBucket {
+		bucket.processingTimes = append(bucket.processingTimes, event.taskFinishedInTime)
+	}
+	if event.taskTimeSpentInQueue > 0 && len(bucket.queueTimes) < maxDurationSamplesPerBucket {
+		bucket.queueTimes = append(bucket.queueTimes, event.taskTimeSpentInQueue)
+	}
+}
+
+// merge combines every bucket that overlaps the last window.
+func (r *statsRing) merge(window time.Duration, now time.Time) (MergedStats, []time.Duration, []time.Duration) {
+	window = min(window, StatsMaxWindow)
+	cutoff := now.Add(-window)
+	merged := MergedStats{}
+	processingTimes := []time.Duration{}
+	queueTimes := []time.Duration{}
+	for _, bucket := range r.buckets {
+		if bucket.start.IsZero() || !bucket.start.Add(statsBucketWidth).After(cutoff) || bucket.start.After(now) {
+			continue
+		}
+		merged.NumEvents += bucket.numEvents
+		merged.EngineStatEvent.add(bucket.merged)
+		processingTimes = append(processingTimes, bucket.processingTimes...)
+		queueTimes = append(queueTimes, bucket.queueTimes...)
+	}
+	if merged.tasksFinished > 0 {
+		merged.AvgProcessingTimePerTask = merged.taskFinishedInTime / time.Duration(merged.tasksFinished)
+	}
+	// queue time is recorded when a task is picked up, which isn't when (or whether) it finishes
+	if merged.tasksPickedUp > 0 {
+		merged.AvgTaskTimeSpentInQueue = merged.taskTimeSpentInQueue / time.Duration(merged.tasksPickedUp)
+	}
+	return merged, processingTimes, queueTimes
+}
+
+type DurationPercentiles struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+}
+
+func durationPercentiles(samples []time.Duration) DurationPercentiles {
+	if len(samples) == 0 {
+		return DurationPercentiles{}
+	}
+	slices.Sort(samples)
+	at := func(p float64) time.Duration {
+		return samples[int(p*float64(len(samples)-1))]
+	}
+	return DurationPercentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99)}
+}
+
+// EngineStats summarizes the engine's activity over a window.
+type EngineStats struct {
+	Window                          time.Duration       `json:"window"`
+	TasksEnqueued                   int                 `json:"tasks_enqueued"`
+	TasksFinished                   int                 `json:"tasks_finished"`
+	TasksRequeued                   int                 `json:"tasks_requeued"`
+	TasksDead                       int                 `json:"tasks_dead"`
+	TasksCancelled                  int                 `json:"tasks_cancelled"`
+	WorkersLost                     int                 `json:"workers_lost"`
+	CamshaftBlockedFromBackpressure int                 `json:"camshaft_blocked_from_backpressure"`
+	AvgProcessingTime               time.Duration       `json:"avg_processing_time"`
+	ProcessingTime                  DurationPercentiles `json:"processing_time"`
+	TimeInQueue                     DurationPercentiles `json:"time_in_queue"`
+}
+
+// Stats summarizes the last window (at most StatsMaxWindow, rounded up to statsBucketWidth).
+func (e *Engine) Stats(window time.Duration) EngineStats {
+	merged, processingTimes, queueTimes := e.mergeStatsInInterval(window)
+	return EngineStats{
+		Window:                          min(window, StatsMaxWindow),
+		TasksEnqueued:                   merged.tasksEnqueued,
+		TasksFinished:                   merged.tasksFinished,
+		TasksRequeued:                   merged.tasksRequeued,
+		TasksDead:                       merged.tasksDead,
+		TasksCancelled:                  merged.tasksCancelled,
+		WorkersLost:                     merged.workersLost,
+		CamshaftBlockedFromBackpressure: merged.camshaftBlockedFromBackpressure,
+		AvgProcessingTime:               merged.AvgProcessingTimePerTask,
+		ProcessingTime:                  durationPercentiles(processingTimes),
+		TimeInQueue:                     durationPercentiles(queueTimes),
+	}
+}
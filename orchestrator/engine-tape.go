@@ -0,0 +1,301 @@
+package orchestrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// A tape is a JSONL log of the tasks sent to (and results received from) the workers of one or more engines.
+// Recording a run and replaying its tape (see ReplayTransport) reproduces the orchestrator's side of the run
+// without any workers, which makes crashes in the result handlers debuggable offline.
+type TapeEntry struct {
+	Time time.Time `json:"time"`
+	// Un-namespaced, so a tape can be replayed under any RedisNamespace.
+	Job    EngineJobName        `json:"job"`
+	Task   *EngineTaskMsg       `json:"task,omitempty"`
+	Result *EngineTaskResultMsg `json:"result,omitempty"`
+}
+
+// TapeRecorder appends TapeEntries to a file. Safe to share between engines.
+type TapeRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewTapeRecorder(path string) (*TapeRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &TapeRecorder{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (r *TapeRecorder) Record(entry TapeEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	return r.enc.Encode(entry)
+}
+
+func (r *TapeRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// RecordingTransport records every task pushed to (and every result popped from) the wrapped transport.
+// Requeued tasks are recorded every time they are pushed.
+type RecordingTransport struct {
+	EngineTransport
+	job  EngineJobName
+	tape *TapeRecorder
+}
+
+var _ EngineTransport = &RecordingTransport{}
+
+// NewRecordingTransport records the traffic of inner under job (which should not be namespaced).
+func NewRecordingTransport(inner EngineTransport, job EngineJobName, tape *TapeRecorder) *RecordingTransport {
+	return &RecordingTransport{EngineTransport: inner, job: job, tape: tape}
+}
+
+func (t *RecordingTransport) PushTask(ctx context.Context, msg EngineTaskMsg) (int64, error) {
+	n, err := t.EngineTransport.PushTask(ctx, msg)
+	if err != nil {
+		return n, err
+	}
+	if err := t.tape.Record(TapeEntry{Job: t.job, Task: &msg}); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Error recording task")
+	}
+	return n, nil
+}
+
+func (t *RecordingTransport) PopResults(ctx context.Context) ([]EngineTaskResultMsg, error) {
+	results, err := t.EngineTransport.PopResults(ctx)
+	if err != nil {
+		return results, err
+	}
+	for i := range results {
+		if err := t.tape.Record(TapeEntry{Job: t.job, Result: &results[i]}); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("Error recording result")
+		}
+	}
+	return results, nil
+}
+
+// Tapes can't match results to tasks by their exact text: tasks contain names generated during the run
+// (e.g. the branch names of new nodes), which are different every time the run is replayed.
+var generatedNamePattern = regexp.MustCompile(`(branch|node|repo-graph)-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+// tapeTaskKey replaces the generated names in task with placeholders numbered in order of first appearance.
+// Returns the key & the names that were replaced (the name of placeholder i is names[i]).
+func tapeTaskKey(task string) (string, []string) {
+	names := []string{}
+	placeholders := map[string]string{}
+	key := generatedNamePattern.ReplaceAllStringFunc(task, func(name string) string {
+		placeholder, ok := placeholders[name]
+		if !ok {
+			placeholder = fmt.Sprintf("{generated-%d}", len(names))
+			placeholders[name] = placeholder
+			names = append(names, name)
+		}
+		return placeholder
+	})
+	return key, names
+}
+
+type tapeResult struct {
+	Result string
+	// the generated names of the task that produced Result
+	Names []string
+}
+
+// Tape holds the recorded results of each job, keyed by the content of the task that produced them (see tapeTaskKey).
+type Tape struct {
+	// job -> task key -> results in the order they were recorded
+	results map[EngineJobName]map[string][]tapeResult
+}
+
+// LoadTape reads a tape written by a TapeRecorder. Results are matched to their task by id.
+// Results for tasks that were never recorded are dropped.
+func LoadTape(path string) (*Tape, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	type taskKey struct {
+		job EngineJobName
+		id  EngineTaskID
+	}
+	tasks := map[taskKey]string{}
+	tape := &Tape{results: map[EngineJobName]map[string][]tapeResult{}}
+	scanner := bufio.NewScanner(file)
+	// inference prompts & compilation outputs are far larger than the default 64k
+	scanner.Buffer(make([]byte, 0, 1024*1024), 256*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry TapeEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("tape %s line %d: %w", path, line, err)
+		}
+		switch {
+		case entry.Task != nil:
+			tasks[taskKey{entry.Job, entry.Task.ID}] = entry.Task.Task
+		case entry.Result != nil:
+			task, ok := tasks[taskKey{entry.Job, entry.Result.ID}]
+			if !ok {
+				continue
+			}
+			if tape.results[entry.Job] == nil {
+				tape.results[entry.Job] = map[string][]tapeResult{}
+			}
+			key, names := tapeTaskKey(task)
+			tape.results[entry.Job][key] = append(tape.results[entry.Job][key], tapeResult{Result: entry.Result.Result, Names: names})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tape, nil
+}
+
+// copyGraphForReplay saves rg (loaded from graphPath) to outPath & links the graph's archive next to it,
+// so a replay never writes to the graph (or the event logs) it started from.
+// If outPath is empty, a new file next to graphPath is used. Returns the path to replay into.
+func copyGraphForReplay(rg *RepoGraph, graphPath string, outPath string) (string, error) {
+	if outPath == "" {
+		outPath = fmt.Sprintf("%s.replay-%s.json", graphPath, time.Now().UTC().Format(graphSnapshotTimeFormat))
+	}
+	if outPath == graphPath {
+		return "", errors.New("a tape can't be replayed into the graph it starts from")
+	}
+	if err := NewGraphArchive(graphPath).CopyTo(NewGraphArchive(outPath)); err != nil {
+		return "", err
+	}
+	if err := rg.SaveToFile(outPath); err != nil {
+		return "", err
+	}
+	return outPath, nil
+}
+
+// ReplayTransport answers tasks with the results recorded on a Tape instead of sending them to workers.
+// Identical tasks (up to their generated names) are answered with their recorded results in order.
+// The generated names in a recorded result are replaced with the corresponding names of the replayed task.
+// Tasks without a recorded result never finish, but they don't hold up the rest of the queue.
+type ReplayTransport struct {
+	job EngineJobName
+
+	mu      sync.Mutex
+	results map[string][]tapeResult
+	// answered tasks are "picked up" by the next PopProcessing and returned by the PopResults after that.
+	started  []EngineTaskResultMsg
+	finished []EngineTaskResultMsg
+}
+
+var _ EngineTransport = &ReplayTransport{}
+
+// NewReplayTransport replays the results recorded under job (which should not be namespaced).
+// The tape is consumed, so each Tape should only be used for one run.
+func NewReplayTransport(job EngineJobName, tape *Tape) *ReplayTransport {
+	results := tape.results[job]
+	if results == nil {
+		results = map[string][]tapeResult{}
+	}
+	return &ReplayTransport{
+		job:     job,
+		results: results,
+	}
+}
+
+func (t *ReplayTransport) Reset(ctx context.Context) error {
+	return nil
+}
+
+func (t *ReplayTransport) Resume(ctx context.Context) error {
+	return nil
+}
+
+func (t *ReplayTransport) NumWaitingTasks(ctx context.Context) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return int64(len(t.started)), nil
+}
+
+func (t *ReplayTransport) PushTask(ctx context.Context, msg EngineTaskMsg) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key, names := tapeTaskKey(msg.Task)
+	recorded := t.results[key]
+	if len(recorded) == 0 {
+		zerolog.Ctx(ctx).Warn().Str("job", string(t.job)).Msgf("No recorded result for task %s. It will never finish", msg.ID)
+		return int64(len(t.started)), nil
+	}
+	t.results[key] = recorded[1:]
+	// same key, so both tasks have the same number of generated names
+	replacements := make([]string, 0, 2*len(names))
+	for i, name := range recorded[0].Names {
+		replacements = append(replacements, name, names[i])
+	}
+	result := strings.NewReplacer(replacements...).Replace(recorded[0].Result)
+	t.started = append(t.started, EngineTaskResultMsg{ID: msg.ID, Result: result})
+	return int64(len(t.started)), nil
+}
+
+func (t *ReplayTransport) PopProcessing(ctx context.Context) ([]EngineTaskID, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := make([]EngineTaskID, 0, len(t.started))
+	for _, result := range t.started {
+		ids = append(ids, result.ID)
+	}
+	t.finished = append(t.finished, t.started...)
+	t.started = nil
+	return ids, nil
+}
+
+func (t *ReplayTransport) PopAbandoned(ctx context.Context) ([]EngineTaskID, error) {
+	return nil, nil
+}
+
+func (t *ReplayTransport) PopResults(ctx context.Context) ([]EngineTaskResultMsg, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	results := t.finished
+	t.finished = nil
+	return results, nil
+}
+
+func (t *ReplayTransport) AckResults(ctx context.Context, results []EngineTaskResultMsg) error {
+	return nil
+}
+
+func (t *ReplayTransport) RemoveTask(ctx context.Context, msg EngineTaskMsg) error {
+	return nil
+}
+
+func (t *ReplayTransport) Release(ctx context.Context, ids []EngineTaskID) error {
+	return nil
+}
+
+func (t *ReplayTransport) TracksProcessing() bool {
+	return false
+}
+
+func (t *ReplayTransport) ClaimTimedOut(ctx context.Context, timeout time.Duration) ([]EngineTaskID, error) {
+	return nil, errors.New("replay transport does not track processing tasks")
+}
@@ -0,0 +1,206 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// EngineTransport moves messages between the engine and its workers.
+// The engine owns all scheduling decisions; the transport only knows how to talk to the workers.
+type EngineTransport interface {
+	// Reset drops all queues owned by the transport. Called once on engine startup.
+	Reset(ctx context.Context) error
+	// Resume picks up the queues left behind by a previous engine instead of dropping them.
+	// Called on startup in place of Reset when the engine persists its in-flight tasks.
+	Resume(ctx context.Context) error
+	// NumWaitingTasks is the number of tasks that have not been picked up by a worker yet.
+	NumWaitingTasks(ctx context.Context) (int64, error)
+	// PushTask returns the number of waiting tasks after the push.
+	PushTask(ctx context.Context, msg EngineTaskMsg) (int64, error)
+	// PopProcessing returns the tasks that workers have started since the last call.
+	PopProcessing(ctx context.Context) ([]EngineTaskID, error)
+	// PopAbandoned returns the tasks that workers knowingly gave up on since the last call.
+	PopAbandoned(ctx context.Context) ([]EngineTaskID, error)
+	PopResults(ctx context.Context) ([]EngineTaskResultMsg, error)
+	// AckResults is called once the results returned by PopResults have been handled by the engine.
+	AckResults(ctx context.Context, results []EngineTaskResultMsg) error
+	// RemoveTask takes a task back before a worker picks it up. A no-op if it has already been picked up.
+	RemoveTask(ctx context.Context, msg EngineTaskMsg) error
+	// Release forgets the current attempt of tasks the engine has decided to requeue on its own (e.g. their worker died).
+	Release(ctx context.Context, ids []EngineTaskID) error
+	// TracksProcessing is true if the transport knows how long each task has been processing.
+	// If false, the engine falls back to its own bookkeeping in queuedTasks.
+	TracksProcessing() bool
+	// ClaimTimedOut returns (and forgets) the tasks that have been processing for longer than timeout.
+	// Only called if TracksProcessing is true.
+	ClaimTimedOut(ctx context.Context, timeout time.Duration) ([]EngineTaskID, error)
+}
+
+// priority queue of EngineTaskMsg (see QueueBackend.PriorityPush). Each task is in the band of its EngineTaskMsg.Priority.
+func (j EngineJobName) TasksQueueName() string {
+	return fmt.Sprintf("%s:tasks", j)
+}
+func (j EngineJobName) ProcessingQueueName() string {
+	return fmt.Sprintf("%s:processing", j)
+}
+func (j EngineJobName) ResultsQueueName() string {
+	return fmt.Sprintf("%s:results", j)
+}
+func (j EngineJobName) AbandonedQueueName() string {
+	return fmt.Sprintf("%s:abandoned", j)
+}
+
+// list of DeadTaskMsg. Never dropped by the engine; clear it by hand once the tasks have been looked at.
+func (j EngineJobName) DeadQueueName() string {
+	return fmt.Sprintf("%s:dead", j)
+}
+
+// hash of EngineTaskID -> time the task was cancelled (RFC3339). See Engine.Cancel.
+func (j EngineJobName) CancelledTableName() string {
+	return fmt.Sprintf("%s:cancelled", j)
+}
+
+// hash of EngineTaskID -> persistedTask. Only written if SchedulingParams.PersistInFlight is set.
+func (j EngineJobName) InFlightTableName() string {
+	return fmt.Sprintf("%s:in-flight", j)
+}
+
+// hash of EngineTaskID -> NodeLocator. Written by the orchestrator (see TaskLocatorTable).
+// Dropped with the queues on startup unless SchedulingParams.PersistInFlight is set.
+func (j EngineJobName) LocatorTableName() string {
+	return fmt.Sprintf("%s:locators", j)
+}
+
+// ListTransport is the original list-based protocol described on Engine.
+type ListTransport struct {
+	job   EngineJobName
+	queue QueueBackend
+}
+
+var _ EngineTransport = &ListTransport{}
+
+func NewListTransport(job EngineJobName, queue QueueBackend) *ListTransport {
+	return &ListTransport{job: job, queue: queue}
+}
+
+func (t *ListTransport) Reset(ctx context.Context) error {
+	if err := t.queue.PriorityDel(ctx, t.job.TasksQueueName()); err != nil {
+		return err
+	}
+	return t.queue.Del(ctx,
+		t.job.ProcessingQueueName(),
+		t.job.ResultsQueueName(),
+		t.job.AbandonedQueueName(),
+	)
+}
+
+// Resume is a no-op: the lists are left exactly as the previous engine left them.
+func (t *ListTransport) Resume(ctx context.Context) error {
+	return nil
+}
+
+func (t *ListTransport) NumWaitingTasks(ctx context.Context) (int64, error) {
+	return t.queue.PriorityLen(ctx, t.job.TasksQueueName())
+}
+
+func (t *ListTransport) PushTask(ctx context.Context, msg EngineTaskMsg) (int64, error) {
+	return t.queue.PriorityPush(ctx, t.job.TasksQueueName(), msg.Priority, msg.toJSON())
+}
+
+// popAll drains at most the current length of the queue (new entries are left for the next call).
+func (t *ListTransport) popAll(ctx context.Context, queue string) ([]string, error) {
+	logger := zerolog.Ctx(ctx)
+	size, err := t.queue.LLen(ctx, queue)
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]string, 0, size)
+	for i := 0; i < int(size); i++ {
+		m, err := t.queue.RPop(ctx, queue)
+		if errors.Is(err, ErrQueueEmpty) {
+			break
+		}
+		if err != nil {
+			logger.Error().Err(err).Msgf("Error popping from %s", queue)
+			continue
+		}
+		vals = append(vals, m)
+	}
+	return vals, nil
+}
+
+func (t *ListTransport) PopProcessing(ctx context.Context) ([]EngineTaskID, error) {
+	logger := zerolog.Ctx(ctx)
+	vals, err := t.popAll(ctx, t.job.ProcessingQueueName())
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]EngineTaskID, 0, len(vals))
+	for _, m := range vals {
+		msg, err := engineTaskMsgFromJSON(m)
+		if err != nil {
+			// This is fatal because the task won't get requeued and will be lost.
+			logger.Fatal().Err(err).Msg("Error unmarshalling processing message")
+		}
+		ids = append(ids, msg.ID)
+	}
+	return ids, nil
+}
+
+func (t *ListTransport) PopAbandoned(ctx context.Context) ([]EngineTaskID, error) {
+	vals, err := t.popAll(ctx, t.job.AbandonedQueueName())
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]EngineTaskID, 0, len(vals))
+	for _, m := range vals {
+		ids = append(ids, EngineTaskID(m))
+	}
+	return ids, nil
+}
+
+func (t *ListTransport) PopResults(ctx context.Context) ([]EngineTaskResultMsg, error) {
+	logger := zerolog.Ctx(ctx)
+	vals, err := t.popAll(ctx, t.job.ResultsQueueName())
+	if err != nil {
+		return nil, err
+	}
+	results := make([]EngineTaskResultMsg, 0, len(vals))
+	for _, m := range vals {
+		resultMsg, err := engineTaskResultMsgFromJSON(m)
+		if err != nil {
+			logger.Error().Err(err).Msg("Error unmarshalling result message")
+			continue
+		}
+		results = append(results, *resultMsg)
+	}
+	return results, nil
+}
+
+// AckResults is a no-op: results are removed from the list when they are popped.
+func (t *ListTransport) AckResults(ctx context.Context, results []EngineTaskResultMsg) error {
+	return nil
+}
+
+func (t *ListTransport) RemoveTask(ctx context.Context, msg EngineTaskMsg) error {
+	// a requeued task is pushed with identical json, so this removes every copy.
+	_, err := t.queue.PriorityRem(ctx, t.job.TasksQueueName(), msg.Priority, msg.toJSON())
+	return err
+}
+
+// Release is a no-op: the processing list is already drained by the timing belt.
+func (t *ListTransport) Release(ctx context.Context, ids []EngineTaskID) error {
+	return nil
+}
+
+func (t *ListTransport) TracksProcessing() bool {
+	return false
+}
+
+func (t *ListTransport) ClaimTimedOut(ctx context.Context, timeout time.Duration) ([]EngineTaskID, error) {
+	return nil, errors.New("list transport does not track processing tasks")
+}
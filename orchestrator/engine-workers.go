@@ -0,0 +1,101 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// WorkerHeartbeat is written by every worker to {job}:workers (hash of worker name -> WorkerHeartbeat).
+// Workers should rewrite it every few seconds (and whenever they pick up or finish a task)
+// listing every task they currently hold.
+//
+// If SchedulingParams.WorkerHeartbeatTimeout is set, the timing belt requeues the tasks of any worker
+// whose heartbeat is older than the timeout instead of waiting for TaskProcessingTimeout.
+type WorkerHeartbeat struct {
+	Name          string         `json:"name"`
+	LastHeartbeat time.Time      `json:"last_heartbeat"`
+	TaskIDs       []EngineTaskID `json:"task_ids"`
+}
+
+type WorkerStatus struct {
+	WorkerHeartbeat
+	Alive bool `json:"alive"`
+}
+
+// hash of worker name -> WorkerHeartbeat. Written by the workers.
+func (j EngineJobName) WorkersTableName() string {
+	return fmt.Sprintf("%s:workers", j)
+}
+
+func (e *Engine) WorkersTableName() string {
+	return e.job.WorkersTableName()
+}
+
+// Workers returns every worker that has registered with the engine, sorted by name.
+// If WorkerHeartbeatTimeout is not set, all workers are considered alive.
+func (e *Engine) Workers(ctx context.Context) ([]WorkerStatus, error) {
+	raw, err := e.queue.HGetAll(ctx, e.job.WorkersTableName())
+	if err != nil {
+		return nil, err
+	}
+	workers := make([]WorkerStatus, 0, len(raw))
+	for name, val := range raw {
+		var heartbeat WorkerHeartbeat
+		if err := json.Unmarshal([]byte(val), &heartbeat); err != nil {
+			e.logger.Warn().Err(err).Msgf("Ignoring unparsable heartbeat from worker %s", name)
+			continue
+		}
+		heartbeat.Name = name
+		timeout := e.schedulingParams.WorkerHeartbeatTimeout
+		workers = append(workers, WorkerStatus{
+			WorkerHeartbeat: heartbeat,
+			Alive:           timeout == 0 || time.Since(heartbeat.LastHeartbeat) < timeout,
+		})
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Name < workers[j].Name
+	})
+	return workers, nil
+}
+
+// requeueDeadWorkers marks every task held by a dead worker as abandoned so the camshaft requeues it,
+// then unregisters the worker. Returns the number of workers removed.
+func (e *Engine) requeueDeadWorkers(ctx context.Context) (int, error) {
+	workers, err := e.Workers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	numDead := 0
+	for _, worker := range workers {
+		if worker.Alive {
+			continue
+		}
+		released := []EngineTaskID{}
+		func() {
+			e.queuedTasksMu.Lock()
+			defer e.queuedTasksMu.Unlock()
+			for _, id := range worker.TaskIDs {
+				task, ok := e.queuedTasks[id]
+				if !ok {
+					continue
+				}
+				// same signal as an abandoned task (see the timing belt)
+				task.ProcessingStartTime = &time.Time{}
+				e.queuedTasks[id] = task
+				released = append(released, id)
+			}
+		}()
+		if err := e.transport.Release(ctx, released); err != nil {
+			return numDead, err
+		}
+		if err := e.queue.HDel(ctx, e.job.WorkersTableName(), worker.Name); err != nil {
+			return numDead, err
+		}
+		e.logger.Warn().Msgf("Worker %s missed its heartbeat (last seen %s). Requeueing %d tasks", worker.Name, worker.LastHeartbeat, len(released))
+		numDead++
+	}
+	return numDead, nil
+}
@@ -4,23 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
 )
 
-// Engine is a safe task-execution tool for distributing work through redis.
-// It uses 4 queues:
-// - {job}:tasks - tasks to be picked up by workers
+// Engine is a safe task-execution tool for distributing work through redis
+// (or any other QueueBackend, such as the in-memory one used in tests).
+// The default (list) transport uses 4 queues:
+// - {job}:tasks - tasks to be picked up by workers, highest priority first
 //   - Writer: orchestrator
 //   - Reader: workers
-//   - Datatype: EngineTaskMsg
+//   - Datatype: EngineTaskMsg, in one list per priority ({job}:tasks:{priority}, see QueueBackend.PriorityPush)
 //
-// - {job}:processing - tasks that were picked up by workers via r.brpoplpush("{job}:tasks", "{job}:processing")
+// - {job}:processing - tasks that were picked up by workers via QueueBackend.BPriorityPopLPush("{job}:tasks", "{job}:processing")
 //   - Writer: workers
 //   - Reader: orchestrator
 //   - Datatype: EngineTaskProcessingMsg
@@ -35,59 +34,114 @@ import (
 //   - Reader: orchestrator
 //   - Datatype: EngineTaskID (string)
 //
+// - {job}:cancelled - tasks that workers should stop working on (see Engine.Cancel)
+//   - Writer: orchestrator
+//   - Reader: workers
+//   - Datatype: hash of EngineTaskID -> time of cancellation
+//
+// - {job}:workers - optional worker registry & heartbeats (see WorkerHeartbeat)
+//   - Writer: workers
+//   - Reader: orchestrator
+//   - Datatype: hash of worker name -> WorkerHeartbeat
+//
 // The engine receives its tasks from a channel and then writes all the results to the results channel.
 // It is NOT safe to have multiple engines touching the same queues, however it is safe to have multiple workers.
+// Start takes a lease on {job}:lease (renewed while the engine runs) and fails with ErrEngineLeaseHeld if another engine holds it.
 //
 // The engine ensures that if the workers crash, no work is lost (though it may be reordered).
-// However, it is the caller's responsibility to ensure that if the engine crashes, all in-progress work will be requeued.
+// However, it is the caller's responsibility to ensure that if the engine crashes, all in-progress work will be requeued
+// (or to set SchedulingParams.PersistInFlight so a restarted engine picks up where the last one left off).
 //
 // The consumer is expected to read from the output channel as fast as possible. The engine won't read from the input channel
 // until the results channel is empty (back-pressure).
 //
-// The workers MUST use brpoplpush to receive tasks and they MUST push exactly one result per task they process (even if that result is an error).
+// The workers MUST use BPriorityPopLPush (or its lua script) to receive tasks and they MUST push exactly one result per task they process (even if that result is an error).
+//
+// If SchedulingParams.MaxAttempts is set, a task that times out or is abandoned that many times is pushed to {job}:dead
+// (Datatype: DeadTaskMsg) and the consumer receives a result with EngineError set instead of waiting forever.
+//
+// Large task & result bodies can be compressed and offloaded to content-addressed keys (see PayloadTransport).
+// See RecordingTransport & ReplayTransport to record a run's worker traffic and replay it without workers.
 type EngineTaskMsg struct {
 	ID   EngineTaskID `json:"task_id"`
 	Task string       `json:"task"`
+	// Higher priority tasks are sent to the workers first, including over lower priority tasks already in {job}:tasks
+	// (see SchedulingParams.PriorityBufferSize).
+	Priority int `json:"priority,omitempty"`
+	// How Task is encoded (see PayloadVersionGzip). Always plain outside of the transport.
+	PayloadVersion int    `json:"payload_version,omitempty"`
+	PayloadRef     string `json:"payload_ref,omitempty"`
 }
 type EngineTaskProcessingMsg struct {
-	ID   EngineTaskID `json:"task_id"`
-	Task string       `json:"task"`
+	ID             EngineTaskID `json:"task_id"`
+	Task           string       `json:"task"`
+	Priority       int          `json:"priority,omitempty"`
+	PayloadVersion int          `json:"payload_version,omitempty"`
+	PayloadRef     string       `json:"payload_ref,omitempty"`
 }
 type EngineTaskResultMsg struct {
 	ID     EngineTaskID `json:"task_id"`
 	Result string       `json:"result"`
+	// How Result is encoded (see PayloadVersionGzip). Workers reply in the version of their task.
+	PayloadVersion int    `json:"payload_version,omitempty"`
+	PayloadRef     string `json:"payload_ref,omitempty"`
+	// Set by the engine (never by a worker) when the task could not be run. Result is empty.
+	EngineError string `json:"engine_error,omitempty"`
 }
 
 type QueuedTask struct {
 	msg                 EngineTaskMsg
 	CreationTime        time.Time
 	ProcessingStartTime *time.Time
+	// number of times the task has been pushed to the workers
+	Attempts int
+}
+
+type DeadTaskMsg struct {
+	Msg      EngineTaskMsg `json:"msg"`
+	Attempts int           `json:"attempts"`
+	DiedAt   time.Time     `json:"died_at"`
 }
 
 type Engine struct {
-	job EngineJobName
+	job         EngineJobName
+	leaseHolder string
 
-	rdb    *redis.Client
-	logger *zerolog.Logger
+	queue     QueueBackend
+	transport EngineTransport
+	logger    *zerolog.Logger
 
 	wg             *sync.WaitGroup
 	shouldStopChan chan bool
 
 	// only read from camshaft
 	taskInput chan EngineTaskMsg
+	// only touched by camshaft
+	pending *pendingTasks
 	// only write from crankshaft
 	taskOutput chan EngineTaskResultMsg
 
 	queuedTasksMu sync.Mutex
 	//TODO: This should be map to pointer
 	queuedTasks map[EngineTaskID]QueuedTask
+	// error results for dead tasks. Written by the camshaft, sent by the crankshaft.
+	deadResults []EngineTaskResultMsg
+	// see Cancel. Applied by the camshaft.
+	cancelRequests map[EngineTaskID]time.Time
 
 	// read-only
 	schedulingParams SchedulingParams
+	startedAt        time.Time
+
+	// start as SchedulingParams.Min/MaxTaskQueueSize. Only change if TargetQueueLatency is set.
+	queueSizeMu      sync.Mutex
+	minTaskQueueSize int
+	maxTaskQueueSize int
 
 	// must not block aquisition of queuedTasksMu
 	statsMu sync.Mutex
-	stats   []EngineStatEvent
+	stats   *statsRing
+	metrics engineMetrics
 }
 type EngineJobName string
 
@@ -99,8 +153,17 @@ const (
 )
 
 type SchedulingParams struct {
+	// The camshaft tops the queue up to MaxTaskQueueSize once it falls to MinTaskQueueSize.
+	// Only the starting values if TargetQueueLatency is set.
 	MinTaskQueueSize int
 	MaxTaskQueueSize int
+	// If set, the queue is resized (by the odb) so tasks wait about this long for a worker.
+	TargetQueueLatency time.Duration
+	// Upper bound for the adaptive MaxTaskQueueSize. 0 means unbounded.
+	MaxAdaptiveQueueSize int
+	// How many tasks a worker takes at once (e.g. the inference batch size). 0 means 1.
+	// The adaptive queue never drops below a batch per live worker.
+	WorkerBatchSize int
 	// how long a task can be processing before it is requeued
 	TaskProcessingTimeout time.Duration
 
@@ -117,34 +180,77 @@ type SchedulingParams struct {
 
 	// If true, the engine will not block reading from the input channel.
 	DisableBackpressure bool
+
+	// How many tasks the camshaft may hold back from the input channel so it can send the highest priority ones first.
+	// The camshaft always reads at least enough tasks to fill the queue, so 0 only orders tasks within a single tick.
+	PriorityBufferSize int
+
+	// How long a worker can go without a heartbeat before its tasks are requeued. 0 disables the check
+	// (workers that don't heartbeat still fall back to TaskProcessingTimeout).
+	WorkerHeartbeatTimeout time.Duration
+
+	// Number of times a task is sent to the workers before it is given up on. 0 means retry forever.
+	MaxAttempts int
+
+	// If true, in-flight tasks are written to {job}:in-flight and the queues are resumed
+	// (instead of dropped) on startup. Results for tasks sent before a restart will still be delivered.
+	PersistInFlight bool
+}
+
+// NewEngine creates an engine that speaks the list protocol over queue.
+func NewEngine(ctx context.Context, job EngineJobName, queue QueueBackend, schedulingParams SchedulingParams) *Engine {
+	return NewEngineWithTransport(ctx, job, queue, NewListTransport(job, queue), schedulingParams)
 }
 
-func NewEngine(ctx context.Context, job EngineJobName, rdb *redis.Client, schedulingParams SchedulingParams) *Engine {
+// NewEngineWithTransport creates an engine that talks to its workers through transport.
+// queue is still used for the engine's own bookkeeping.
+func NewEngineWithTransport(ctx context.Context, job EngineJobName, queue QueueBackend, transport EngineTransport, schedulingParams SchedulingParams) *Engine {
 	parentLogger := zerolog.Ctx(ctx)
 	logger := parentLogger.With().Str("job", string(job)).Logger()
 
 	return &Engine{
 		job:              job,
-		rdb:              rdb,
+		leaseHolder:      newEngineLeaseHolder(),
+		queue:            queue,
+		transport:        transport,
 		logger:           &logger,
 		wg:               &sync.WaitGroup{},
 		shouldStopChan:   make(chan bool),
 		taskInput:        make(chan EngineTaskMsg, schedulingParams.InputChanSize),
+		pending:          &pendingTasks{},
 		taskOutput:       make(chan EngineTaskResultMsg, schedulingParams.OutputChanSize),
 		queuedTasksMu:    sync.Mutex{},
 		queuedTasks:      make(map[EngineTaskID]QueuedTask),
+		cancelRequests:   make(map[EngineTaskID]time.Time),
+		stats:            newStatsRing(),
+		metrics:          newEngineMetrics(),
 		schedulingParams: schedulingParams,
+		minTaskQueueSize: schedulingParams.MinTaskQueueSize,
+		maxTaskQueueSize: schedulingParams.MaxTaskQueueSize,
 	}
 }
 
 func (e *Engine) Start(ctx context.Context) error {
 	e.logger.Debug().Msg("Starting engine")
+	e.startedAt = time.Now()
 
-	err := e.dropQueuesForStartup(ctx)
+	if err := e.acquireLease(ctx); err != nil {
+		return err
+	}
+	var err error
+	if e.schedulingParams.PersistInFlight {
+		err = e.resumeQueuesForStartup(ctx)
+	} else {
+		err = e.dropQueuesForStartup(ctx)
+	}
 	if err != nil {
+		if _, releaseErr := e.queue.CompareAndDelete(ctx, e.job.LeaseKeyName(), e.leaseHolder); releaseErr != nil {
+			e.logger.Error().Err(releaseErr).Msg("Error releasing lease")
+		}
 		return err
 	}
-	e.wg.Add(4)
+	e.wg.Add(5)
+	go e.createLeaseKeeper()
 	go e.createCamshaft()
 	go e.createCrankshaft()
 	go e.createTimingBelt()
@@ -154,25 +260,75 @@ func (e *Engine) Start(ctx context.Context) error {
 }
 func (e *Engine) dropQueuesForStartup(ctx context.Context) error {
 	e.logger.Debug().Msg("Dropping queues for startup")
-	err := e.rdb.Del(ctx, e.TasksQueueName()).Err()
-	if err != nil {
+	if err := e.queue.Del(ctx, e.job.InFlightTableName(), e.job.WorkersTableName(), e.job.CancelledTableName(), e.job.LocatorTableName()); err != nil {
 		return err
 	}
-	err = e.rdb.Del(ctx, e.ProcessingQueueName()).Err()
-	if err != nil {
-		return err
+	return e.transport.Reset(ctx)
+}
+
+type persistedTask struct {
+	Msg          EngineTaskMsg `json:"msg"`
+	CreationTime time.Time     `json:"creation_time"`
+	Attempts     int           `json:"attempts"`
+}
+
+// must be called with queuedTasksMu held.
+func (e *Engine) persistInFlight(ctx context.Context, task QueuedTask) error {
+	if !e.schedulingParams.PersistInFlight {
+		return nil
 	}
-	err = e.rdb.Del(ctx, e.ResultsQueueName()).Err()
+	persisted, err := json.Marshal(persistedTask{Msg: task.msg, CreationTime: task.CreationTime, Attempts: task.Attempts})
 	if err != nil {
+		panic(err)
+	}
+	return e.queue.HSet(ctx, e.job.InFlightTableName(), string(task.msg.ID), string(persisted))
+}
+
+func (e *Engine) resumeQueuesForStartup(ctx context.Context) error {
+	e.logger.Debug().Msg("Resuming queues for startup")
+	if err := e.transport.Resume(ctx); err != nil {
 		return err
 	}
-	err = e.rdb.Del(ctx, e.AbandonedQueueName()).Err()
+	persisted, err := e.queue.HGetAll(ctx, e.job.InFlightTableName())
 	if err != nil {
 		return err
 	}
+	e.queuedTasksMu.Lock()
+	defer e.queuedTasksMu.Unlock()
+	// We don't know which of these were being processed when the last engine died.
+	// Treat them all as just-started so the ones that were lost get requeued after the timeout.
+	now := time.Now()
+	for id, raw := range persisted {
+		var task persistedTask
+		if err := json.Unmarshal([]byte(raw), &task); err != nil {
+			e.logger.Error().Err(err).Msgf("Dropping unparsable in-flight task %s", id)
+			continue
+		}
+		e.queuedTasks[task.Msg.ID] = QueuedTask{
+			msg:                 task.Msg,
+			CreationTime:        task.CreationTime,
+			ProcessingStartTime: &now,
+			Attempts:            task.Attempts,
+		}
+	}
+	e.logger.Info().Msgf("Resumed %d in-flight tasks", len(e.queuedTasks))
 	return nil
 }
 
+// HasTask returns true if the engine is still waiting on a result for id.
+func (e *Engine) HasTask(id EngineTaskID) bool {
+	e.queuedTasksMu.Lock()
+	defer e.queuedTasksMu.Unlock()
+	_, ok := e.queuedTasks[id]
+	return ok
+}
+
+// Queue is the backend the engine keeps its bookkeeping in.
+// Consumers may use it to persist their own per-task state next to the engine's.
+func (e *Engine) Queue() QueueBackend {
+	return e.queue
+}
+
 func (e *Engine) TriggerStop() {
 	close(e.shouldStopChan)
 }
@@ -183,16 +339,19 @@ func (e *Engine) WaitForStop() {
 }
 
 func (e *Engine) TasksQueueName() string {
-	return fmt.Sprintf("%s:tasks", e.job)
+	return e.job.TasksQueueName()
 }
 func (e *Engine) ProcessingQueueName() string {
-	return fmt.Sprintf("%s:processing", e.job)
+	return e.job.ProcessingQueueName()
 }
 func (e *Engine) ResultsQueueName() string {
-	return fmt.Sprintf("%s:results", e.job)
+	return e.job.ResultsQueueName()
 }
 func (e *Engine) AbandonedQueueName() string {
-	return fmt.Sprintf("%s:abandoned", e.job)
+	return e.job.AbandonedQueueName()
+}
+func (e *Engine) DeadQueueName() string {
+	return e.job.DeadQueueName()
 }
 func (e *Engine) GetInput() chan<- EngineTaskMsg {
 	return e.taskInput
@@ -227,41 +386,71 @@ func (e *Engine) createCamshaft() {
 			camshaftStarted: 1,
 		})
 
+		// before requeueing so we don't requeue anything that was cancelled.
+		e.recordStatEvent(EngineStatEvent{
+			tasksCancelled: e.processCancellations(ctx),
+		})
+
 		// requeue tasks that have been processing for too long.
 		// We do this before enqueing new tasks to avoid over-filling the queue.
+		timedOut := map[EngineTaskID]bool{}
+		if e.transport.TracksProcessing() {
+			ids, err := e.transport.ClaimTimedOut(ctx, e.schedulingParams.TaskProcessingTimeout)
+			if err != nil {
+				logger.Error().Err(err).Msg("Failed to claim timed out tasks")
+			}
+			for _, id := range ids {
+				timedOut[id] = true
+			}
+		}
 		func() {
 			e.queuedTasksMu.Lock()
 			defer e.queuedTasksMu.Unlock()
 			numTasksRequeued := 0
+			numTasksDead := 0
 
 			for _, task := range e.queuedTasks {
-				if task.ProcessingStartTime != nil && time.Since(*task.ProcessingStartTime) > e.schedulingParams.TaskProcessingTimeout {
-					taskMsg := task.msg.toJSON()
-					err := e.rdb.LPush(ctx, e.TasksQueueName(), taskMsg).Err()
-					if err != nil {
-						logger.Error().Err(err).Msg("Failed to requeue timed out task")
-						continue
-					}
-					// reset processing start time
-					task.ProcessingStartTime = nil
-					e.queuedTasks[task.msg.ID] = task
-					numTasksRequeued++
+				if !e.shouldRequeue(task, timedOut) {
+					continue
+				}
+				if e.schedulingParams.MaxAttempts > 0 && task.Attempts >= e.schedulingParams.MaxAttempts {
+					e.killTask(ctx, task)
+					numTasksDead++
+					continue
 				}
+				_, err := e.transport.PushTask(ctx, task.msg)
+				if err != nil {
+					logger.Error().Err(err).Msg("Failed to requeue timed out task")
+					continue
+				}
+				// reset processing start time
+				task.ProcessingStartTime = nil
+				task.Attempts++
+				e.queuedTasks[task.msg.ID] = task
+				if err := e.persistInFlight(ctx, task); err != nil {
+					logger.Error().Err(err).Msg("Error persisting in-flight task")
+				}
+				numTasksRequeued++
 			}
 			logger.Debug().Msgf("Requeued %d tasks", numTasksRequeued)
+			if numTasksDead > 0 {
+				logger.Warn().Msgf("%d tasks ran out of attempts", numTasksDead)
+			}
 			e.recordStatEvent(EngineStatEvent{
 				tasksRequeued: numTasksRequeued,
+				tasksDead:     numTasksDead,
 			})
 		}()
 
 		// the job of this routine is to keep this queue fed. Not to care about the
 		// fake e.queuedTasks which is just a monitoring tool and doesn't have to be strictly accurate
-		tasksQueueSize, err := e.rdb.LLen(ctx, e.TasksQueueName()).Result()
+		tasksQueueSize, err := e.transport.NumWaitingTasks(ctx)
 		if err != nil {
 			logger.Error().Err(err).Msg("Error getting tasks queue size")
 			continue
 		}
-		if tasksQueueSize > int64(e.schedulingParams.MinTaskQueueSize) {
+		minTaskQueueSize, maxTaskQueueSize := e.QueueSizes()
+		if tasksQueueSize > int64(minTaskQueueSize) {
 			// Don't do anything if we have enough tasks.
 			continue
 		}
@@ -274,9 +463,10 @@ func (e *Engine) createCamshaft() {
 			})
 			continue
 		}
-		numTasksToAdd := e.schedulingParams.MaxTaskQueueSize - int(tasksQueueSize)
-		tasks := make([]EngineTaskMsg, 0, numTasksToAdd)
-		for i := 0; i < numTasksToAdd; i++ {
+		numTasksToAdd := maxTaskQueueSize - int(tasksQueueSize)
+		bufferSize := max(numTasksToAdd, e.schedulingParams.PriorityBufferSize)
+	fillBuffer:
+		for e.pending.Len() < bufferSize {
 			select {
 			case <-e.shouldStopChan:
 				logger.Debug().Msg("Camshaft stopping without adding any tasks")
@@ -288,11 +478,16 @@ func (e *Engine) createCamshaft() {
 				if task.ID == "" {
 					task.ID = NewEngineTaskID()
 				}
-				tasks = append(tasks, task)
+				e.pending.add(task)
 			default:
 				// no task to add.
+				break fillBuffer
 			}
 		}
+		tasks := make([]EngineTaskMsg, 0, numTasksToAdd)
+		for len(tasks) < numTasksToAdd && e.pending.Len() > 0 {
+			tasks = append(tasks, e.pending.next())
+		}
 
 		func() {
 			e.queuedTasksMu.Lock()
@@ -300,20 +495,24 @@ func (e *Engine) createCamshaft() {
 
 			lastK := 0
 			for _, msg := range tasks {
-				e.queuedTasks[msg.ID] = QueuedTask{
+				queuedTask := QueuedTask{
 					msg:                 msg,
 					CreationTime:        time.Now(),
 					ProcessingStartTime: nil,
+					Attempts:            1,
+				}
+				e.queuedTasks[msg.ID] = queuedTask
+				if err := e.persistInFlight(ctx, queuedTask); err != nil {
+					logger.Error().Err(err).Msg("Error persisting in-flight task")
 				}
-				msg := msg.toJSON()
 				// Could be done outside the lock. Optimize if needed.
-				res := e.rdb.LPush(ctx, e.TasksQueueName(), msg)
-				if res.Err() != nil {
+				queueLen, err := e.transport.PushTask(ctx, msg)
+				if err != nil {
 					// This is non-fatal because the task will get requeued.
-					logger.Error().Err(res.Err()).Msg("Error pushing tasks to queue")
+					logger.Error().Err(err).Msg("Error pushing tasks to queue")
 					continue
 				}
-				lastK = int(res.Val())
+				lastK = int(queueLen)
 			}
 			e.recordStatEvent(EngineStatEvent{
 				tasksEnqueued: len(tasks),
@@ -347,34 +546,20 @@ func (e *Engine) createCrankshaft() {
 			crankshaftStarted: 1,
 		})
 
-		resultsQueueSize, err := e.rdb.LLen(ctx, e.ResultsQueueName()).Result()
+		results, err := e.transport.PopResults(ctx)
 		if err != nil {
-			logger.Error().Err(err).Msg("Error getting results queue size")
-			continue
-		}
-		if resultsQueueSize == 0 {
+			logger.Error().Err(err).Msg("Error popping results")
 			continue
 		}
-		resultsToSend := make([]EngineTaskResultMsg, 0, resultsQueueSize)
-		results := make([]EngineTaskResultMsg, 0, resultsQueueSize)
-		for i := 0; i < int(resultsQueueSize); i++ {
-			m, err := e.rdb.RPop(ctx, e.ResultsQueueName()).Result()
-			if err != nil {
-				logger.Error().Err(err).Msg("Error popping results from queue")
-				continue
-			}
-			resultMsg, err := engineTaskResultMsgFromJSON(m)
-			if err != nil {
-				logger.Error().Err(err).Msg("Error unmarshalling result message")
-				continue
-			}
-			results = append(results, *resultMsg)
-		}
+		resultsToSend := make([]EngineTaskResultMsg, 0, len(results))
 
 		func() {
 			e.queuedTasksMu.Lock()
 			defer e.queuedTasksMu.Unlock()
 
+			resultsToSend = append(resultsToSend, e.deadResults...)
+			e.deadResults = nil
+
 			for _, result := range results {
 				queuedTask, ok := e.queuedTasks[result.ID]
 				if !ok {
@@ -395,9 +580,17 @@ func (e *Engine) createCrankshaft() {
 					})
 				}
 				delete(e.queuedTasks, result.ID)
+				if e.schedulingParams.PersistInFlight {
+					if err := e.queue.HDel(ctx, e.job.InFlightTableName(), string(result.ID)); err != nil {
+						logger.Error().Err(err).Msg("Error removing in-flight task")
+					}
+				}
 				resultsToSend = append(resultsToSend, result)
 			}
 		}()
+		if len(resultsToSend) == 0 && len(results) == 0 {
+			continue
+		}
 		logger.Debug().Msgf("Sending %d results to output channel", len(resultsToSend))
 		for _, result := range resultsToSend {
 			select {
@@ -407,6 +600,10 @@ func (e *Engine) createCrankshaft() {
 			case e.taskOutput <- result:
 			}
 		}
+		// ack everything (including the results we dropped) so they aren't redelivered.
+		if err := e.transport.AckResults(ctx, results); err != nil {
+			logger.Error().Err(err).Msg("Error acking results")
+		}
 		e.recordStatEvent(EngineStatEvent{
 			crankshaftExecuted:      1,
 			crankshaftExecutionTime: time.Since(startTime),
@@ -431,22 +628,16 @@ func (e *Engine) createTimingBelt() {
 		case <-ticker.C:
 		}
 		startTime := time.Now()
-		abandonedQueueSize, err := e.rdb.LLen(ctx, e.AbandonedQueueName()).Result()
+		abandonedIDs, err := e.transport.PopAbandoned(ctx)
 		if err != nil {
-			logger.Error().Err(err).Msg("Error getting abandoned queue size")
+			logger.Error().Err(err).Msg("Error popping abandoned tasks")
 			continue
 		}
 		func() {
 			e.queuedTasksMu.Lock()
 			defer e.queuedTasksMu.Unlock()
 
-			for i := 0; i < int(abandonedQueueSize); i++ {
-				m, err := e.rdb.RPop(ctx, e.AbandonedQueueName()).Result()
-				if err != nil {
-					logger.Error().Err(err).Msg("Error popping abandoned from queue")
-					continue
-				}
-				abandonedID := EngineTaskID(m)
+			for _, abandonedID := range abandonedIDs {
 				abandonedTask, ok := e.queuedTasks[abandonedID]
 				if !ok {
 					logger.Warn().Msgf("Found abandoned task that is not in the queue: %+v", abandonedID)
@@ -464,51 +655,51 @@ func (e *Engine) createTimingBelt() {
 			timingBeltStarted: 1,
 		})
 
-		// TODO: This length thing is stupid. Just read with timeout.
-		processingQueueSize, err := e.rdb.LLen(ctx, e.ProcessingQueueName()).Result()
+		if err := e.pruneCancelledTable(ctx); err != nil {
+			logger.Error().Err(err).Msg("Error pruning cancelled tasks")
+		}
+
+		if e.schedulingParams.WorkerHeartbeatTimeout > 0 {
+			numLost, err := e.requeueDeadWorkers(ctx)
+			if err != nil {
+				logger.Error().Err(err).Msg("Error requeueing tasks of dead workers")
+			}
+			e.recordStatEvent(EngineStatEvent{
+				workersLost: numLost,
+			})
+		}
+
+		processingIDs, err := e.transport.PopProcessing(ctx)
 		if err != nil {
-			logger.Error().Err(err).Msg("Error getting processing queue size")
+			logger.Error().Err(err).Msg("Error popping processing tasks")
 			continue
 		}
-		if processingQueueSize == 0 {
+		if len(processingIDs) == 0 {
 			continue
 		}
-		processingMsgs := make([]EngineTaskMsg, 0, processingQueueSize)
-		for i := 0; i < int(processingQueueSize); i++ {
-			m, err := e.rdb.RPop(ctx, e.ProcessingQueueName()).Result()
-			if err != nil {
-				logger.Error().Err(err).Msg("Error popping processing from queue")
-				continue
-			}
-			msg, err := engineTaskMsgFromJSON(m)
-			if err != nil {
-				// This is fatal because the task won't get requeued and will be lost.
-				logger.Fatal().Err(err).Msg("Error unmarshalling processing message")
-			}
-			processingMsgs = append(processingMsgs, *msg)
-		}
 
 		func() {
 			e.queuedTasksMu.Lock()
 			defer e.queuedTasksMu.Unlock()
 
-			for _, msg := range processingMsgs {
-				task, ok := e.queuedTasks[msg.ID]
+			for _, id := range processingIDs {
+				task, ok := e.queuedTasks[id]
 				if !ok {
-					logger.Warn().Msgf("Found processing message for task that is not in the queue: %+v", msg)
+					logger.Warn().Msgf("Found processing message for task that is not in the queue: %s", id)
 					continue
 				}
 
 				e.recordStatEvent(EngineStatEvent{
+					tasksPickedUp:        1,
 					taskTimeSpentInQueue: startTime.Sub(task.CreationTime),
 				})
 
 				if task.ProcessingStartTime == nil {
 					// use job start time to reduce the impact of reading from the queue & from waiting on the lock.
 					task.ProcessingStartTime = &startTime
-					e.queuedTasks[msg.ID] = task
+					e.queuedTasks[id] = task
 				} else {
-					logger.Warn().Msgf("Found processing message for abandoned or already-processed task: %s", msg.ID)
+					logger.Warn().Msgf("Found processing message for abandoned or already-processed task: %s", id)
 				}
 			}
 		}()
@@ -519,11 +710,55 @@ func (e *Engine) createTimingBelt() {
 	}
 }
 
-// the odb emits stats to the logger.
+// killTask moves a task that has run out of attempts to the dead queue
+// and queues an error result for the consumer.
+// must be called with queuedTasksMu held.
+func (e *Engine) killTask(ctx context.Context, task QueuedTask) {
+	logger := zerolog.Ctx(ctx)
+	dead, err := json.Marshal(DeadTaskMsg{Msg: task.msg, Attempts: task.Attempts, DiedAt: time.Now()})
+	if err != nil {
+		panic(err)
+	}
+	if _, err := e.queue.LPush(ctx, e.job.DeadQueueName(), string(dead)); err != nil {
+		// still fail the task. Retrying it forever is what we are trying to avoid.
+		logger.Error().Err(err).Msgf("Error pushing task %s to the dead queue", task.msg.ID)
+	}
+	delete(e.queuedTasks, task.msg.ID)
+	if e.schedulingParams.PersistInFlight {
+		if err := e.queue.HDel(ctx, e.job.InFlightTableName(), string(task.msg.ID)); err != nil {
+			logger.Error().Err(err).Msg("Error removing in-flight task")
+		}
+	}
+	e.deadResults = append(e.deadResults, EngineTaskResultMsg{
+		ID:          task.msg.ID,
+		EngineError: fmt.Sprintf("task gave up after %d attempts", task.Attempts),
+	})
+}
+
+// must be called with queuedTasksMu held.
+func (e *Engine) shouldRequeue(task QueuedTask, timedOut map[EngineTaskID]bool) bool {
+	if timedOut[task.msg.ID] {
+		return true
+	}
+	if task.ProcessingStartTime == nil {
+		return false
+	}
+	// abandoned (see the timing belt)
+	if task.ProcessingStartTime.IsZero() {
+		return true
+	}
+	if e.transport.TracksProcessing() {
+		return false
+	}
+	return time.Since(*task.ProcessingStartTime) > e.schedulingParams.TaskProcessingTimeout
+}
+
+// the odb emits stats to the logger (and resizes the queue if TargetQueueLatency is set).
+// Use Engine.Stats to read them programmatically.
 func (e *Engine) createOBD() {
 	defer e.wg.Done()
 	ticker := time.NewTicker(e.schedulingParams.ODBInterval)
-	_, cancel, logger := e.setupLoggerAndCtxForComponent("odb")
+	ctx, cancel, logger := e.setupLoggerAndCtxForComponent("odb")
 	defer cancel()
 	for {
 		select {
@@ -537,15 +772,21 @@ func (e *Engine) createOBD() {
 		e.recordStatEvent(EngineStatEvent{
 			odbStarted: 1,
 		})
+		if e.schedulingParams.TargetQueueLatency > 0 {
+			e.resizeQueue(ctx)
+		}
 		statsLines := []string{}
-		statsLines = append(statsLines, "Emitting stats")
-		mergedStats := e.mergeStatsInInterval(nil)
+		statsLines = append(statsLines, fmt.Sprintf("Emitting stats for the last %s", StatsMaxWindow))
+		mergedStats, _, _ := e.mergeStatsInInterval(StatsMaxWindow)
 		statsLines = append(statsLines, fmt.Sprintf("\tNum stat events: %d", mergedStats.NumEvents))
 		statsLines = append(statsLines, fmt.Sprintf("\tTasks finished: %d", mergedStats.tasksFinished))
 		statsLines = append(statsLines, fmt.Sprintf("\tTasks enqueued: %d", mergedStats.tasksEnqueued))
 		statsLines = append(statsLines, fmt.Sprintf("\tAvg processing time per task: %s", mergedStats.AvgProcessingTimePerTask))
 		statsLines = append(statsLines, "")
 		statsLines = append(statsLines, fmt.Sprintf("\tTasks requeued: %d", mergedStats.tasksRequeued))
+		statsLines = append(statsLines, fmt.Sprintf("\tTasks dead: %d", mergedStats.tasksDead))
+		statsLines = append(statsLines, fmt.Sprintf("\tTasks cancelled: %d", mergedStats.tasksCancelled))
+		statsLines = append(statsLines, fmt.Sprintf("\tWorkers lost: %d", mergedStats.workersLost))
 		statsLines = append(statsLines, fmt.Sprintf("\tAvg task time spent in queue: %s", mergedStats.AvgTaskTimeSpentInQueue))
 		statsLines = append(statsLines, "")
 		statsLines = append(statsLines, fmt.Sprintf("\tCamshaft blocked from backpressure: %d", mergedStats.camshaftBlockedFromBackpressure))
@@ -565,6 +806,12 @@ func (e *Engine) createOBD() {
 		statsLines = append(statsLines, fmt.Sprintf("\tOBD executed: %d", mergedStats.odbExecuted))
 		statsLines = append(statsLines, fmt.Sprintf("\tOBD execution time: %s", mergedStats.odbExecutionTime))
 		statsLines = append(statsLines, "")
+		for _, window := range []time.Duration{time.Minute, 10 * time.Minute, time.Hour} {
+			stats := e.Stats(window)
+			statsLines = append(statsLines, fmt.Sprintf("\t%s processing time p50/p90/p99: %s / %s / %s", window, stats.ProcessingTime.P50, stats.ProcessingTime.P90, stats.ProcessingTime.P99))
+			statsLines = append(statsLines, fmt.Sprintf("\t%s time in queue p50/p90/p99: %s / %s / %s", window, stats.TimeInQueue.P50, stats.TimeInQueue.P90, stats.TimeInQueue.P99))
+		}
+		statsLines = append(statsLines, "")
 		logger.Debug().Msg(strings.Join(statsLines, "\n"))
 
 		e.recordStatEvent(EngineStatEvent{
@@ -576,13 +823,17 @@ func (e *Engine) createOBD() {
 
 // EngineStatEvent is a single stat event.
 // It is important that the null-value indicates that the stat is not set.
-// 🚩 If you add a new stat, make sure to add it to the mergedStatsInInterval function & the OBD.
+// 🚩 If you add a new stat, make sure to add it to EngineStatEvent.add, the OBD & engineMetrics (if it should be exported).
 type EngineStatEvent struct {
 	timestamp                       time.Time
 	tasksFinished                   int
 	taskFinishedInTime              time.Duration
 	tasksEnqueued                   int
 	tasksRequeued                   int
+	tasksDead                       int
+	tasksCancelled                  int
+	workersLost                     int
+	tasksPickedUp                   int
 	taskTimeSpentInQueue            time.Duration
 	camshaftBlockedFromBackpressure int
 	// started == was scheduled
@@ -608,46 +859,36 @@ type MergedStats struct {
 	AvgTaskTimeSpentInQueue  time.Duration
 }
 
-func (e *Engine) mergeStatsInInterval(interval *time.Duration) MergedStats {
+func (m *EngineStatEvent) add(event EngineStatEvent) {
+	m.tasksFinished += event.tasksFinished
+	m.taskFinishedInTime += event.taskFinishedInTime
+	m.tasksEnqueued += event.tasksEnqueued
+	m.tasksRequeued += event.tasksRequeued
+	m.tasksDead += event.tasksDead
+	m.tasksCancelled += event.tasksCancelled
+	m.workersLost += event.workersLost
+	m.tasksPickedUp += event.tasksPickedUp
+	m.taskTimeSpentInQueue += event.taskTimeSpentInQueue
+	m.camshaftBlockedFromBackpressure += event.camshaftBlockedFromBackpressure
+	m.camshaftStarted += event.camshaftStarted
+	m.camshaftExecuted += event.camshaftExecuted
+	m.camshaftExecutionTime += event.camshaftExecutionTime
+	m.crankshaftStarted += event.crankshaftStarted
+	m.crankshaftExecuted += event.crankshaftExecuted
+	m.crankshaftExecutionTime += event.crankshaftExecutionTime
+	m.timingBeltStarted += event.timingBeltStarted
+	m.timingBeltExecuted += event.timingBeltExecuted
+	m.timingBeltExecutionTime += event.timingBeltExecutionTime
+	m.odbStarted += event.odbStarted
+	m.odbExecuted += event.odbExecuted
+	m.odbExecutionTime += event.odbExecutionTime
+}
+
+// mergeStatsInInterval also returns the processing & queue time samples in the interval (for percentiles).
+func (e *Engine) mergeStatsInInterval(interval time.Duration) (MergedStats, []time.Duration, []time.Duration) {
 	e.statsMu.Lock()
 	defer e.statsMu.Unlock()
-
-	startIndex := 0
-	if interval != nil {
-		startIndex = sort.Search(len(e.stats), func(i int) bool {
-			return e.stats[i].timestamp.Add(*interval).After(time.Now())
-		})
-	}
-	mergedStats := MergedStats{}
-	mergedEvent := EngineStatEvent{}
-	for i := startIndex; i < len(e.stats); i++ {
-		mergedStats.NumEvents++
-		event := e.stats[i]
-		mergedEvent.tasksFinished += event.tasksFinished
-		mergedEvent.taskFinishedInTime += event.taskFinishedInTime
-		mergedEvent.tasksEnqueued += event.tasksEnqueued
-		mergedEvent.tasksRequeued += event.tasksRequeued
-		mergedEvent.taskTimeSpentInQueue += event.taskTimeSpentInQueue
-		mergedEvent.camshaftBlockedFromBackpressure += event.camshaftBlockedFromBackpressure
-		mergedEvent.camshaftStarted += event.camshaftStarted
-		mergedEvent.camshaftExecuted += event.camshaftExecuted
-		mergedEvent.camshaftExecutionTime += event.camshaftExecutionTime
-		mergedEvent.crankshaftStarted += event.crankshaftStarted
-		mergedEvent.crankshaftExecuted += event.crankshaftExecuted
-		mergedEvent.crankshaftExecutionTime += event.crankshaftExecutionTime
-		mergedEvent.timingBeltStarted += event.timingBeltStarted
-		mergedEvent.timingBeltExecuted += event.timingBeltExecuted
-		mergedEvent.timingBeltExecutionTime += event.timingBeltExecutionTime
-		mergedEvent.odbStarted += event.odbStarted
-		mergedEvent.odbExecuted += event.odbExecuted
-		mergedEvent.odbExecutionTime += event.odbExecutionTime
-	}
-	mergedStats.EngineStatEvent = mergedEvent
-	if mergedEvent.tasksFinished > 0 {
-		mergedStats.AvgProcessingTimePerTask = mergedEvent.taskFinishedInTime / time.Duration(mergedEvent.tasksFinished)
-		mergedStats.AvgTaskTimeSpentInQueue = mergedEvent.taskTimeSpentInQueue / time.Duration(mergedEvent.tasksFinished)
-	}
-	return mergedStats
+	return e.stats.merge(interval, time.Now())
 }
 
 func (e *Engine) recordStatEvent(event EngineStatEvent) {
@@ -656,7 +897,8 @@ func (e *Engine) recordStatEvent(event EngineStatEvent) {
 	// it is important that the timestamp is calculated with the lock so the stats are in order
 	// (even though that slightly messes with the stats)
 	event.timestamp = time.Now()
-	e.stats = append(e.stats, event)
+	e.stats.record(event)
+	e.metrics.record(event)
 }
 
 func (t *EngineTaskMsg) toJSON() string {
@@ -667,6 +909,14 @@ func (t *EngineTaskMsg) toJSON() string {
 	return string(msg)
 }
 
+func (t *EngineTaskResultMsg) toJSON() string {
+	msg, err := json.Marshal(t)
+	if err != nil {
+		panic(err)
+	}
+	return string(msg)
+}
+
 func engineTaskMsgFromJSON(input string) (*EngineTaskMsg, error) {
 	var msg EngineTaskMsg
 	err := json.Unmarshal([]byte(input), &msg)
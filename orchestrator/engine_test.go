@@ -0,0 +1,528 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testSchedulingParams(taskProcessingTimeout time.Duration) SchedulingParams {
+	return SchedulingParams{
+		MinTaskQueueSize:      4,
+		MaxTaskQueueSize:      8,
+		TaskProcessingTimeout: taskProcessingTimeout,
+		CamShaftInterval:      5 * time.Millisecond,
+		CrankShaftInterval:    5 * time.Millisecond,
+		TimingBeltInterval:    5 * time.Millisecond,
+		ODBInterval:           time.Second,
+		InputChanSize:         4,
+		OutputChanSize:        4,
+	}
+}
+
+func newTestEngine(t *testing.T, queue QueueBackend, taskProcessingTimeout time.Duration) *Engine {
+	return startTestEngine(t, queue, testSchedulingParams(taskProcessingTimeout))
+}
+
+func startTestEngine(t *testing.T, queue QueueBackend, params SchedulingParams) *Engine {
+	ctx := context.Background()
+	engine := NewEngine(ctx, EngineJobNameTest, queue, params)
+	require.NoError(t, engine.Start(ctx))
+	t.Cleanup(func() {
+		engine.TriggerStop()
+		engine.WaitForStop()
+	})
+	return engine
+}
+
+// testWorkerPop behaves like a worker picking up a task.
+func testWorkerPop(t *testing.T, engine *Engine, queue QueueBackend) *EngineTaskMsg {
+	m, err := queue.BPriorityPopLPush(context.Background(), engine.TasksQueueName(), engine.ProcessingQueueName(), 2*time.Second)
+	require.NoError(t, err)
+	msg, err := engineTaskMsgFromJSON(m)
+	require.NoError(t, err)
+	return msg
+}
+
+func testWorkerPushResult(t *testing.T, engine *Engine, queue QueueBackend, id EngineTaskID, result string) {
+	msg := EngineTaskResultMsg{ID: id, Result: result}
+	_, err := queue.LPush(context.Background(), engine.ResultsQueueName(), msg.toJSON())
+	require.NoError(t, err)
+}
+
+func requireEngineOutput(t *testing.T, engine *Engine) EngineTaskResultMsg {
+	select {
+	case result := <-engine.GetOutput():
+		return result
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "timed out waiting for engine output")
+	}
+	return EngineTaskResultMsg{}
+}
+
+func TestEngine_MemoryBackendRoundTrip(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	engine := newTestEngine(t, queue, time.Minute)
+
+	engine.GetInput() <- EngineTaskMsg{Task: "hello"}
+	task := testWorkerPop(t, engine, queue)
+	require.Equal(t, "hello", task.Task)
+	require.True(t, IsValidEngineTaskID(task.ID))
+
+	testWorkerPushResult(t, engine, queue, task.ID, "world")
+	result := requireEngineOutput(t, engine)
+	require.Equal(t, task.ID, result.ID)
+	require.Equal(t, "world", result.Result)
+}
+
+func TestEngine_RequeueOnTimeout(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	engine := newTestEngine(t, queue, 50*time.Millisecond)
+
+	engine.GetInput() <- EngineTaskMsg{Task: "slow"}
+	// this worker "crashes" and never responds
+	first := testWorkerPop(t, engine, queue)
+
+	second := testWorkerPop(t, engine, queue)
+	require.Equal(t, first.ID, second.ID)
+
+	testWorkerPushResult(t, engine, queue, second.ID, "done")
+	result := requireEngineOutput(t, engine)
+	require.Equal(t, first.ID, result.ID)
+}
+
+func TestEngine_RequeueOnAbandon(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	// long enough that only abandonment can requeue the task
+	engine := newTestEngine(t, queue, time.Hour)
+
+	engine.GetInput() <- EngineTaskMsg{Task: "abandon me"}
+	first := testWorkerPop(t, engine, queue)
+	_, err := queue.LPush(context.Background(), engine.AbandonedQueueName(), string(first.ID))
+	require.NoError(t, err)
+
+	second := testWorkerPop(t, engine, queue)
+	require.Equal(t, first.ID, second.ID)
+
+	testWorkerPushResult(t, engine, queue, second.ID, "done")
+	result := requireEngineOutput(t, engine)
+	require.Equal(t, first.ID, result.ID)
+}
+
+func TestEngine_ResumeInFlight(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	params := testSchedulingParams(time.Hour)
+	params.PersistInFlight = true
+
+	ctx := context.Background()
+	first := NewEngine(ctx, EngineJobNameTest, queue, params)
+	require.NoError(t, first.Start(ctx))
+	first.GetInput() <- EngineTaskMsg{Task: "survive a restart"}
+	task := testWorkerPop(t, first, queue)
+	first.TriggerStop()
+	first.WaitForStop()
+
+	second := startTestEngine(t, queue, params)
+	require.True(t, second.HasTask(task.ID))
+
+	testWorkerPushResult(t, second, queue, task.ID, "done")
+	result := requireEngineOutput(t, second)
+	require.Equal(t, task.ID, result.ID)
+	require.Equal(t, "done", result.Result)
+}
+
+func TestEngine_DeadAfterMaxAttempts(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	params := testSchedulingParams(time.Hour)
+	params.MaxAttempts = 2
+	engine := startTestEngine(t, queue, params)
+
+	engine.GetInput() <- EngineTaskMsg{Task: "poison"}
+	for i := 0; i < params.MaxAttempts; i++ {
+		task := testWorkerPop(t, engine, queue)
+		_, err := queue.LPush(context.Background(), engine.AbandonedQueueName(), string(task.ID))
+		require.NoError(t, err)
+	}
+
+	result := requireEngineOutput(t, engine)
+	require.NotEmpty(t, result.EngineError)
+	require.False(t, engine.HasTask(result.ID))
+
+	dead, err := queue.RPop(context.Background(), engine.DeadQueueName())
+	require.NoError(t, err)
+	var deadMsg DeadTaskMsg
+	require.NoError(t, json.Unmarshal([]byte(dead), &deadMsg))
+	require.Equal(t, result.ID, deadMsg.Msg.ID)
+	require.Equal(t, params.MaxAttempts, deadMsg.Attempts)
+}
+
+func TestEngine_RequeueOnDeadWorker(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	params := testSchedulingParams(time.Hour)
+	params.WorkerHeartbeatTimeout = time.Minute
+	engine := startTestEngine(t, queue, params)
+
+	engine.GetInput() <- EngineTaskMsg{Task: "crash"}
+	first := testWorkerPop(t, engine, queue)
+	heartbeat, err := json.Marshal(WorkerHeartbeat{
+		Name:          "worker-1",
+		LastHeartbeat: time.Now().Add(-2 * time.Minute),
+		TaskIDs:       []EngineTaskID{first.ID},
+	})
+	require.NoError(t, err)
+	require.NoError(t, queue.HSet(context.Background(), engine.WorkersTableName(), "worker-1", string(heartbeat)))
+
+	second := testWorkerPop(t, engine, queue)
+	require.Equal(t, first.ID, second.ID)
+	workers, err := engine.Workers(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, workers)
+}
+
+func TestEngine_HighestPriorityFirst(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	ctx := context.Background()
+	engine := NewEngine(ctx, EngineJobNameTest, queue, testSchedulingParams(time.Hour))
+	// queue everything up before the camshaft's first tick
+	engine.GetInput() <- EngineTaskMsg{Task: "low", Priority: 1}
+	engine.GetInput() <- EngineTaskMsg{Task: "high", Priority: 10}
+	engine.GetInput() <- EngineTaskMsg{Task: "also low", Priority: 1}
+	require.NoError(t, engine.Start(ctx))
+	t.Cleanup(func() {
+		engine.TriggerStop()
+		engine.WaitForStop()
+	})
+
+	require.Equal(t, "high", testWorkerPop(t, engine, queue).Task)
+	require.Equal(t, "low", testWorkerPop(t, engine, queue).Task)
+	require.Equal(t, "also low", testWorkerPop(t, engine, queue).Task)
+}
+
+func TestEngine_HighPriorityOvertakesQueuedTasks(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	engine := newTestEngine(t, queue, time.Hour)
+	ctx := context.Background()
+
+	engine.GetInput() <- EngineTaskMsg{Task: "low", Priority: 1}
+	engine.GetInput() <- EngineTaskMsg{Task: "also low", Priority: 1}
+	require.Eventually(t, func() bool {
+		n, err := queue.PriorityLen(ctx, engine.TasksQueueName())
+		return err == nil && n == 2
+	}, 2*time.Second, 5*time.Millisecond)
+	engine.GetInput() <- EngineTaskMsg{Task: "high", Priority: 10}
+	require.Eventually(t, func() bool {
+		n, err := queue.PriorityLen(ctx, engine.TasksQueueName())
+		return err == nil && n == 3
+	}, 2*time.Second, 5*time.Millisecond)
+
+	require.Equal(t, "high", testWorkerPop(t, engine, queue).Task)
+	require.Equal(t, "low", testWorkerPop(t, engine, queue).Task)
+	require.Equal(t, "also low", testWorkerPop(t, engine, queue).Task)
+}
+
+func TestEngine_Cancel(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	engine := newTestEngine(t, queue, time.Hour)
+	ctx := context.Background()
+
+	engine.GetInput() <- EngineTaskMsg{Task: "in flight"}
+	inFlight := testWorkerPop(t, engine, queue)
+	queued := EngineTaskMsg{ID: NewEngineTaskID(), Task: "queued"}
+	engine.GetInput() <- queued
+	require.Eventually(t, func() bool {
+		n, err := queue.PriorityLen(ctx, engine.TasksQueueName())
+		return err == nil && n == 1
+	}, 2*time.Second, 5*time.Millisecond)
+
+	engine.Cancel(inFlight.ID)
+	engine.Cancel(queued.ID)
+	require.Eventually(t, func() bool {
+		return !engine.HasTask(inFlight.ID) && !engine.HasTask(queued.ID)
+	}, 2*time.Second, 5*time.Millisecond)
+
+	n, err := queue.PriorityLen(ctx, engine.TasksQueueName())
+	require.NoError(t, err)
+	require.Zero(t, n)
+	cancelled, err := queue.HGetAll(ctx, engine.CancelledTableName())
+	require.NoError(t, err)
+	require.Contains(t, cancelled, string(inFlight.ID))
+}
+
+func TestStatsRing_WindowsAndPercentiles(t *testing.T) {
+	ring := newStatsRing()
+	now := time.Now()
+	for i := 1; i <= 100; i++ {
+		ring.record(EngineStatEvent{
+			timestamp:          now.Add(-30 * time.Second),
+			tasksFinished:      1,
+			taskFinishedInTime: time.Duration(i) * time.Second,
+		})
+	}
+	// old enough to only show up in the larger window
+	ring.record(EngineStatEvent{timestamp: now.Add(-30 * time.Minute), tasksFinished: 1, taskFinishedInTime: time.Hour})
+	// older than the ring. Must never be counted.
+	ring.record(EngineStatEvent{timestamp: now.Add(-2 * StatsMaxWindow), tasksFinished: 1})
+
+	merged, processingTimes, _ := ring.merge(time.Minute, now)
+	require.Equal(t, 100, merged.tasksFinished)
+	percentiles := durationPercentiles(processingTimes)
+	require.Equal(t, 50*time.Second, percentiles.P50)
+	require.Equal(t, 90*time.Second, percentiles.P90)
+	require.Equal(t, 99*time.Second, percentiles.P99)
+
+	merged, _, _ = ring.merge(time.Hour, now)
+	require.Equal(t, 101, merged.tasksFinished)
+}
+
+func TestStatsRing_AvgQueueTimeCountsPickUps(t *testing.T) {
+	ring := newStatsRing()
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		ring.record(EngineStatEvent{timestamp: now, tasksPickedUp: 1, taskTimeSpentInQueue: 10 * time.Second})
+	}
+	// only one of the picked up tasks has finished
+	ring.record(EngineStatEvent{timestamp: now, tasksFinished: 1, taskFinishedInTime: time.Minute})
+
+	merged, _, _ := ring.merge(time.Minute, now)
+	require.Equal(t, 10*time.Second, merged.AvgTaskTimeSpentInQueue)
+	require.Equal(t, time.Minute, merged.AvgProcessingTimePerTask)
+}
+
+func TestEngine_ResizeQueueFromThroughput(t *testing.T) {
+	params := testSchedulingParams(time.Hour)
+	params.TargetQueueLatency = 100 * time.Second
+	engine := NewEngine(context.Background(), EngineJobNameTest, NewMemoryQueueBackend(), params)
+	engine.startedAt = time.Now().Add(-time.Hour)
+	// 60 tasks in the last 10 minutes = 0.1 tasks/s
+	for i := 0; i < 60; i++ {
+		engine.recordStatEvent(EngineStatEvent{tasksFinished: 1, taskFinishedInTime: time.Second})
+	}
+
+	engine.resizeQueue(context.Background())
+	minSize, maxSize := engine.QueueSizes()
+	require.Equal(t, 10, maxSize)
+	require.Equal(t, 6, minSize)
+}
+
+func TestEngine_ResizeQueueKeepsABatchPerWorker(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	params := testSchedulingParams(time.Hour)
+	params.TargetQueueLatency = 100 * time.Second
+	params.WorkerBatchSize = 8
+	engine := NewEngine(context.Background(), EngineJobNameTest, queue, params)
+	engine.startedAt = time.Now().Add(-time.Hour)
+	for _, name := range []string{"worker-1", "worker-2"} {
+		heartbeat, err := json.Marshal(WorkerHeartbeat{Name: name, LastHeartbeat: time.Now()})
+		require.NoError(t, err)
+		require.NoError(t, queue.HSet(context.Background(), engine.WorkersTableName(), name, string(heartbeat)))
+	}
+	// 0.1 tasks/s would only be a queue of 10
+	for i := 0; i < 60; i++ {
+		engine.recordStatEvent(EngineStatEvent{tasksFinished: 1, taskFinishedInTime: time.Second})
+	}
+
+	engine.resizeQueue(context.Background())
+	minSize, maxSize := engine.QueueSizes()
+	require.Equal(t, 16, maxSize)
+	require.Equal(t, 10, minSize)
+}
+
+func TestEngine_LeaseBlocksSecondEngine(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	newTestEngine(t, queue, time.Hour)
+
+	second := NewEngine(context.Background(), EngineJobNameTest, queue, testSchedulingParams(time.Hour))
+	require.ErrorIs(t, second.Start(context.Background()), ErrEngineLeaseHeld)
+}
+
+func TestEngine_NamespacesAreIsolated(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	newTestEngine(t, queue, time.Hour)
+
+	ctx := context.Background()
+	namespaced := NewEngine(ctx, RedisNamespace("run-2").Job(EngineJobNameTest), queue, testSchedulingParams(time.Hour))
+	require.NoError(t, namespaced.Start(ctx))
+	t.Cleanup(func() {
+		namespaced.TriggerStop()
+		namespaced.WaitForStop()
+	})
+	require.Equal(t, "run-2:test-engine:tasks", namespaced.TasksQueueName())
+
+	namespaced.GetInput() <- EngineTaskMsg{ID: NewEngineTaskID(), Task: "task"}
+	msg := testWorkerPop(t, namespaced, queue)
+	require.Equal(t, "task", msg.Task)
+	length, err := queue.PriorityLen(ctx, EngineJobNameTest.TasksQueueName())
+	require.NoError(t, err)
+	require.Zero(t, length)
+}
+
+func TestEngine_RecordAndReplay(t *testing.T) {
+	tapePath := filepath.Join(t.TempDir(), "tape.jsonl")
+	recorder, err := NewTapeRecorder(tapePath)
+	require.NoError(t, err)
+	queue := NewMemoryQueueBackend()
+	ctx := context.Background()
+	transport := NewRecordingTransport(NewListTransport(EngineJobNameTest, queue), EngineJobNameTest, recorder)
+	recording := NewEngineWithTransport(ctx, EngineJobNameTest, queue, transport, testSchedulingParams(time.Hour))
+	require.NoError(t, recording.Start(ctx))
+	for _, answer := range []string{"first", "second"} {
+		recording.GetInput() <- EngineTaskMsg{Task: "same task"}
+		task := testWorkerPop(t, recording, queue)
+		testWorkerPushResult(t, recording, queue, task.ID, answer)
+		requireEngineOutput(t, recording)
+	}
+	recording.TriggerStop()
+	recording.WaitForStop()
+	require.NoError(t, recorder.Close())
+
+	tape, err := LoadTape(tapePath)
+	require.NoError(t, err)
+	replaying := NewEngineWithTransport(ctx, EngineJobNameTest, NewMemoryQueueBackend(), NewReplayTransport(EngineJobNameTest, tape), testSchedulingParams(time.Hour))
+	require.NoError(t, replaying.Start(ctx))
+	t.Cleanup(func() {
+		replaying.TriggerStop()
+		replaying.WaitForStop()
+	})
+	for _, answer := range []string{"first", "second"} {
+		replaying.GetInput() <- EngineTaskMsg{Task: "same task"}
+		require.Equal(t, answer, requireEngineOutput(t, replaying).Result)
+	}
+}
+
+func TestEngine_PayloadOffloadRoundTrip(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	ctx := context.Background()
+	params := PayloadParams{Version: PayloadVersionGzip, OffloadThreshold: 64, OffloadTTL: time.Hour}
+	transport := NewPayloadTransport(NewListTransport(EngineJobNameTest, queue), EngineJobNameTest, queue, params)
+	engine := NewEngineWithTransport(ctx, EngineJobNameTest, queue, transport, testSchedulingParams(time.Hour))
+	require.NoError(t, engine.Start(ctx))
+	t.Cleanup(func() {
+		engine.TriggerStop()
+		engine.WaitForStop()
+	})
+
+	// random enough that it can't be compressed under the threshold
+	large := ""
+	for i := 0; i < 64; i++ {
+		large += string(NewEngineTaskID())
+	}
+	engine.GetInput() <- EngineTaskMsg{Task: large}
+	encoded := testWorkerPop(t, engine, queue)
+	require.Equal(t, PayloadVersionGzip, encoded.PayloadVersion)
+	require.NotEmpty(t, encoded.PayloadRef)
+	require.Empty(t, encoded.Task)
+
+	codec := NewPayloadCodec(EngineJobNameTest, queue, params)
+	task, err := codec.DecodeTask(ctx, *encoded)
+	require.NoError(t, err)
+	require.Equal(t, large, task.Task)
+
+	result, err := codec.EncodeResult(ctx, EngineTaskResultMsg{ID: task.ID, Result: "small"}, encoded.PayloadVersion)
+	require.NoError(t, err)
+	require.Empty(t, result.PayloadRef)
+	_, err = queue.LPush(ctx, engine.ResultsQueueName(), result.toJSON())
+	require.NoError(t, err)
+	require.Equal(t, "small", requireEngineOutput(t, engine).Result)
+}
+
+func TestEngine_ReplayCompilationTask(t *testing.T) {
+	// every run generates new branch names, so the replayed task differs from the recorded one
+	buildTask := func() CompilationTask {
+		rg := NewRepoGraph(BranchName("test"))
+		bt := rg.BranchTargets[BranchName("test")]
+		cg := NewCommitGraph(GoalID("goal_id"))
+		bt.Subgraphs[cg.GoalID] = cg
+		root := NodeLocatorFromTriplet(bt.BranchName, cg.GoalID, cg.RootNode)
+		child, err := rg.AddNodeToCommitGraph(root, "<think>look around</think>\n<actions>\n\t<git-status/>\n</actions>", NodeMetadata{})
+		require.NoError(t, err)
+		task, err := rg.BuildCompilationTasksForNode(child)
+		require.NoError(t, err)
+		return task
+	}
+
+	tapePath := filepath.Join(t.TempDir(), "tape.jsonl")
+	recorder, err := NewTapeRecorder(tapePath)
+	require.NoError(t, err)
+	queue := NewMemoryQueueBackend()
+	ctx := context.Background()
+	transport := NewRecordingTransport(NewListTransport(EngineJobNameTest, queue), EngineJobNameTest, recorder)
+	recording := NewEngineWithTransport(ctx, EngineJobNameTest, queue, transport, testSchedulingParams(time.Hour))
+	require.NoError(t, recording.Start(ctx))
+	recorded := buildTask()
+	recording.GetInput() <- EngineTaskMsg{Task: recorded.ToJSON()}
+	task := testWorkerPop(t, recording, queue)
+	testWorkerPushResult(t, recording, queue, task.ID, "built "+string(recorded.NewBranchName))
+	requireEngineOutput(t, recording)
+	recording.TriggerStop()
+	recording.WaitForStop()
+	require.NoError(t, recorder.Close())
+
+	tape, err := LoadTape(tapePath)
+	require.NoError(t, err)
+	replaying := NewEngineWithTransport(ctx, EngineJobNameTest, NewMemoryQueueBackend(), NewReplayTransport(EngineJobNameTest, tape), testSchedulingParams(time.Hour))
+	require.NoError(t, replaying.Start(ctx))
+	t.Cleanup(func() {
+		replaying.TriggerStop()
+		replaying.WaitForStop()
+	})
+	replayed := buildTask()
+	require.NotEqual(t, recorded.NewBranchName, replayed.NewBranchName)
+	replaying.GetInput() <- EngineTaskMsg{Task: replayed.ToJSON()}
+	require.Equal(t, "built "+string(replayed.NewBranchName), requireEngineOutput(t, replaying).Result)
+}
+
+func TestEngine_ReplayLeavesTheGraphAlone(t *testing.T) {
+	dir := t.TempDir()
+	graphPath := filepath.Join(dir, "graph.json")
+	rg, _, cg, root, child := newTestCommitGraph(t)
+	require.NoError(t, rg.SaveToFile(graphPath))
+	require.NoError(t, rg.OpenEventLog(graphPath))
+	_, err := rg.AddNodeToCommitGraph(root, "logged, not saved", NodeMetadata{})
+	require.NoError(t, err)
+	require.NoError(t, rg.CloseEventLog())
+
+	readAll := func() map[string]string {
+		files := map[string]string{}
+		require.NoError(t, filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			files[path] = string(data)
+			return err
+		}))
+		return files
+	}
+	before := readAll()
+
+	loaded := &RepoGraph{}
+	require.NoError(t, loaded.LoadFromFile(graphPath))
+	_, err = copyGraphForReplay(loaded, graphPath, graphPath)
+	require.Error(t, err)
+	outPath, err := copyGraphForReplay(loaded, graphPath, "")
+	require.NoError(t, err)
+	require.NotEqual(t, graphPath, outPath)
+	// what the orchestrator does during the replay
+	require.NoError(t, loaded.OpenEventLog(outPath))
+	_, err = loaded.AddNodeToCommitGraph(child, "replayed", NodeMetadata{})
+	require.NoError(t, err)
+	require.NoError(t, loaded.CloseEventLog())
+	require.NoError(t, loaded.SaveToFile(outPath))
+
+	after := readAll()
+	for path, data := range before {
+		require.Equal(t, data, after[path], path)
+	}
+	original := &RepoGraph{}
+	require.NoError(t, original.LoadFromFile(graphPath))
+	require.Len(t, original.BranchTargets[BranchName("test")].Subgraphs[cg.GoalID].Nodes, 3)
+	replayed := &RepoGraph{}
+	require.NoError(t, replayed.LoadFromFile(outPath))
+	require.Len(t, replayed.BranchTargets[BranchName("test")].Subgraphs[cg.GoalID].Nodes, 4)
+}
@@ -32,6 +32,10 @@ func (n *CompilationExecutor) Execute(ctx context.Context, config *experimentCon
 	if parsedConfig.Task.NewBranchName == "" {
 		parsedConfig.Task.NewBranchName = orchestrator.NewBranchName()
 	}
+	namespace, err := readRedisNamespace(config)
+	if err != nil {
+		return err
+	}
 	rdb, err := orchestrator.ConnectToRedis(ctx)
 	if err != nil {
 		return err
@@ -47,7 +51,7 @@ func (n *CompilationExecutor) Execute(ctx context.Context, config *experimentCon
 		InputChanSize:         1,
 		OutputChanSize:        1,
 	}
-	compilationEngine := orchestrator.NewEngine(ctx, orchestrator.EngineJobNameCompilation, rdb, compilationSchedulingParams)
+	compilationEngine := orchestrator.NewEngine(ctx, namespace.Job(orchestrator.EngineJobNameCompilation), orchestrator.NewRedisQueueBackend(rdb), compilationSchedulingParams)
 	if err := compilationEngine.Start(ctx); err != nil {
 		return err
 	}
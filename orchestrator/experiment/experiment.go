@@ -11,6 +11,7 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/urfave/cli/v3"
+	"github.com/zaporter/branch-by-branch/orchestrator"
 )
 
 /*
@@ -85,9 +86,13 @@ func createExperimentRunCli() *cli.Command {
 		if !ok {
 			return fmt.Errorf("executor %s not found", experimentConfig.Executor)
 		}
+		namespace, err := readRedisNamespace(config)
+		if err != nil {
+			return err
+		}
 
 		if !noSetParams && experimentConfig.RedisParams != nil {
-			if err := setParams(ctx, experimentConfig.RedisParams); err != nil {
+			if err := setParams(ctx, namespace, experimentConfig.RedisParams); err != nil {
 				return err
 			}
 		}
@@ -99,7 +104,7 @@ func createExperimentRunCli() *cli.Command {
 		}
 
 		if !noSetParams && experimentConfig.RedisParams != nil {
-			if err := setParams(ctx, experimentConfig.RedisParams); err != nil {
+			if err := setParams(ctx, namespace, experimentConfig.RedisParams); err != nil {
 				return err
 			}
 		}
@@ -305,6 +310,20 @@ type BaseExperimentConfig struct {
 	InstanceRequests map[string]instanceReservationReq `json:"instance_requests"`
 	// Array of . indexed keys to unset in the base config pre-merge. Ex: ["redis_params.a", "instance_requests.b"]
 	UnsetParams []string `json:"unset"`
+	// Prefix for every redis key the experiment touches. Defaults to $REDIS_NAMESPACE.
+	// Experiments that run in parallel on the same redis must use different namespaces.
+	RedisNamespace string `json:"redis_namespace"`
+}
+
+func readRedisNamespace(config *experimentConfig) (orchestrator.RedisNamespace, error) {
+	baseConfig, err := readExperimentConfig[BaseExperimentConfig](config)
+	if err != nil {
+		return "", err
+	}
+	if baseConfig.RedisNamespace == "" {
+		return orchestrator.RedisNamespaceFromEnv(), nil
+	}
+	return orchestrator.RedisNamespace(baseConfig.RedisNamespace), nil
 }
 
 func readExperimentConfig[T any](config *experimentConfig) (T, error) {
@@ -60,11 +60,15 @@ func (n *GrpoLoopExecutor) Execute(ctx context.Context, config *experimentConfig
 	logger := zerolog.Ctx(ctx)
 	logger.Info().Msg("GRPO loop test")
 
+	namespace, err := readRedisNamespace(config)
+	if err != nil {
+		return err
+	}
 	rdb, err := orchestrator.ConnectToRedis(ctx)
 	if err != nil {
 		return err
 	}
-	rdb.Del(ctx, orchestrator.RedisTrainingAdvList)
+	rdb.Del(ctx, namespace.Key(orchestrator.RedisTrainingAdvList))
 	inferenceSchedulingParams := orchestrator.SchedulingParams{
 		MinTaskQueueSize:      4,
 		MaxTaskQueueSize:      8,
@@ -77,11 +81,11 @@ func (n *GrpoLoopExecutor) Execute(ctx context.Context, config *experimentConfig
 		OutputChanSize:        8,
 		DisableBackpressure:   true,
 	}
-	err = orchestrator.DropTrainingChans(ctx, rdb)
+	err = orchestrator.DropTrainingChans(ctx, rdb, namespace)
 	if err != nil {
 		return err
 	}
-	inferenceEngine := orchestrator.NewEngine(ctx, orchestrator.EngineJobNameInference, rdb, inferenceSchedulingParams)
+	inferenceEngine := orchestrator.NewEngine(ctx, namespace.Job(orchestrator.EngineJobNameInference), orchestrator.NewRedisQueueBackend(rdb), inferenceSchedulingParams)
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
@@ -188,12 +192,12 @@ func (n *GrpoLoopExecutor) Execute(ctx context.Context, config *experimentConfig
 				})
 			}
 			logger.Info().Msgf("training data: %+v", data)
-			err = messageList.AddAdvertisement(ctx, rdb, orchestrator.RedisTrainingAdvList, string(groupID), data)
+			err = messageList.AddAdvertisement(ctx, rdb, namespace.Key(orchestrator.RedisTrainingAdvList), string(groupID), data)
 			if err != nil {
 				return err
 			}
 		}
-		err = rdb.Set(ctx, string(orchestrator.RedisInferenceEnabled), "false", 0).Err()
+		err = rdb.Set(ctx, namespace.RouterKey(orchestrator.RedisInferenceEnabled), "false", 0).Err()
 		if err != nil {
 			return err
 		}
@@ -205,7 +209,7 @@ func (n *GrpoLoopExecutor) Execute(ctx context.Context, config *experimentConfig
 				return nil
 			default:
 			}
-			request, err := orchestrator.ReadNextTrainingRequest(ctx, rdb)
+			request, err := orchestrator.ReadNextTrainingRequest(ctx, rdb, namespace)
 			if err != nil {
 				logger.Warn().Err(err).Msg("error reading next training request")
 				continue
@@ -216,7 +220,7 @@ func (n *GrpoLoopExecutor) Execute(ctx context.Context, config *experimentConfig
 				return fmt.Errorf("group not found")
 			}
 			logger.Info().Msgf("group: %+v", group)
-			err = rdb.LPush(ctx, orchestrator.RedisTrainingTxChan, group).Err()
+			err = rdb.LPush(ctx, namespace.Key(orchestrator.RedisTrainingTxChan), group).Err()
 			if err != nil {
 				return err
 			}
@@ -232,7 +236,7 @@ func (n *GrpoLoopExecutor) Execute(ctx context.Context, config *experimentConfig
 				return nil
 			default:
 			}
-			enabled, err := rdb.Get(ctx, string(orchestrator.RedisInferenceEnabled)).Result()
+			enabled, err := rdb.Get(ctx, namespace.RouterKey(orchestrator.RedisInferenceEnabled)).Result()
 			if err != nil {
 				return err
 			}
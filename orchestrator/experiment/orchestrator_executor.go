@@ -31,6 +31,11 @@ func (o *OrchestratorExecutor) Execute(ctx context.Context, config *experimentCo
 		return err
 	}
 
+	namespace, err := readRedisNamespace(config)
+	if err != nil {
+		return err
+	}
+
 	logger := zerolog.Ctx(ctx)
 	logger.Info().Msg("starting orchestrator")
 	rdb, err := orchestrator.ConnectToRedis(ctx)
@@ -39,48 +44,65 @@ func (o *OrchestratorExecutor) Execute(ctx context.Context, config *experimentCo
 	}
 	resolvedGoalFile := filepath.Join(config.FullPath, parsedConfig.GoalFile)
 	goalProvider := orchestrator.StaticGoalProviderFromFile(resolvedGoalFile)
-	if err := orchestrator.DropTrainingChans(ctx, rdb); err != nil {
+	if err := orchestrator.DropTrainingChans(ctx, rdb, namespace); err != nil {
 		return err
 	}
 	rg := &orchestrator.RepoGraph{}
 	graphPath := filepath.Join(config.FullPath, parsedConfig.GraphFile)
+	if err := rg.LoadFromFile(graphPath); err != nil {
+		return err
+	}
 	if parsedConfig.CloneGraph {
+		// save (rather than copy) so the clone includes anything still in the original's event log
 		newFile := filepath.Join(config.FullPath, "cloned_graph.json")
-		if err := orchestrator.CopyFile(graphPath, newFile); err != nil {
+		if err := orchestrator.NewGraphArchive(graphPath).CopyTo(orchestrator.NewGraphArchive(newFile)); err != nil {
+			return err
+		}
+		if err := rg.SaveToFile(newFile); err != nil {
 			return err
 		}
 		graphPath = newFile
 	}
-	if err := rg.LoadFromFile(graphPath); err != nil {
+	rg.Ctx = ctx
+	if err := rg.OpenEventLog(graphPath); err != nil {
 		return err
 	}
-	rg.Ctx = ctx
+	defer rg.CloseEventLog()
 	rg.ShouldAdvertiseChan = make(chan orchestrator.CommitGraphLocator, 128)
 	inferenceSchedulingParams := orchestrator.SchedulingParams{
-		MinTaskQueueSize:      16,
-		MaxTaskQueueSize:      32,
-		TaskProcessingTimeout: 5 * time.Minute,
-		CamShaftInterval:      1 * time.Second,
-		CrankShaftInterval:    1 * time.Second,
-		TimingBeltInterval:    2 * time.Second,
-		ODBInterval:           10 * time.Second,
-		InputChanSize:         8,
-		OutputChanSize:        8,
+		MinTaskQueueSize:       16,
+		MaxTaskQueueSize:       32,
+		WorkerBatchSize:        8,
+		TaskProcessingTimeout:  5 * time.Minute,
+		CamShaftInterval:       1 * time.Second,
+		CrankShaftInterval:     1 * time.Second,
+		TimingBeltInterval:     2 * time.Second,
+		ODBInterval:            10 * time.Second,
+		InputChanSize:          8,
+		OutputChanSize:         8,
+		WorkerHeartbeatTimeout: 30 * time.Second,
+		PriorityBufferSize:     64,
+		MaxAttempts:            3,
+		PersistInFlight:        true,
 	}
 	compilationSchedulingParams := orchestrator.SchedulingParams{
-		MinTaskQueueSize:      32,
-		MaxTaskQueueSize:      64,
-		TaskProcessingTimeout: 2 * time.Minute,
-		CamShaftInterval:      1 * time.Second,
-		CrankShaftInterval:    1 * time.Second,
-		TimingBeltInterval:    2 * time.Second,
-		ODBInterval:           10 * time.Second,
-		InputChanSize:         32,
-		OutputChanSize:        32,
+		MinTaskQueueSize:       32,
+		MaxTaskQueueSize:       64,
+		TaskProcessingTimeout:  2 * time.Minute,
+		CamShaftInterval:       1 * time.Second,
+		CrankShaftInterval:     1 * time.Second,
+		TimingBeltInterval:     2 * time.Second,
+		ODBInterval:            10 * time.Second,
+		InputChanSize:          32,
+		OutputChanSize:         32,
+		WorkerHeartbeatTimeout: 30 * time.Second,
+		PriorityBufferSize:     64,
+		MaxAttempts:            3,
+		PersistInFlight:        true,
 	}
-	inferenceEngine := orchestrator.NewEngine(ctx, orchestrator.EngineJobNameInference, rdb, inferenceSchedulingParams)
-	compilationEngine := orchestrator.NewEngine(ctx, orchestrator.EngineJobNameCompilation, rdb, compilationSchedulingParams)
-	goalCompilationEngine := orchestrator.NewEngine(ctx, orchestrator.EngineJobNameGoalCompilation, rdb, compilationSchedulingParams)
+	inferenceEngine := orchestrator.NewEngine(ctx, namespace.Job(orchestrator.EngineJobNameInference), orchestrator.NewRedisQueueBackend(rdb), inferenceSchedulingParams)
+	compilationEngine := orchestrator.NewEngine(ctx, namespace.Job(orchestrator.EngineJobNameCompilation), orchestrator.NewRedisQueueBackend(rdb), compilationSchedulingParams)
+	goalCompilationEngine := orchestrator.NewEngine(ctx, namespace.Job(orchestrator.EngineJobNameGoalCompilation), orchestrator.NewRedisQueueBackend(rdb), compilationSchedulingParams)
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(ctx)
@@ -110,6 +132,7 @@ func (o *OrchestratorExecutor) Execute(ctx context.Context, config *experimentCo
 		InferenceEngine:       inferenceEngine,
 		CompilationEngine:     compilationEngine,
 		GoalCompilationEngine: goalCompilationEngine,
+		Namespace:             namespace,
 		DoTraining:            true,
 	}
 	orchestrator := orchestrator.NewOrchestrator(ctx, logger, orchestratorParams)
@@ -9,7 +9,7 @@ import (
 	"github.com/zaporter/branch-by-branch/orchestrator"
 )
 
-func setParams(ctx context.Context, params map[string]any) error {
+func setParams(ctx context.Context, namespace orchestrator.RedisNamespace, params map[string]any) error {
 	rdb, err := orchestrator.ConnectToRedis(ctx)
 	if err != nil {
 		return err
@@ -20,7 +20,7 @@ func setParams(ctx context.Context, params map[string]any) error {
 		if !slices.Contains(orchestrator.AllRouterKeys, orchestrator.RedisKey(key)) {
 			return fmt.Errorf("key %s not found in router keys", key)
 		}
-		if err := rdb.Set(ctx, key, value, 0).Err(); err != nil {
+		if err := rdb.Set(ctx, namespace.RouterKey(orchestrator.RedisKey(key)), value, 0).Err(); err != nil {
 			return err
 		}
 		logger.Info().Msgf("%s = %v", key, value)
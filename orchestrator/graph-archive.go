@@ -0,0 +1,330 @@
+package orchestrator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v3"
+)
+
+// Failed commit graphs are never trained on, but their nodes keep every (large) inference & compilation output.
+// Compact moves those payloads into a content-addressed archive next to the graph ({graph}.archive/{sha256}.json.gz)
+// and leaves CommitGraphNode.ArchivedPayload pointing at them. Everything else (structure, results, stats) stays in the graph.
+
+// The payload fields of a CommitGraphNode
+type ArchivedNodePayload struct {
+	InferenceOutput   string             `json:"inference_output"`
+	ActionOutputs     []ActionOutput     `json:"action_outputs"`
+	CompilationResult *CompilationResult `json:"compilation_result"`
+}
+
+type GraphArchive struct {
+	dir string
+}
+
+func NewGraphArchive(graphPath string) *GraphArchive {
+	return &GraphArchive{dir: graphPath + ".archive"}
+}
+
+func (a *GraphArchive) path(hash string) string {
+	return filepath.Join(a.dir, hash+".json.gz")
+}
+
+func archivedPayloadHash(payload ArchivedNodePayload) (string, []byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), data, nil
+}
+
+// Put stores payload (if it isn't already stored) and returns its hash.
+func (a *GraphArchive) Put(payload ArchivedNodePayload) (string, error) {
+	hash, data, err := archivedPayloadHash(payload)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(a.path(hash)); err == nil {
+		return hash, nil
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return "", err
+	}
+	// the graph will point at this file, so it has to be complete before the graph is saved
+	if err := writeFileAtomic(a.path(hash), buf.Bytes()); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func (a *GraphArchive) Get(hash string) (ArchivedNodePayload, error) {
+	file, err := os.Open(a.path(hash))
+	if err != nil {
+		return ArchivedNodePayload{}, err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return ArchivedNodePayload{}, err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return ArchivedNodePayload{}, err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return ArchivedNodePayload{}, fmt.Errorf("archived payload %s is corrupt", hash)
+	}
+	payload := ArchivedNodePayload{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return ArchivedNodePayload{}, err
+	}
+	return payload, nil
+}
+
+// CopyTo makes every payload in a available in other, for when a graph is saved under a new path (e.g. cloned or merged).
+func (a *GraphArchive) CopyTo(other *GraphArchive) error {
+	entries, err := os.ReadDir(a.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(other.dir, 0755); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		src := filepath.Join(a.dir, entry.Name())
+		dst := filepath.Join(other.dir, entry.Name())
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		// payloads are never modified, so a link is as good as a copy
+		if err := os.Link(src, dst); err != nil {
+			if err := CopyFile(src, dst); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isArchivableGraphState(state GraphState) bool {
+	return state == GraphStateFailed || state == GraphStateGoalSetupFailed
+}
+
+func nodePayload(node *CommitGraphNode) ArchivedNodePayload {
+	return ArchivedNodePayload{
+		InferenceOutput:   node.InferenceOutput,
+		ActionOutputs:     node.ActionOutputs,
+		CompilationResult: node.CompilationResult,
+	}
+}
+
+// A GraphCompaction is Compact split up so the slow part (compressing & writing the archive) doesn't have to hold the
+// orchestrator's lock (like PrepareSave): PrepareCompaction & ApplyCompaction need the lock, Write doesn't.
+type GraphCompaction struct {
+	nodes []compactedNode
+}
+
+type compactedNode struct {
+	locator NodeLocator
+	payload ArchivedNodePayload
+	// set by Write
+	hash string
+}
+
+// PrepareCompaction copies the payloads of every node that Compact would archive.
+func (rg *RepoGraph) PrepareCompaction() *GraphCompaction {
+	compaction := &GraphCompaction{}
+	for _, branchTarget := range rg.BranchTargets {
+		for _, cg := range branchTarget.Subgraphs {
+			if !isArchivableGraphState(cg.State) {
+				continue
+			}
+			for _, node := range cg.Nodes {
+				if node.ArchivedPayload != "" {
+					continue
+				}
+				payload := nodePayload(node)
+				payload.ActionOutputs = slices.Clone(payload.ActionOutputs)
+				if payload.CompilationResult != nil {
+					compilationResult := *payload.CompilationResult
+					payload.CompilationResult = &compilationResult
+				}
+				compaction.nodes = append(compaction.nodes, compactedNode{
+					locator: NodeLocatorFromTriplet(branchTarget.BranchName, cg.GoalID, node.ID),
+					payload: payload,
+				})
+			}
+		}
+	}
+	return compaction
+}
+
+// Write stores the payloads in archive. Payloads written before an error are still applied by ApplyCompaction.
+func (c *GraphCompaction) Write(archive *GraphArchive) error {
+	for i := range c.nodes {
+		hash, err := archive.Put(c.nodes[i].payload)
+		if err != nil {
+			return err
+		}
+		c.nodes[i].hash = hash
+	}
+	return nil
+}
+
+// ApplyCompaction points the nodes at their archived payloads. Returns the number of nodes archived.
+// Nodes that changed since PrepareCompaction (e.g. their commit graph was brought back to life) are left alone.
+func (rg *RepoGraph) ApplyCompaction(compaction *GraphCompaction) (int, error) {
+	archived := 0
+	for _, compacted := range compaction.nodes {
+		if compacted.hash == "" {
+			continue
+		}
+		slice, err := rg.GetNodeSlice(compacted.locator)
+		if err != nil || !isArchivableGraphState(slice.CommitGraph.State) || slice.CommitGraphNode.ArchivedPayload != "" {
+			continue
+		}
+		node := slice.CommitGraphNode
+		hash, _, err := archivedPayloadHash(nodePayload(node))
+		if err != nil {
+			return archived, err
+		}
+		if hash != compacted.hash {
+			continue
+		}
+		node.ArchivedPayload = hash
+		node.InferenceOutput = ""
+		node.ActionOutputs = []ActionOutput{}
+		node.CompilationResult = nil
+		rg.recordNodeArchival(slice)
+		archived++
+	}
+	return archived, nil
+}
+
+// Compact archives the payloads of every node in a failed (or setup-failed) commit graph. Returns the number of nodes archived.
+func (rg *RepoGraph) Compact(archive *GraphArchive) (int, error) {
+	compaction := rg.PrepareCompaction()
+	writeErr := compaction.Write(archive)
+	archived, err := rg.ApplyCompaction(compaction)
+	return archived, errors.Join(writeErr, err)
+}
+
+func restoreArchivedNode(node *CommitGraphNode, archive *GraphArchive) error {
+	payload, err := archive.Get(node.ArchivedPayload)
+	if err != nil {
+		return fmt.Errorf("node %s: %w", node.ID, err)
+	}
+	node.InferenceOutput = payload.InferenceOutput
+	node.ActionOutputs = payload.ActionOutputs
+	node.CompilationResult = payload.CompilationResult
+	node.ArchivedPayload = ""
+	return nil
+}
+
+// RestoreArchivedCommitGraph puts the archived payloads back into the commit graph's nodes.
+// Needed before a dead commit graph is brought back to life (its prompts are built from its nodes' payloads).
+func (rg *RepoGraph) RestoreArchivedCommitGraph(slice CommitGraphSlice, archive *GraphArchive) error {
+	for _, node := range slice.CommitGraph.Nodes {
+		if node.ArchivedPayload == "" {
+			continue
+		}
+		if err := restoreArchivedNode(node, archive); err != nil {
+			return err
+		}
+		rg.recordNodeArchival(NodeSlice{BranchTarget: slice.BranchTarget, CommitGraph: slice.CommitGraph, CommitGraphNode: node})
+	}
+	return nil
+}
+
+// HydratedCommitGraph returns a graph that can be read (not mutated) as if the commit graph had never been compacted.
+// If nothing in it is archived, that is rg itself.
+// Otherwise, it is a graph with just the commit graph, with copies of its nodes.
+func (rg *RepoGraph) HydratedCommitGraph(locator CommitGraphLocator, archive *GraphArchive) (*RepoGraph, error) {
+	slice, err := rg.GetCommitGraphSlice(locator)
+	if err != nil {
+		return nil, err
+	}
+	hasArchived := false
+	for _, node := range slice.CommitGraph.Nodes {
+		hasArchived = hasArchived || node.ArchivedPayload != ""
+	}
+	if !hasArchived {
+		return rg, nil
+	}
+	cg := *slice.CommitGraph
+	cg.Nodes = map[NodeID]*CommitGraphNode{}
+	for nodeID, node := range slice.CommitGraph.Nodes {
+		nodeCopy := *node
+		if nodeCopy.ArchivedPayload != "" {
+			if err := restoreArchivedNode(&nodeCopy, archive); err != nil {
+				return nil, err
+			}
+		}
+		cg.Nodes[nodeID] = &nodeCopy
+	}
+	branchTarget := *slice.BranchTarget
+	branchTarget.Subgraphs = map[GoalID]*CommitGraph{cg.GoalID: &cg}
+	return &RepoGraph{
+		SchemaVersion: rg.SchemaVersion,
+		ID:            rg.ID,
+		BranchTargets: map[BranchName]*RepoGraphBranchTarget{branchTarget.BranchName: &branchTarget},
+		Ctx:           rg.Ctx,
+	}, nil
+}
+
+func createGraphCompactCli() *cli.Command {
+	action := func(ctx context.Context, cmd *cli.Command) error {
+		logger := zerolog.Ctx(ctx)
+		path := cmd.Args().First()
+		if path == "" {
+			return errors.New("no graph file given")
+		}
+		rg := &RepoGraph{}
+		if err := rg.LoadFromFile(path); err != nil {
+			return err
+		}
+		archived, err := rg.Compact(NewGraphArchive(path))
+		if err != nil {
+			return err
+		}
+		if archived == 0 {
+			logger.Info().Msgf("nothing to compact in %s", path)
+			return nil
+		}
+		if err := rg.SaveToFile(path); err != nil {
+			return err
+		}
+		logger.Info().Msgf("archived the payloads of %d nodes from %s", archived, path)
+		return nil
+	}
+	return &cli.Command{
+		Name:      "compact",
+		Usage:     "move the payloads of failed commit graphs' nodes into {graph}.archive (see also orchestrator start --auto-compact)",
+		ArgsUsage: "<graph.json>",
+		Action:    action,
+	}
+}
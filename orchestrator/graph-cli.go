@@ -0,0 +1,12 @@
+package orchestrator
+
+import "github.com/urfave/cli/v3"
+
+// CreateGraphCli groups the offline tools that operate on graph files.
+func CreateGraphCli() *cli.Command {
+	return &cli.Command{
+		Name:     "graph",
+		Usage:    "inspect and maintain graph files",
+		Commands: []*cli.Command{createGraphMigrateCli(), createGraphFsckCli(), createGraphStatsCli(), createGraphRenderCli(), createGraphQueryCli(), createGraphMergeCli(), createGraphDiffCli(), createGraphCompactCli()},
+	}
+}
@@ -0,0 +1,233 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/urfave/cli/v3"
+)
+
+type GraphDiffKind string
+
+const (
+	GraphDiffBranchTargetAdded      GraphDiffKind = "branch_target_added"
+	GraphDiffBranchTargetRemoved    GraphDiffKind = "branch_target_removed"
+	GraphDiffCommitGraphAdded       GraphDiffKind = "commit_graph_added"
+	GraphDiffCommitGraphRemoved     GraphDiffKind = "commit_graph_removed"
+	GraphDiffCommitGraphStateChange GraphDiffKind = "commit_graph_state_changed"
+	GraphDiffResultAdded            GraphDiffKind = "result_added"
+	GraphDiffResultRemoved          GraphDiffKind = "result_removed"
+	GraphDiffNodeAdded              GraphDiffKind = "node_added"
+	GraphDiffNodeRemoved            GraphDiffKind = "node_removed"
+	GraphDiffNodeStateChange        GraphDiffKind = "node_state_changed"
+	GraphDiffNodeResultChange       GraphDiffKind = "node_result_changed"
+	GraphDiffNodeMetadataEdit       GraphDiffKind = "node_metadata_edited"
+)
+
+// A GraphDiffEntry is one difference between two graphs.
+// Like GraphEvent, branch target & commit graph entries use a NodeLocator with the lower levels left empty.
+type GraphDiffEntry struct {
+	Kind    GraphDiffKind `json:"kind"`
+	Locator NodeLocator   `json:"locator"`
+	// for changes. Results are described by the branch target they created
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+func (e GraphDiffEntry) String() string {
+	location := string(e.Locator.CommitGraphLocator.BranchTargetLocator.BranchName)
+	if e.Locator.CommitGraphLocator.GoalID != "" {
+		location += "/" + string(e.Locator.CommitGraphLocator.GoalID)
+	}
+	if e.Locator.NodeID != "" {
+		location += "/" + string(e.Locator.NodeID)
+	}
+	switch e.Kind {
+	case GraphDiffBranchTargetAdded:
+		return fmt.Sprintf("+ branch target %s", location)
+	case GraphDiffBranchTargetRemoved:
+		return fmt.Sprintf("- branch target %s", location)
+	case GraphDiffCommitGraphAdded:
+		return fmt.Sprintf("+ commit graph %s", location)
+	case GraphDiffCommitGraphRemoved:
+		return fmt.Sprintf("- commit graph %s", location)
+	case GraphDiffNodeAdded:
+		return fmt.Sprintf("+ node %s", location)
+	case GraphDiffNodeRemoved:
+		return fmt.Sprintf("- node %s", location)
+	case GraphDiffResultAdded:
+		return fmt.Sprintf("+ result %s -> %s", location, e.To)
+	case GraphDiffResultRemoved:
+		return fmt.Sprintf("- result %s -> %s", location, e.From)
+	default:
+		return fmt.Sprintf("~ %s %s: %s -> %s", e.Kind, location, e.From, e.To)
+	}
+}
+
+// DiffRepoGraphs lists what changed from before to after, ordered by branch target, goal & node.
+// Anything inside an added or removed branch target / commit graph isn't listed separately.
+func DiffRepoGraphs(before *RepoGraph, after *RepoGraph) ([]GraphDiffEntry, error) {
+	diff := []GraphDiffEntry{}
+	branchNames := slices.Sorted(maps.Keys(before.BranchTargets))
+	for branchName := range after.BranchTargets {
+		if _, ok := before.BranchTargets[branchName]; !ok {
+			branchNames = append(branchNames, branchName)
+		}
+	}
+	slices.Sort(branchNames)
+	for _, branchName := range branchNames {
+		oldBT, inOld := before.BranchTargets[branchName]
+		newBT, inNew := after.BranchTargets[branchName]
+		locator := NodeLocatorFromTriplet(branchName, "", "")
+		if !inNew {
+			diff = append(diff, GraphDiffEntry{Kind: GraphDiffBranchTargetRemoved, Locator: locator})
+			continue
+		}
+		if !inOld {
+			diff = append(diff, GraphDiffEntry{Kind: GraphDiffBranchTargetAdded, Locator: locator})
+			continue
+		}
+		goalIDs := slices.Sorted(maps.Keys(oldBT.Subgraphs))
+		for goalID := range newBT.Subgraphs {
+			if _, ok := oldBT.Subgraphs[goalID]; !ok {
+				goalIDs = append(goalIDs, goalID)
+			}
+		}
+		slices.Sort(goalIDs)
+		for _, goalID := range goalIDs {
+			oldCG, inOld := oldBT.Subgraphs[goalID]
+			newCG, inNew := newBT.Subgraphs[goalID]
+			locator := NodeLocatorFromTriplet(branchName, goalID, "")
+			if !inNew {
+				diff = append(diff, GraphDiffEntry{Kind: GraphDiffCommitGraphRemoved, Locator: locator})
+				continue
+			}
+			if !inOld {
+				diff = append(diff, GraphDiffEntry{Kind: GraphDiffCommitGraphAdded, Locator: locator})
+				continue
+			}
+			cgDiff, err := diffCommitGraphs(locator, oldCG, newCG)
+			if err != nil {
+				return nil, err
+			}
+			diff = append(diff, cgDiff...)
+		}
+	}
+	return diff, nil
+}
+
+func diffCommitGraphs(locator NodeLocator, before *CommitGraph, after *CommitGraph) ([]GraphDiffEntry, error) {
+	diff := []GraphDiffEntry{}
+	if before.State != after.State {
+		diff = append(diff, GraphDiffEntry{Kind: GraphDiffCommitGraphStateChange, Locator: locator, From: string(before.State), To: string(after.State)})
+	}
+	// DiffPatch identifies a result within a commit graph (see CGResult)
+	hasResult := func(results []*CGResult, diffPatch string) bool {
+		return slices.ContainsFunc(results, func(result *CGResult) bool { return result.DiffPatch == diffPatch })
+	}
+	for _, result := range after.Results {
+		if !hasResult(before.Results, result.DiffPatch) {
+			diff = append(diff, GraphDiffEntry{Kind: GraphDiffResultAdded, Locator: locator, To: string(result.BranchTarget)})
+		}
+	}
+	for _, result := range before.Results {
+		if !hasResult(after.Results, result.DiffPatch) {
+			diff = append(diff, GraphDiffEntry{Kind: GraphDiffResultRemoved, Locator: locator, From: string(result.BranchTarget)})
+		}
+	}
+
+	nodeIDs := slices.Sorted(maps.Keys(before.Nodes))
+	for nodeID := range after.Nodes {
+		if _, ok := before.Nodes[nodeID]; !ok {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+	}
+	slices.Sort(nodeIDs)
+	for _, nodeID := range nodeIDs {
+		oldNode, inOld := before.Nodes[nodeID]
+		newNode, inNew := after.Nodes[nodeID]
+		nodeLocator := locator
+		nodeLocator.NodeID = nodeID
+		if !inNew {
+			diff = append(diff, GraphDiffEntry{Kind: GraphDiffNodeRemoved, Locator: nodeLocator})
+			continue
+		}
+		if !inOld {
+			diff = append(diff, GraphDiffEntry{Kind: GraphDiffNodeAdded, Locator: nodeLocator})
+			continue
+		}
+		if oldNode.State != newNode.State {
+			diff = append(diff, GraphDiffEntry{Kind: GraphDiffNodeStateChange, Locator: nodeLocator, From: string(oldNode.State), To: string(newNode.State)})
+		}
+		if oldNode.Result != newNode.Result {
+			diff = append(diff, GraphDiffEntry{Kind: GraphDiffNodeResultChange, Locator: nodeLocator, From: string(oldNode.Result), To: string(newNode.Result)})
+		}
+		if oldNode.Metadata != newNode.Metadata {
+			from, err := json.Marshal(oldNode.Metadata)
+			if err != nil {
+				return nil, err
+			}
+			to, err := json.Marshal(newNode.Metadata)
+			if err != nil {
+				return nil, err
+			}
+			diff = append(diff, GraphDiffEntry{Kind: GraphDiffNodeMetadataEdit, Locator: nodeLocator, From: string(from), To: string(to)})
+		}
+	}
+	return diff, nil
+}
+
+func createGraphDiffCli() *cli.Command {
+	format := ""
+	action := func(ctx context.Context, cmd *cli.Command) error {
+		if cmd.Args().Len() != 2 {
+			return errors.New("expected exactly two graph files")
+		}
+		graphs := []*RepoGraph{}
+		for _, path := range cmd.Args().Slice() {
+			rg := &RepoGraph{}
+			if err := rg.LoadFromFile(path); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			graphs = append(graphs, rg)
+		}
+		diff, err := DiffRepoGraphs(graphs[0], graphs[1])
+		if err != nil {
+			return err
+		}
+		switch format {
+		case "text":
+			for _, entry := range diff {
+				if _, err := fmt.Fprintln(os.Stdout, entry); err != nil {
+					return err
+				}
+			}
+			return nil
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(diff)
+		default:
+			return fmt.Errorf("unknown format %q (expected text or json)", format)
+		}
+	}
+	return &cli.Command{
+		Name:      "diff",
+		Usage:     "list what changed between two graphs (e.g. two snapshots, or a graph and its clone)",
+		ArgsUsage: "<old.json> <new.json>",
+		Action:    action,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "format",
+				Usage:       "text or json",
+				Value:       "text",
+				Destination: &format,
+			},
+		},
+	}
+}
@@ -0,0 +1,478 @@
+package orchestrator
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type GraphEventType string
+
+const (
+	GraphEventBranchTargetCreated       GraphEventType = "branch_target_created"
+	GraphEventCommitGraphCreated        GraphEventType = "commit_graph_created"
+	GraphEventCommitGraphStateChanged   GraphEventType = "commit_graph_state_changed"
+	GraphEventCommitGraphResultsChanged GraphEventType = "commit_graph_results_changed"
+	GraphEventNodeAdded                 GraphEventType = "node_added"
+	GraphEventNodeDeleted               GraphEventType = "node_deleted"
+	GraphEventNodeStateChanged          GraphEventType = "node_state_changed"
+	GraphEventNodeOutputsAttached       GraphEventType = "node_outputs_attached"
+	GraphEventNodeMetadataEdited        GraphEventType = "node_metadata_edited"
+	// payloads moved into (or back out of) the GraphArchive
+	GraphEventNodeArchivalChanged GraphEventType = "node_archival_changed"
+)
+
+// GraphEvent is a single mutation of a RepoGraph.
+// Events carry the new values (not deltas) so replaying an event that already made it into a snapshot is harmless.
+// Only the fields relevant to the Type are set.
+type GraphEvent struct {
+	Seq  uint64         `json:"seq"`
+	Time time.Time      `json:"time"`
+	Type GraphEventType `json:"type"`
+	// NodeID is empty for branch target & commit graph events. GoalID is empty for branch target events.
+	Locator NodeLocator `json:"locator"`
+
+	// GraphEventBranchTargetCreated
+	BranchTarget *RepoGraphBranchTarget `json:"branch_target,omitempty"`
+	// GraphEventCommitGraphCreated
+	CommitGraph *CommitGraph `json:"commit_graph,omitempty"`
+	// GraphEventCommitGraphStateChanged
+	GraphState GraphState `json:"graph_state,omitempty"`
+	// GraphEventCommitGraphResultsChanged
+	Results []*CGResult `json:"results,omitempty"`
+	// GraphEventNodeAdded
+	Node *CommitGraphNode `json:"node,omitempty"`
+	// GraphEventNodeStateChanged
+	State                NodeState  `json:"state,omitempty"`
+	Result               NodeResult `json:"result,omitempty"`
+	TerminationRequested bool       `json:"termination_requested,omitempty"`
+	// GraphEventNodeOutputsAttached & GraphEventNodeArchivalChanged
+	ActionOutputs     []ActionOutput     `json:"action_outputs,omitempty"`
+	CompilationResult *CompilationResult `json:"compilation_result,omitempty"`
+	// GraphEventNodeArchivalChanged
+	InferenceOutput string `json:"inference_output,omitempty"`
+	ArchivedPayload string `json:"archived_payload,omitempty"`
+	// GraphEventNodeMetadataEdited
+	Metadata *NodeMetadata `json:"metadata,omitempty"`
+}
+
+// GraphEventLog is a write-ahead log of every mutation made to a RepoGraph since its last snapshot.
+// It lives next to the graph file at {graph}.events.
+//
+// Saving a snapshot rotates the log to {graph}.events.{seq} (where seq is the last event in the snapshot)
+// and only deletes it once the snapshot is on disk, so no event is lost if the save fails.
+type GraphEventLog struct {
+	mu        sync.Mutex
+	graphPath string
+	file      *os.File
+}
+
+func graphEventLogPath(graphPath string) string {
+	return graphPath + ".events"
+}
+
+func rotatedGraphEventLogPath(graphPath string, seq uint64) string {
+	return fmt.Sprintf("%s.%d", graphEventLogPath(graphPath), seq)
+}
+
+// rotatedGraphEventLogs returns the rotated logs of graphPath, oldest first.
+func rotatedGraphEventLogs(graphPath string) ([]string, []uint64, error) {
+	matches, err := filepath.Glob(graphEventLogPath(graphPath) + ".*")
+	if err != nil {
+		return nil, nil, err
+	}
+	type rotated struct {
+		path string
+		seq  uint64
+	}
+	logs := []rotated{}
+	for _, match := range matches {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(match, graphEventLogPath(graphPath)+"."), 10, 64)
+		if err != nil {
+			// not one of ours
+			continue
+		}
+		logs = append(logs, rotated{match, seq})
+	}
+	slices.SortFunc(logs, func(a, b rotated) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	paths := make([]string, 0, len(logs))
+	seqs := make([]uint64, 0, len(logs))
+	for _, log := range logs {
+		paths = append(paths, log.path)
+		seqs = append(seqs, log.seq)
+	}
+	return paths, seqs, nil
+}
+
+// OpenEventLog starts logging every mutation of rg to {graphPath}.events.
+// rg should have been loaded from graphPath (so the log continues where the last one left off).
+func (rg *RepoGraph) OpenEventLog(graphPath string) error {
+	file, err := os.OpenFile(graphEventLogPath(graphPath), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	rg.eventLog = &GraphEventLog{graphPath: graphPath, file: file}
+	return nil
+}
+
+func (rg *RepoGraph) CloseEventLog() error {
+	if rg.eventLog == nil {
+		return nil
+	}
+	err := rg.eventLog.file.Close()
+	rg.eventLog = nil
+	return err
+}
+
+// rotate moves the current log aside so it can be dropped once the snapshot up to seq is saved.
+func (l *GraphEventLog) rotate(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(graphEventLogPath(l.graphPath), rotatedGraphEventLogPath(l.graphPath, seq)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(graphEventLogPath(l.graphPath), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	return nil
+}
+
+// dropRotated deletes every rotated log that is covered by the snapshot up to seq.
+func (l *GraphEventLog) dropRotated(seq uint64) error {
+	paths, seqs, err := rotatedGraphEventLogs(l.graphPath)
+	if err != nil {
+		return err
+	}
+	for i, path := range paths {
+		if seqs[i] > seq {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeGraphEventLogs(graphPath string) error {
+	paths, _, err := rotatedGraphEventLogs(graphPath)
+	if err != nil {
+		return err
+	}
+	for _, path := range append(paths, graphEventLogPath(graphPath)) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveGraphEventLogsAside renames every log of graphPath so it is no longer replayed (but is kept for debugging).
+// Needed when the graph is loaded at an older seq than its logs, or new events would reuse seqs that are already logged.
+func moveGraphEventLogsAside(graphPath string) error {
+	paths, _, err := rotatedGraphEventLogs(graphPath)
+	if err != nil {
+		return err
+	}
+	// rotatedGraphEventLogs ignores anything that doesn't end in a seq
+	suffix := fmt.Sprintf(".unreplayed-%d", time.Now().Unix())
+	for _, path := range append(paths, graphEventLogPath(graphPath)) {
+		if err := os.Rename(path, path+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *GraphEventLog) append(event GraphEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// recordEvent must be called with the same lock held as the mutation it describes.
+func (rg *RepoGraph) recordEvent(event GraphEvent) {
+	if rg.eventLog == nil {
+		return
+	}
+	rg.EventSeq++
+	event.Seq = rg.EventSeq
+	event.Time = time.Now()
+	if err := rg.eventLog.append(event); err != nil {
+		zerolog.Ctx(rg.Ctx).Error().Err(err).Msgf("error appending %s event to graph event log", event.Type)
+	}
+}
+
+func commitGraphSliceLocator(slice CommitGraphSlice) NodeLocator {
+	return NodeLocatorFromTriplet(slice.BranchTarget.BranchName, slice.CommitGraph.GoalID, "")
+}
+
+func nodeSliceLocator(slice NodeSlice) NodeLocator {
+	return NodeLocatorFromTriplet(slice.BranchTarget.BranchName, slice.CommitGraph.GoalID, slice.CommitGraphNode.ID)
+}
+
+func (rg *RepoGraph) recordBranchTargetCreated(bt *RepoGraphBranchTarget) {
+	rg.recordEvent(GraphEvent{
+		Type:         GraphEventBranchTargetCreated,
+		Locator:      NodeLocatorFromTriplet(bt.BranchName, "", ""),
+		BranchTarget: bt,
+	})
+}
+
+func (rg *RepoGraph) recordCommitGraphCreated(slice CommitGraphSlice) {
+	rg.recordEvent(GraphEvent{
+		Type:        GraphEventCommitGraphCreated,
+		Locator:     commitGraphSliceLocator(slice),
+		CommitGraph: slice.CommitGraph,
+	})
+}
+
+func (rg *RepoGraph) recordCommitGraphState(slice CommitGraphSlice) {
+	rg.recordEvent(GraphEvent{
+		Type:       GraphEventCommitGraphStateChanged,
+		Locator:    commitGraphSliceLocator(slice),
+		GraphState: slice.CommitGraph.State,
+	})
+}
+
+func (rg *RepoGraph) recordCommitGraphResults(slice CommitGraphSlice) {
+	rg.recordEvent(GraphEvent{
+		Type:    GraphEventCommitGraphResultsChanged,
+		Locator: commitGraphSliceLocator(slice),
+		Results: slice.CommitGraph.Results,
+	})
+}
+
+func (rg *RepoGraph) recordNodeAdded(slice NodeSlice) {
+	rg.recordEvent(GraphEvent{
+		Type:    GraphEventNodeAdded,
+		Locator: nodeSliceLocator(slice),
+		Node:    slice.CommitGraphNode,
+	})
+}
+
+func (rg *RepoGraph) recordNodeDeleted(locator NodeLocator) {
+	rg.recordEvent(GraphEvent{
+		Type:    GraphEventNodeDeleted,
+		Locator: locator,
+	})
+}
+
+func (rg *RepoGraph) recordNodeState(slice NodeSlice) {
+	rg.recordEvent(GraphEvent{
+		Type:                 GraphEventNodeStateChanged,
+		Locator:              nodeSliceLocator(slice),
+		State:                slice.CommitGraphNode.State,
+		Result:               slice.CommitGraphNode.Result,
+		TerminationRequested: slice.CommitGraphNode.TerminationRequested,
+	})
+}
+
+func (rg *RepoGraph) recordNodeOutputs(slice NodeSlice) {
+	rg.recordEvent(GraphEvent{
+		Type:              GraphEventNodeOutputsAttached,
+		Locator:           nodeSliceLocator(slice),
+		ActionOutputs:     slice.CommitGraphNode.ActionOutputs,
+		CompilationResult: slice.CommitGraphNode.CompilationResult,
+	})
+}
+
+func (rg *RepoGraph) recordNodeArchival(slice NodeSlice) {
+	rg.recordEvent(GraphEvent{
+		Type:              GraphEventNodeArchivalChanged,
+		Locator:           nodeSliceLocator(slice),
+		InferenceOutput:   slice.CommitGraphNode.InferenceOutput,
+		ActionOutputs:     slice.CommitGraphNode.ActionOutputs,
+		CompilationResult: slice.CommitGraphNode.CompilationResult,
+		ArchivedPayload:   slice.CommitGraphNode.ArchivedPayload,
+	})
+}
+
+func (rg *RepoGraph) recordNodeMetadata(slice NodeSlice) {
+	metadata := slice.CommitGraphNode.Metadata
+	rg.recordEvent(GraphEvent{
+		Type:     GraphEventNodeMetadataEdited,
+		Locator:  nodeSliceLocator(slice),
+		Metadata: &metadata,
+	})
+}
+
+// applyEvent replays a single event onto rg.
+func (rg *RepoGraph) applyEvent(event GraphEvent) error {
+	switch event.Type {
+	case GraphEventBranchTargetCreated:
+		if event.BranchTarget == nil {
+			return errors.New("missing branch target")
+		}
+		if existing, ok := rg.BranchTargets[event.BranchTarget.BranchName]; ok {
+			// keep the subgraphs that were created after it
+			event.BranchTarget.Subgraphs = existing.Subgraphs
+		}
+		if event.BranchTarget.Subgraphs == nil {
+			event.BranchTarget.Subgraphs = map[GoalID]*CommitGraph{}
+		}
+		rg.BranchTargets[event.BranchTarget.BranchName] = event.BranchTarget
+		return nil
+	case GraphEventCommitGraphCreated:
+		slice, err := rg.GetBranchTargetSlice(event.Locator.CommitGraphLocator.BranchTargetLocator)
+		if err != nil {
+			return err
+		}
+		if event.CommitGraph == nil {
+			return errors.New("missing commit graph")
+		}
+		if _, ok := slice.BranchTarget.Subgraphs[event.CommitGraph.GoalID]; ok {
+			return nil
+		}
+		slice.BranchTarget.Subgraphs[event.CommitGraph.GoalID] = event.CommitGraph
+		return nil
+	case GraphEventCommitGraphStateChanged, GraphEventCommitGraphResultsChanged:
+		slice, err := rg.GetCommitGraphSlice(event.Locator.CommitGraphLocator)
+		if err != nil {
+			return err
+		}
+		if event.Type == GraphEventCommitGraphStateChanged {
+			slice.CommitGraph.State = event.GraphState
+		} else {
+			slice.CommitGraph.Results = event.Results
+		}
+		return nil
+	case GraphEventNodeAdded:
+		slice, err := rg.GetCommitGraphSlice(event.Locator.CommitGraphLocator)
+		if err != nil {
+			return err
+		}
+		if event.Node == nil {
+			return errors.New("missing node")
+		}
+		slice.CommitGraph.Nodes[event.Node.ID] = event.Node
+		if event.Node.Parent != nil {
+			parent, ok := slice.CommitGraph.Nodes[*event.Node.Parent]
+			if !ok {
+				return fmt.Errorf("parent %v not found", *event.Node.Parent)
+			}
+			if !slices.Contains(parent.Children, event.Node.ID) {
+				parent.Children = append(parent.Children, event.Node.ID)
+			}
+		}
+		return nil
+	case GraphEventNodeDeleted:
+		slice, err := rg.GetCommitGraphSlice(event.Locator.CommitGraphLocator)
+		if err != nil {
+			return err
+		}
+		for _, node := range slice.CommitGraph.Nodes {
+			node.Children = slices.DeleteFunc(node.Children, func(child NodeID) bool {
+				return child == event.Locator.NodeID
+			})
+		}
+		delete(slice.CommitGraph.Nodes, event.Locator.NodeID)
+		return nil
+	}
+
+	slice, err := rg.GetNodeSlice(event.Locator)
+	if err != nil {
+		return err
+	}
+	node := slice.CommitGraphNode
+	switch event.Type {
+	case GraphEventNodeStateChanged:
+		node.State = event.State
+		node.Result = event.Result
+		node.TerminationRequested = event.TerminationRequested
+	case GraphEventNodeOutputsAttached:
+		node.ActionOutputs = event.ActionOutputs
+		node.CompilationResult = event.CompilationResult
+	case GraphEventNodeArchivalChanged:
+		node.InferenceOutput = event.InferenceOutput
+		node.ActionOutputs = event.ActionOutputs
+		if node.ActionOutputs == nil {
+			node.ActionOutputs = []ActionOutput{}
+		}
+		node.CompilationResult = event.CompilationResult
+		node.ArchivedPayload = event.ArchivedPayload
+	case GraphEventNodeMetadataEdited:
+		if event.Metadata == nil {
+			return errors.New("missing metadata")
+		}
+		node.Metadata = *event.Metadata
+	default:
+		return fmt.Errorf("unknown graph event type %s", event.Type)
+	}
+	return nil
+}
+
+// replayEventLogs applies every logged event newer than the snapshot rg was loaded from.
+func (rg *RepoGraph) replayEventLogs(graphPath string) error {
+	paths, _, err := rotatedGraphEventLogs(graphPath)
+	if err != nil {
+		return err
+	}
+	paths = append(paths, graphEventLogPath(graphPath))
+	for _, path := range paths {
+		if err := rg.replayEventLog(path); err != nil {
+			return fmt.Errorf("replaying %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (rg *RepoGraph) replayEventLog(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// a partial last line means we crashed mid-write. That event never happened.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var event GraphEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return err
+		}
+		if event.Seq <= rg.EventSeq {
+			continue
+		}
+		if event.Seq != rg.EventSeq+1 {
+			return fmt.Errorf("events %d-%d are missing", rg.EventSeq+1, event.Seq-1)
+		}
+		if err := rg.applyEvent(event); err != nil {
+			return fmt.Errorf("event %d (%s): %w", event.Seq, event.Type, err)
+		}
+		rg.EventSeq = event.Seq
+	}
+}
@@ -0,0 +1,286 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v3"
+)
+
+// A GraphProblem is an inconsistency found by Fsck.
+type GraphProblem struct {
+	// branch[/goal[/node]]
+	Location    string
+	Description string
+	// true if Fsck was asked to repair & did
+	Repaired bool
+}
+
+func (p GraphProblem) String() string {
+	if p.Repaired {
+		return fmt.Sprintf("%s: %s (repaired)", p.Location, p.Description)
+	}
+	return fmt.Sprintf("%s: %s", p.Location, p.Description)
+}
+
+// Fsck checks the graph for inconsistencies left behind by crashes or manual edits
+// (e.g. /api/graph/delete-node) and, if repair is set, fixes the ones it can.
+// Repairs never invent data: dangling references are dropped & orphaned subtrees are removed.
+// Repairs aren't written to the event log (it can't express all of them), so save the graph afterwards.
+func (rg *RepoGraph) Fsck(repair bool) []GraphProblem {
+	problems := []GraphProblem{}
+	for _, branchName := range slices.Sorted(maps.Keys(rg.BranchTargets)) {
+		branchTarget := rg.BranchTargets[branchName]
+		if branchTarget.ParentBranchName != nil {
+			if _, ok := rg.BranchTargets[*branchTarget.ParentBranchName]; !ok {
+				problem := GraphProblem{
+					Location:    string(branchName),
+					Description: fmt.Sprintf("parent branch target %s does not exist", *branchTarget.ParentBranchName),
+				}
+				if repair {
+					// keep the branch target (and everything explored from it) as an extra root
+					branchTarget.ParentBranchName = nil
+					problem.Description += "; detached it"
+					problem.Repaired = true
+				}
+				problems = append(problems, problem)
+			}
+		}
+		for _, goalID := range slices.Sorted(maps.Keys(branchTarget.Subgraphs)) {
+			slice := CommitGraphSlice{BranchTarget: branchTarget, CommitGraph: branchTarget.Subgraphs[goalID]}
+			problems = append(problems, fsckCommitGraph(slice, repair)...)
+		}
+	}
+	return problems
+}
+
+func fsckCommitGraph(slice CommitGraphSlice, repair bool) []GraphProblem {
+	cg := slice.CommitGraph
+	problems := []GraphProblem{}
+	cgLocation := fmt.Sprintf("%s/%s", slice.BranchTarget.BranchName, cg.GoalID)
+	nodeProblem := func(nodeID NodeID, description string) *GraphProblem {
+		problems = append(problems, GraphProblem{
+			Location:    fmt.Sprintf("%s/%s", cgLocation, nodeID),
+			Description: description,
+		})
+		return &problems[len(problems)-1]
+	}
+
+	if _, ok := cg.Nodes[cg.RootNode]; !ok {
+		problems = append(problems, GraphProblem{
+			Location:    cgLocation,
+			Description: fmt.Sprintf("root node %s does not exist", cg.RootNode),
+		})
+	}
+
+	// Nodes whose parent is gone. Their inference output only makes sense on top of the parent,
+	// so there is nowhere to reattach them. Remove them along with everything below them.
+	for _, nodeID := range slices.Sorted(maps.Keys(cg.Nodes)) {
+		node, ok := cg.Nodes[nodeID]
+		if !ok {
+			// removed with an orphaned ancestor
+			continue
+		}
+		if nodeID == cg.RootNode {
+			if node.Parent != nil {
+				problem := nodeProblem(nodeID, fmt.Sprintf("root node has parent %s", *node.Parent))
+				if repair {
+					node.Parent = nil
+					problem.Repaired = true
+				}
+			}
+			continue
+		}
+		var description string
+		if node.Parent == nil {
+			description = "non-root node has no parent"
+		} else if _, ok := cg.Nodes[*node.Parent]; !ok {
+			description = fmt.Sprintf("parent %s does not exist", *node.Parent)
+		} else {
+			continue
+		}
+		problem := nodeProblem(nodeID, description)
+		if repair {
+			removed := cg.removeSubtree(nodeID)
+			problem.Description += fmt.Sprintf("; removed it and %d descendants", len(removed)-1)
+			problem.Repaired = true
+		}
+	}
+
+	for _, nodeID := range slices.Sorted(maps.Keys(cg.Nodes)) {
+		node := cg.Nodes[nodeID]
+		dangling := slices.DeleteFunc(slices.Clone(node.Children), func(child NodeID) bool {
+			_, ok := cg.Nodes[child]
+			return ok
+		})
+		if len(dangling) > 0 {
+			problem := nodeProblem(nodeID, fmt.Sprintf("children %v do not exist", dangling))
+			if repair {
+				node.Children = slices.DeleteFunc(node.Children, func(child NodeID) bool {
+					return slices.Contains(dangling, child)
+				})
+				problem.Repaired = true
+			}
+		}
+		if node.Parent != nil {
+			parent, ok := cg.Nodes[*node.Parent]
+			if ok && !slices.Contains(parent.Children, nodeID) {
+				problem := nodeProblem(nodeID, fmt.Sprintf("parent %s does not list it as a child", parent.ID))
+				if repair {
+					parent.Children = append(parent.Children, nodeID)
+					problem.Repaired = true
+				}
+			}
+		}
+	}
+
+	resultsChanged := false
+	results := []*CGResult{}
+	for i, result := range cg.Results {
+		dangling := slices.DeleteFunc(slices.Clone(result.GeneratingNodes), func(nodeID NodeID) bool {
+			_, ok := cg.Nodes[nodeID]
+			return ok
+		})
+		if len(dangling) == 0 {
+			results = append(results, result)
+			continue
+		}
+		problem := GraphProblem{
+			Location:    cgLocation,
+			Description: fmt.Sprintf("result %d (branch %s) has generating nodes %v that do not exist", i, result.BranchTarget, dangling),
+		}
+		if repair {
+			result.GeneratingNodes = slices.DeleteFunc(result.GeneratingNodes, func(nodeID NodeID) bool {
+				return slices.Contains(dangling, nodeID)
+			})
+			if len(result.GeneratingNodes) == 0 {
+				problem.Description += "; removed the result"
+			} else {
+				results = append(results, result)
+			}
+			resultsChanged = true
+			problem.Repaired = true
+		} else {
+			results = append(results, result)
+		}
+		problems = append(problems, problem)
+	}
+	if resultsChanged {
+		cg.Results = results
+	}
+
+	// goal setup failures are sticky & not derivable from the nodes
+	if cg.State != GraphStateGoalSetupFailed {
+		if state, ok := cg.computedState(); ok && state != cg.State {
+			problem := GraphProblem{
+				Location:    cgLocation,
+				Description: fmt.Sprintf("state is %s but its nodes say %s", cg.State, state),
+			}
+			if repair {
+				cg.State = state
+				problem.Repaired = true
+			}
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// removeSubtree deletes nodeID and every node below it (by Parent). Returns the deleted IDs.
+func (cg *CommitGraph) removeSubtree(nodeID NodeID) []NodeID {
+	removed := []NodeID{}
+	queue := []NodeID{nodeID}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if _, ok := cg.Nodes[current]; !ok {
+			continue
+		}
+		delete(cg.Nodes, current)
+		removed = append(removed, current)
+		for _, node := range cg.Nodes {
+			if node.Parent != nil && *node.Parent == current {
+				queue = append(queue, node.ID)
+			}
+		}
+	}
+	return removed
+}
+
+// fsckGraphFile runs Fsck on the graph at path and, if anything was repaired, saves it.
+// The loaded graph (including events that saving drops from the log) is first written to backupPath.
+func fsckGraphFile(path string, repair bool) (problems []GraphProblem, backupPath string, err error) {
+	rg := &RepoGraph{}
+	if err := rg.LoadFromFile(path); err != nil {
+		return nil, "", err
+	}
+	var original []byte
+	if repair {
+		rg.SchemaVersion = CurrentGraphSchemaVersion
+		if original, err = json.Marshal(rg); err != nil {
+			return nil, "", err
+		}
+	}
+	problems = rg.Fsck(repair)
+	if !slices.ContainsFunc(problems, func(p GraphProblem) bool { return p.Repaired }) {
+		return problems, "", nil
+	}
+	backupPath = fmt.Sprintf("%s.v%d-%s.bak", path, CurrentGraphSchemaVersion, time.Now().UTC().Format(graphSnapshotTimeFormat))
+	if err := writeFileAtomic(backupPath, original); err != nil {
+		return problems, "", err
+	}
+	if err := rg.SaveToFile(path); err != nil {
+		return problems, backupPath, err
+	}
+	return problems, backupPath, nil
+}
+
+func createGraphFsckCli() *cli.Command {
+	action := func(ctx context.Context, cmd *cli.Command) error {
+		logger := zerolog.Ctx(ctx)
+		path := cmd.Args().First()
+		if path == "" {
+			return errors.New("no graph file given")
+		}
+		problems, backupPath, err := fsckGraphFile(path, cmd.Bool("repair"))
+		if err != nil {
+			return err
+		}
+		unrepaired := 0
+		for _, problem := range problems {
+			fmt.Println(problem)
+			if !problem.Repaired {
+				unrepaired++
+			}
+		}
+		if len(problems) == 0 {
+			logger.Info().Msgf("%s is consistent", path)
+			return nil
+		}
+		if backupPath != "" {
+			logger.Info().Msgf("repaired %d problems in %s (backup at %s)", len(problems)-unrepaired, path, backupPath)
+		}
+		if unrepaired > 0 {
+			return fmt.Errorf("%d problems found in %s", unrepaired, path)
+		}
+		return nil
+	}
+	return &cli.Command{
+		Name:      "fsck",
+		Usage:     "check a graph file for inconsistencies (dangling references, orphaned nodes, stale states)",
+		ArgsUsage: "<graph.json>",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "repair",
+				Usage: "fix what can be fixed and save the graph (after backing it up)",
+			},
+		},
+		Action: action,
+	}
+}
@@ -0,0 +1,214 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v3"
+)
+
+// GraphMergePolicy decides which source wins when two graphs disagree about a branch target or a commit graph.
+type GraphMergePolicy string
+
+const (
+	GraphMergePolicyFirst GraphMergePolicy = "first"
+	GraphMergePolicyLast  GraphMergePolicy = "last"
+	// the commit graph with more nodes (the branch target with more subgraphs in its own source). Ties go to the first.
+	GraphMergePolicyLargest GraphMergePolicy = "largest"
+	GraphMergePolicyError   GraphMergePolicy = "error"
+)
+
+var graphMergePolicies = []GraphMergePolicy{GraphMergePolicyFirst, GraphMergePolicyLast, GraphMergePolicyLargest, GraphMergePolicyError}
+
+type GraphMergeSource struct {
+	// recorded in the Source of everything taken from Graph
+	Name  string
+	Graph *RepoGraph
+}
+
+// MergeRepoGraphs unions the branch targets & commit graphs of sources (e.g. a graph and its clones).
+// Branch targets with the same name have their subgraphs merged. A branch target or commit graph that
+// differs between sources is a conflict and is resolved by policy (every conflict is described in the returned slice).
+// Parts that already have a Source (from an earlier merge) keep it.
+// The merged graph takes ownership of the sources' branch targets & commit graphs.
+func MergeRepoGraphs(sources []GraphMergeSource, policy GraphMergePolicy) (*RepoGraph, []string, error) {
+	if !slices.Contains(graphMergePolicies, policy) {
+		return nil, nil, fmt.Errorf("unknown merge policy %q", policy)
+	}
+	merged := &RepoGraph{
+		SchemaVersion:       CurrentGraphSchemaVersion,
+		ID:                  NewRepoGraphID(),
+		BranchTargets:       map[BranchName]*RepoGraphBranchTarget{},
+		ShouldAdvertiseChan: make(chan CommitGraphLocator, 64),
+	}
+	conflicts := []string{}
+	// number of subgraphs of the winning version of each branch target in its own source
+	// (the merged branch target also collects the subgraphs of every other source, so its size depends on the order)
+	branchTargetSizes := map[BranchName]int{}
+	// reports a conflict & whether the new version should replace the existing one
+	choose := func(description string, existingSource string, existingSize int, source string, size int) (bool, error) {
+		conflict := fmt.Sprintf("%s differs between %s and %s", description, existingSource, source)
+		replace := false
+		switch policy {
+		case GraphMergePolicyError:
+			return false, errors.New(conflict)
+		case GraphMergePolicyLast:
+			replace = true
+		case GraphMergePolicyLargest:
+			replace = size > existingSize
+		}
+		winner := existingSource
+		if replace {
+			winner = source
+		}
+		conflicts = append(conflicts, fmt.Sprintf("%s; kept %s", conflict, winner))
+		return replace, nil
+	}
+
+	for _, source := range sources {
+		merged.MergedFrom = append(merged.MergedFrom, source.Name)
+		for _, branchName := range slices.Sorted(maps.Keys(source.Graph.BranchTargets)) {
+			branchTarget := source.Graph.BranchTargets[branchName]
+			if branchTarget.Source == "" {
+				branchTarget.Source = source.Name
+			}
+			for _, cg := range branchTarget.Subgraphs {
+				if cg.Source == "" {
+					cg.Source = source.Name
+				}
+			}
+			existing, ok := merged.BranchTargets[branchName]
+			if !ok {
+				merged.BranchTargets[branchName] = branchTarget
+				branchTargetSizes[branchName] = len(branchTarget.Subgraphs)
+				continue
+			}
+			subgraphs := existing.Subgraphs
+			if !sameBranchTarget(existing, branchTarget) {
+				replace, err := choose(fmt.Sprintf("branch target %s", branchName), existing.Source, branchTargetSizes[branchName], branchTarget.Source, len(branchTarget.Subgraphs))
+				if err != nil {
+					return nil, nil, err
+				}
+				// keep everything from the winning version except the subgraphs (which are merged separately)
+				if replace {
+					existing.ParentBranchName = branchTarget.ParentBranchName
+					existing.TraversalGoalID = branchTarget.TraversalGoalID
+					existing.CreatedAt = branchTarget.CreatedAt
+					existing.Source = branchTarget.Source
+					branchTargetSizes[branchName] = len(branchTarget.Subgraphs)
+				}
+			}
+			for _, goalID := range slices.Sorted(maps.Keys(branchTarget.Subgraphs)) {
+				cg := branchTarget.Subgraphs[goalID]
+				existingCG, ok := subgraphs[goalID]
+				if !ok {
+					subgraphs[goalID] = cg
+					continue
+				}
+				same, err := sameCommitGraph(existingCG, cg)
+				if err != nil {
+					return nil, nil, err
+				}
+				if same {
+					continue
+				}
+				replace, err := choose(fmt.Sprintf("commit graph %s/%s", branchName, goalID), existingCG.Source, len(existingCG.Nodes), cg.Source, len(cg.Nodes))
+				if err != nil {
+					return nil, nil, err
+				}
+				if replace {
+					subgraphs[goalID] = cg
+				}
+			}
+		}
+	}
+	return merged, conflicts, nil
+}
+
+func sameBranchTarget(a, b *RepoGraphBranchTarget) bool {
+	return a.CreatedAt.Equal(b.CreatedAt) &&
+		(a.ParentBranchName == nil) == (b.ParentBranchName == nil) &&
+		(a.ParentBranchName == nil || *a.ParentBranchName == *b.ParentBranchName) &&
+		(a.TraversalGoalID == nil) == (b.TraversalGoalID == nil) &&
+		(a.TraversalGoalID == nil || *a.TraversalGoalID == *b.TraversalGoalID)
+}
+
+// ignores Source (the same commit graph in a graph & its untouched clone isn't a conflict)
+func sameCommitGraph(a, b *CommitGraph) (bool, error) {
+	aCopy, bCopy := *a, *b
+	aCopy.Source, bCopy.Source = "", ""
+	aJSON, err := json.Marshal(aCopy)
+	if err != nil {
+		return false, err
+	}
+	bJSON, err := json.Marshal(bCopy)
+	if err != nil {
+		return false, err
+	}
+	return string(aJSON) == string(bJSON), nil
+}
+
+func createGraphMergeCli() *cli.Command {
+	outFile := ""
+	policy := ""
+	action := func(ctx context.Context, cmd *cli.Command) error {
+		logger := zerolog.Ctx(ctx)
+		paths := cmd.Args().Slice()
+		if len(paths) < 2 {
+			return errors.New("need at least two graph files to merge")
+		}
+		if slices.Contains(paths, outFile) {
+			return errors.New("--out must not be one of the inputs")
+		}
+		sources := []GraphMergeSource{}
+		for _, path := range paths {
+			rg := &RepoGraph{}
+			if err := rg.LoadFromFile(path); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			sources = append(sources, GraphMergeSource{Name: path, Graph: rg})
+		}
+		merged, conflicts, err := MergeRepoGraphs(sources, GraphMergePolicy(policy))
+		if err != nil {
+			return err
+		}
+		for _, conflict := range conflicts {
+			logger.Warn().Msg(conflict)
+		}
+		for _, path := range paths {
+			if err := NewGraphArchive(path).CopyTo(NewGraphArchive(outFile)); err != nil {
+				return err
+			}
+		}
+		if err := merged.SaveToFile(outFile); err != nil {
+			return err
+		}
+		logger.Info().Msgf("merged %d graphs into %s (%d branch targets, %d conflicts)", len(paths), outFile, len(merged.BranchTargets), len(conflicts))
+		return nil
+	}
+	return &cli.Command{
+		Name:      "merge",
+		Usage:     "union the branch targets & commit graphs of several graphs (e.g. a graph and its clones)",
+		ArgsUsage: "<graph.json> <graph.json>...",
+		Action:    action,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "out",
+				Usage:       "path to save the merged graph",
+				Destination: &outFile,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "policy",
+				Usage:       fmt.Sprintf("how to resolve conflicts: %v", graphMergePolicies),
+				Value:       string(GraphMergePolicyLargest),
+				Destination: &policy,
+			},
+		},
+	}
+}
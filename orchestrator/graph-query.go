@@ -0,0 +1,444 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/urfave/cli/v3"
+)
+
+// A small filter language over nodes, for `graph query`:
+//
+//	result = success and depth <= 3 and goal = "add_comm"
+//	compilation ~ 'unknown identifier' and not (state = done)
+//
+// Comparisons are `field op value`, combined with and/or/not & parentheses (and binds tighter than or).
+// Values are bare words or '...'/"..." strings. Enum fields (result, state) may drop their
+// node_result_/node_state_/node_ prefixes. ~ and !~ match a Go regexp anywhere in the field.
+
+type nodeQueryField struct {
+	kind string // "string", "int" or "bool"
+	// enum values also match with these prefixes removed
+	prefixes []string
+	// reads a payload (which may be archived, see RepoGraph.Compact)
+	payload bool
+	// for strings & enums (any match counts), ints use the first element
+	get func(slice NodeSlice, goalProvider GoalProvider) []string
+}
+
+var nodeQueryFields = map[string]nodeQueryField{
+	"result": {kind: "string", prefixes: []string{"node_result_"}, get: func(slice NodeSlice, _ GoalProvider) []string {
+		return []string{string(slice.CommitGraphNode.Result)}
+	}},
+	"state": {kind: "string", prefixes: []string{"node_state_", "node_"}, get: func(slice NodeSlice, _ GoalProvider) []string {
+		return []string{string(slice.CommitGraphNode.State)}
+	}},
+	"depth": {kind: "int", get: func(slice NodeSlice, _ GoalProvider) []string {
+		return []string{strconv.Itoa(slice.CommitGraphNode.Depth)}
+	}},
+	// goal id, or name if a goal file was given
+	"goal": {kind: "string", get: func(slice NodeSlice, goalProvider GoalProvider) []string {
+		values := []string{string(slice.CommitGraph.GoalID)}
+		if goalProvider != nil {
+			if goal := goalProvider.GetGoal(slice.CommitGraph.GoalID); goal != nil {
+				values = append(values, goal.Name())
+			}
+		}
+		return values
+	}},
+	"branch": {kind: "string", get: func(slice NodeSlice, _ GoalProvider) []string {
+		return []string{string(slice.BranchTarget.BranchName)}
+	}},
+	"label": {kind: "string", get: func(slice NodeSlice, _ GoalProvider) []string {
+		return []string{slice.CommitGraphNode.Metadata.Label}
+	}},
+	"favorite": {kind: "bool", get: func(slice NodeSlice, _ GoalProvider) []string {
+		return []string{strconv.FormatBool(slice.CommitGraphNode.Metadata.IsFavorite)}
+	}},
+	"golden": {kind: "bool", get: func(slice NodeSlice, _ GoalProvider) []string {
+		return []string{strconv.FormatBool(slice.CommitGraphNode.Metadata.IsGoldenSample)}
+	}},
+	"output": {kind: "string", payload: true, get: func(slice NodeSlice, _ GoalProvider) []string {
+		return []string{slice.CommitGraphNode.InferenceOutput}
+	}},
+	"actions": {kind: "string", payload: true, get: func(slice NodeSlice, _ GoalProvider) []string {
+		values := []string{}
+		for _, output := range slice.CommitGraphNode.ActionOutputs {
+			values = append(values, output.Text)
+		}
+		return values
+	}},
+	"compilation": {kind: "string", payload: true, get: func(slice NodeSlice, _ GoalProvider) []string {
+		if slice.CommitGraphNode.CompilationResult == nil {
+			return []string{}
+		}
+		return []string{slice.CommitGraphNode.CompilationResult.Out}
+	}},
+}
+
+// NodeQuery is a compiled filter. See ParseNodeQuery.
+type NodeQuery struct {
+	match         func(slice NodeSlice, goalProvider GoalProvider) bool
+	readsPayloads bool
+}
+
+// Match reports whether the node matches. goalProvider may be nil (goal then only matches ids).
+func (q *NodeQuery) Match(slice NodeSlice, goalProvider GoalProvider) bool {
+	return q.match(slice, goalProvider)
+}
+
+type queryToken struct {
+	// "word", "string", "op", "(" or ")"
+	kind  string
+	value string
+	pos   int
+}
+
+var queryOps = []string{"!=", "<=", ">=", "!~", "=", "<", ">", "~"}
+
+func lexNodeQuery(query string) ([]queryToken, error) {
+	tokens := []queryToken{}
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, queryToken{kind: string(c), value: string(c), pos: i})
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(query[i+1:], c)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, queryToken{kind: "string", value: query[i+1 : i+1+end], pos: i})
+			i += end + 2
+		default:
+			op := ""
+			for _, candidate := range queryOps {
+				if strings.HasPrefix(query[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op != "" {
+				tokens = append(tokens, queryToken{kind: "op", value: op, pos: i})
+				i += len(op)
+				continue
+			}
+			start := i
+			for i < len(query) && !unicode.IsSpace(rune(query[i])) && !strings.ContainsRune("()'\"=!<>~", rune(query[i])) {
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, queryToken{kind: "word", value: query[start:i], pos: start})
+		}
+	}
+	return tokens, nil
+}
+
+type nodeQueryParser struct {
+	tokens        []queryToken
+	pos           int
+	readsPayloads bool
+}
+
+func (p *nodeQueryParser) peek() *queryToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *nodeQueryParser) peekKeyword(keyword string) bool {
+	token := p.peek()
+	return token != nil && token.kind == "word" && strings.EqualFold(token.value, keyword)
+}
+
+type nodeQueryMatcher = func(slice NodeSlice, goalProvider GoalProvider) bool
+
+func (p *nodeQueryParser) parseOr() (nodeQueryMatcher, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(slice NodeSlice, goalProvider GoalProvider) bool {
+			return l(slice, goalProvider) || right(slice, goalProvider)
+		}
+	}
+	return left, nil
+}
+
+func (p *nodeQueryParser) parseAnd() (nodeQueryMatcher, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(slice NodeSlice, goalProvider GoalProvider) bool {
+			return l(slice, goalProvider) && right(slice, goalProvider)
+		}
+	}
+	return left, nil
+}
+
+func (p *nodeQueryParser) parseUnary() (nodeQueryMatcher, error) {
+	if p.peekKeyword("not") {
+		p.pos++
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(slice NodeSlice, goalProvider GoalProvider) bool {
+			return !inner(slice, goalProvider)
+		}, nil
+	}
+	if token := p.peek(); token != nil && token.kind == "(" {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if token := p.peek(); token == nil || token.kind != ")" {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *nodeQueryParser) parseComparison() (nodeQueryMatcher, error) {
+	fieldToken := p.peek()
+	if fieldToken == nil {
+		return nil, errors.New("unexpected end of query")
+	}
+	if fieldToken.kind != "word" {
+		return nil, fmt.Errorf("expected a field at %d, got %q", fieldToken.pos, fieldToken.value)
+	}
+	field, ok := nodeQueryFields[fieldToken.value]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q (expected one of %s)", fieldToken.value, strings.Join(slices.Sorted(maps.Keys(nodeQueryFields)), ", "))
+	}
+	p.readsPayloads = p.readsPayloads || field.payload
+	p.pos++
+	opToken := p.peek()
+	if opToken == nil || opToken.kind != "op" {
+		return nil, fmt.Errorf("expected an operator after %s", fieldToken.value)
+	}
+	p.pos++
+	valueToken := p.peek()
+	if valueToken == nil || (valueToken.kind != "word" && valueToken.kind != "string") {
+		return nil, fmt.Errorf("expected a value after %s %s", fieldToken.value, opToken.value)
+	}
+	p.pos++
+	return compileNodeQueryComparison(fieldToken.value, field, opToken.value, valueToken.value)
+}
+
+func compileNodeQueryComparison(name string, field nodeQueryField, op string, value string) (nodeQueryMatcher, error) {
+	negate := op == "!=" || op == "!~"
+	switch {
+	case op == "~" || op == "!~":
+		if field.kind != "string" {
+			return nil, fmt.Errorf("%s can't be matched with %s", name, op)
+		}
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(slice NodeSlice, goalProvider GoalProvider) bool {
+			return slices.ContainsFunc(field.get(slice, goalProvider), re.MatchString) != negate
+		}, nil
+	case field.kind == "int":
+		want, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s expects a number, got %q", name, value)
+		}
+		return func(slice NodeSlice, goalProvider GoalProvider) bool {
+			got, _ := strconv.Atoi(field.get(slice, goalProvider)[0])
+			switch op {
+			case "=":
+				return got == want
+			case "!=":
+				return got != want
+			case "<":
+				return got < want
+			case "<=":
+				return got <= want
+			case ">":
+				return got > want
+			default:
+				return got >= want
+			}
+		}, nil
+	case op != "=" && op != "!=":
+		return nil, fmt.Errorf("%s can't be compared with %s", name, op)
+	case field.kind == "bool":
+		want, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s expects true or false, got %q", name, value)
+		}
+		return func(slice NodeSlice, goalProvider GoalProvider) bool {
+			return (field.get(slice, goalProvider)[0] == strconv.FormatBool(want)) != negate
+		}, nil
+	default:
+		return func(slice NodeSlice, goalProvider GoalProvider) bool {
+			return slices.ContainsFunc(field.get(slice, goalProvider), func(got string) bool {
+				if got == value {
+					return true
+				}
+				for _, prefix := range field.prefixes {
+					if strings.TrimPrefix(got, prefix) == value {
+						return true
+					}
+				}
+				return false
+			}) != negate
+		}, nil
+	}
+}
+
+// ParseNodeQuery compiles a filter expression (see the top of this file).
+func ParseNodeQuery(query string) (*NodeQuery, error) {
+	tokens, err := lexNodeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return &NodeQuery{match: func(NodeSlice, GoalProvider) bool { return true }}, nil
+	}
+	parser := &nodeQueryParser{tokens: tokens}
+	match, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token != nil {
+		return nil, fmt.Errorf("unexpected %q at %d", token.value, token.pos)
+	}
+	return &NodeQuery{match: match, readsPayloads: parser.readsPayloads}, nil
+}
+
+// Query returns the nodes matching q, ordered by branch target, goal & node id.
+// If q reads payloads, archived nodes are matched (and returned) with their payloads loaded from archive.
+// archive may be nil if the graph was never compacted.
+func (rg *RepoGraph) Query(q *NodeQuery, goalProvider GoalProvider, archive *GraphArchive) ([]NodeSlice, error) {
+	matches := []NodeSlice{}
+	for _, branchName := range slices.Sorted(maps.Keys(rg.BranchTargets)) {
+		for _, goalID := range slices.Sorted(maps.Keys(rg.BranchTargets[branchName].Subgraphs)) {
+			graph := rg
+			if q.readsPayloads && archive != nil {
+				var err error
+				graph, err = rg.HydratedCommitGraph(CommitGraphLocator{BranchTargetLocator: BranchTargetLocator{BranchName: branchName}, GoalID: goalID}, archive)
+				if err != nil {
+					return nil, err
+				}
+			}
+			branchTarget := graph.BranchTargets[branchName]
+			cg := branchTarget.Subgraphs[goalID]
+			for _, nodeID := range slices.Sorted(maps.Keys(cg.Nodes)) {
+				slice := NodeSlice{BranchTarget: branchTarget, CommitGraph: cg, CommitGraphNode: cg.Nodes[nodeID]}
+				if q.Match(slice, goalProvider) {
+					matches = append(matches, slice)
+				}
+			}
+		}
+	}
+	return matches, nil
+}
+
+func createGraphQueryCli() *cli.Command {
+	goalFile := ""
+	full := false
+	action := func(ctx context.Context, cmd *cli.Command) error {
+		path := cmd.Args().First()
+		if path == "" {
+			return errors.New("no graph file given")
+		}
+		q, err := ParseNodeQuery(strings.Join(cmd.Args().Tail(), " "))
+		if err != nil {
+			return fmt.Errorf("invalid query: %w", err)
+		}
+		rg := &RepoGraph{}
+		if err := rg.LoadFromFile(path); err != nil {
+			return err
+		}
+		var goalProvider GoalProvider
+		if goalFile != "" {
+			goalProvider = StaticGoalProviderFromFile(goalFile)
+		}
+		type fullNode struct {
+			Locator NodeLocator      `json:"locator"`
+			Node    *CommitGraphNode `json:"node"`
+		}
+		archive := NewGraphArchive(path)
+		matches, err := rg.Query(q, goalProvider, archive)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		for _, slice := range matches {
+			locator := NodeLocatorFromTriplet(slice.BranchTarget.BranchName, slice.CommitGraph.GoalID, slice.CommitGraphNode.ID)
+			if full {
+				node := *slice.CommitGraphNode
+				if node.ArchivedPayload != "" {
+					if err := restoreArchivedNode(&node, archive); err != nil {
+						return err
+					}
+				}
+				err = encoder.Encode(fullNode{Locator: locator, Node: &node})
+			} else {
+				err = encoder.Encode(locator)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return &cli.Command{
+		Name:      "query",
+		Usage:     "print (as JSONL) the locators of nodes matching a filter, e.g. `result = success and depth <= 3`",
+		ArgsUsage: "<graph.json> <filter>",
+		Description: "Fields: result, state, depth, goal, branch, label, favorite, golden, output (inference output), " +
+			"actions (action outputs) & compilation (compilation output).\n" +
+			"Operators: = != < <= > >= (depth only) and ~ !~ (regexp).\n" +
+			"Combine with and, or, not & parentheses. Quote values with spaces.",
+		Action: action,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "goal",
+				Usage:       "path to goal file (lets goal match goal names)",
+				Destination: &goalFile,
+			},
+			&cli.BoolFlag{
+				Name:        "full",
+				Usage:       "print the whole node alongside its locator",
+				Destination: &full,
+			},
+		},
+	}
+}
@@ -0,0 +1,270 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Static pictures of a run (for write-ups & for comparing runs), as DOT or Mermaid.
+// Both formats are written from the same renderGraph so they always show the same thing.
+
+type renderNode struct {
+	ID string
+	// may contain newlines
+	Label string
+	// empty for the default
+	Color string
+}
+
+type renderEdge struct {
+	From  string
+	To    string
+	Label string
+}
+
+type renderGraph struct {
+	Nodes []renderNode
+	Edges []renderEdge
+}
+
+var nodeResultColors = map[NodeResult]string{
+	NodeResultNone:                     "#ffffff",
+	NodeResultSuccess:                  "#8bc34a",
+	NodeResultFailure:                  "#ef5350",
+	NodeResultSyntaxFailure:            "#ffa726",
+	NodeResultDepthExhaustionFailure:   "#ab47bc",
+	NodeResultContextExhaustionFailure: "#7e57c2",
+	NodeResultTerminated:               "#bdbdbd",
+	NodeResultAborted:                  "#8d6e63",
+	NodeResultInfrastructureFailure:    "#78909c",
+}
+
+func goalName(goalProvider GoalProvider, goalID GoalID) string {
+	if goal := goalProvider.GetGoal(goalID); goal != nil && goal.Name() != "" {
+		return goal.Name()
+	}
+	return string(goalID)
+}
+
+// renderBranchTargetTree has one node per branch target & an edge from each to the branch targets explored from it.
+func (rg *RepoGraph) renderBranchTargetTree(goalProvider GoalProvider) renderGraph {
+	graph := renderGraph{}
+	for _, branchName := range slices.Sorted(maps.Keys(rg.BranchTargets)) {
+		branchTarget := rg.BranchTargets[branchName]
+		graph.Nodes = append(graph.Nodes, renderNode{
+			ID:    string(branchName),
+			Label: fmt.Sprintf("%s\n%d goals attempted", branchName, len(branchTarget.Subgraphs)),
+		})
+		if branchTarget.ParentBranchName == nil {
+			continue
+		}
+		edge := renderEdge{From: string(*branchTarget.ParentBranchName), To: string(branchName)}
+		if branchTarget.TraversalGoalID != nil {
+			edge.Label = goalName(goalProvider, *branchTarget.TraversalGoalID)
+		}
+		graph.Edges = append(graph.Edges, edge)
+	}
+	return graph
+}
+
+// renderCommitGraph has one node per commit graph node, coloured by result.
+// Edges are labelled with the child's advantage (see ExtractData) when the graph has training data & the goal is known.
+func (rg *RepoGraph) renderCommitGraph(locator CommitGraphLocator, goalProvider GoalProvider) (renderGraph, error) {
+	slice, err := rg.GetCommitGraphSlice(locator)
+	if err != nil {
+		return renderGraph{}, err
+	}
+	advantages := map[NodeID]float64{}
+	// the prompts ExtractData builds need the goal
+	if goalProvider.GetGoal(locator.GoalID) != nil {
+		data, err := rg.ExtractData(locator, goalProvider)
+		if err != nil {
+			return renderGraph{}, err
+		}
+		for _, datum := range data.Nodes {
+			for _, output := range datum.Outputs {
+				advantages[output.NodeID] = output.Advantage
+			}
+		}
+	}
+
+	graph := renderGraph{}
+	cg := slice.CommitGraph
+	for _, nodeID := range slices.Sorted(maps.Keys(cg.Nodes)) {
+		node := cg.Nodes[nodeID]
+		label := fmt.Sprintf("%s\ndepth %d\n%s", nodeID, node.Depth, shortNodeResult(node.Result))
+		if nodeID == cg.RootNode {
+			label = fmt.Sprintf("%s\n%s", goalName(goalProvider, cg.GoalID), label)
+		}
+		graph.Nodes = append(graph.Nodes, renderNode{
+			ID:    string(nodeID),
+			Label: label,
+			Color: nodeResultColors[node.Result],
+		})
+		for _, child := range node.Children {
+			edge := renderEdge{From: string(nodeID), To: string(child)}
+			if advantage, ok := advantages[child]; ok {
+				edge.Label = fmt.Sprintf("adv %.2f", advantage)
+			}
+			graph.Edges = append(graph.Edges, edge)
+		}
+	}
+	return graph, nil
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
+
+func (graph renderGraph) WriteDOT(out io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph {\n")
+	b.WriteString("\tnode [shape=box, style=filled, fillcolor=\"#ffffff\"];\n")
+	for _, node := range graph.Nodes {
+		fmt.Fprintf(&b, "\t%s [label=%s", dotQuote(node.ID), dotQuote(node.Label))
+		if node.Color != "" {
+			fmt.Fprintf(&b, ", fillcolor=%s", dotQuote(node.Color))
+		}
+		b.WriteString("];\n")
+	}
+	for _, edge := range graph.Edges {
+		fmt.Fprintf(&b, "\t%s -> %s", dotQuote(edge.From), dotQuote(edge.To))
+		if edge.Label != "" {
+			fmt.Fprintf(&b, " [label=%s]", dotQuote(edge.Label))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+func mermaidQuote(s string) string {
+	s = strings.ReplaceAll(s, `"`, "#quot;")
+	return `"` + strings.ReplaceAll(s, "\n", "<br/>") + `"`
+}
+
+func (graph renderGraph) WriteMermaid(out io.Writer) error {
+	// mermaid ids can't contain most punctuation, so number the nodes instead
+	ids := map[string]string{}
+	id := func(nodeID string) string {
+		if _, ok := ids[nodeID]; !ok {
+			ids[nodeID] = fmt.Sprintf("n%d", len(ids))
+		}
+		return ids[nodeID]
+	}
+	var b strings.Builder
+	b.WriteString("flowchart TD\n")
+	for _, node := range graph.Nodes {
+		fmt.Fprintf(&b, "\t%s[%s]\n", id(node.ID), mermaidQuote(node.Label))
+	}
+	for _, edge := range graph.Edges {
+		if edge.Label != "" {
+			fmt.Fprintf(&b, "\t%s -->|%s| %s\n", id(edge.From), mermaidQuote(edge.Label), id(edge.To))
+		} else {
+			fmt.Fprintf(&b, "\t%s --> %s\n", id(edge.From), id(edge.To))
+		}
+	}
+	for _, node := range graph.Nodes {
+		if node.Color != "" {
+			fmt.Fprintf(&b, "\tstyle %s fill:%s\n", id(node.ID), node.Color)
+		}
+	}
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+func createGraphRenderCli() *cli.Command {
+	goalFile := ""
+	format := ""
+	branchName := ""
+	goalID := ""
+	outFile := ""
+	action := func(ctx context.Context, cmd *cli.Command) error {
+		path := cmd.Args().First()
+		if path == "" {
+			return errors.New("no graph file given")
+		}
+		rg := &RepoGraph{}
+		if err := rg.LoadFromFile(path); err != nil {
+			return err
+		}
+		if (branchName == "") != (goalID == "") {
+			return errors.New("--branch and --goal-id must be given together")
+		}
+		goalProvider := StaticGoalProviderFromFile(goalFile)
+		graph := rg.renderBranchTargetTree(goalProvider)
+		if branchName != "" {
+			var err error
+			graph, err = rg.renderCommitGraph(CommitGraphLocator{
+				BranchTargetLocator: BranchTargetLocator{BranchName: BranchName(branchName)},
+				GoalID:              GoalID(goalID),
+			}, goalProvider)
+			if err != nil {
+				return err
+			}
+		}
+		out := io.Writer(os.Stdout)
+		if outFile != "" {
+			file, err := os.Create(outFile)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			out = file
+		}
+		switch format {
+		case "dot":
+			return graph.WriteDOT(out)
+		case "mermaid":
+			return graph.WriteMermaid(out)
+		default:
+			return fmt.Errorf("unknown format %q (expected dot or mermaid)", format)
+		}
+	}
+	return &cli.Command{
+		Name:      "render",
+		Usage:     "draw the branch target tree (or, with --branch & --goal-id, a single commit graph)",
+		ArgsUsage: "<graph.json>",
+		Action:    action,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "goal",
+				Usage:       "path to goal file",
+				Destination: &goalFile,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "format",
+				Usage:       "dot or mermaid",
+				Value:       "dot",
+				Destination: &format,
+			},
+			&cli.StringFlag{
+				Name:        "branch",
+				Usage:       "branch target of the commit graph to render",
+				Destination: &branchName,
+			},
+			&cli.StringFlag{
+				Name:        "goal-id",
+				Usage:       "goal of the commit graph to render",
+				Destination: &goalID,
+			},
+			&cli.StringFlag{
+				Name:        "out",
+				Usage:       "path to write to (default: stdout)",
+				Destination: &outFile,
+			},
+		},
+	}
+}
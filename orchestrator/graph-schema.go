@@ -0,0 +1,150 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v3"
+)
+
+// CurrentGraphSchemaVersion is written to RepoGraph.SchemaVersion on every save.
+// Bump it (and add a graphMigration) whenever the graph JSON changes in a way older code can't read
+// or a newer field needs a value other than its zero value.
+const CurrentGraphSchemaVersion = 1
+
+// A graphMigration upgrades the raw JSON of a graph from From to From+1.
+// Migrations work on the raw JSON (not RepoGraph) because old files may not unmarshal into the current types.
+type graphMigration struct {
+	From        int
+	Description string
+	Migrate     func(graph map[string]any) error
+}
+
+// graphMigrations[i] must migrate from version i.
+var graphMigrations = []graphMigration{
+	{
+		From:        0,
+		Description: "fill in fields that were added before the graph was versioned",
+		Migrate:     migrateGraphV0ToV1,
+	},
+}
+
+// Files from before schema_version existed. Fields were added over time, so any of them may be missing or null.
+func migrateGraphV0ToV1(graph map[string]any) error {
+	setDefault := func(obj map[string]any, key string, value any) {
+		if existing, ok := obj[key]; !ok || existing == nil {
+			obj[key] = value
+		}
+	}
+	branchTargets, _ := graph["branch_targets"].(map[string]any)
+	if branchTargets == nil {
+		return errors.New("graph has no branch targets")
+	}
+	for _, rawBranchTarget := range branchTargets {
+		branchTarget, ok := rawBranchTarget.(map[string]any)
+		if !ok {
+			return errors.New("branch target is not an object")
+		}
+		setDefault(branchTarget, "subgraphs", map[string]any{})
+		for _, rawSubgraph := range branchTarget["subgraphs"].(map[string]any) {
+			subgraph, ok := rawSubgraph.(map[string]any)
+			if !ok {
+				return errors.New("commit graph is not an object")
+			}
+			setDefault(subgraph, "results", []any{})
+			setDefault(subgraph, "nodes", map[string]any{})
+			for _, rawNode := range subgraph["nodes"].(map[string]any) {
+				node, ok := rawNode.(map[string]any)
+				if !ok {
+					return errors.New("node is not an object")
+				}
+				setDefault(node, "children", []any{})
+				setDefault(node, "action_outputs", []any{})
+				setDefault(node, "metadata", map[string]any{})
+				setDefault(node, "model_reference", map[string]any{"model_name": "", "model_adapter": ""})
+			}
+		}
+	}
+	return nil
+}
+
+// migrateGraphJSON upgrades data to CurrentGraphSchemaVersion. Returns the version data was at.
+func migrateGraphJSON(data []byte) ([]byte, int, error) {
+	var graph map[string]any
+	if err := json.Unmarshal(data, &graph); err != nil {
+		return nil, 0, err
+	}
+	version := 0
+	if rawVersion, ok := graph["schema_version"]; ok {
+		floatVersion, ok := rawVersion.(float64)
+		if !ok {
+			return nil, 0, fmt.Errorf("invalid schema_version %v", rawVersion)
+		}
+		version = int(floatVersion)
+	}
+	if version > CurrentGraphSchemaVersion {
+		return nil, version, fmt.Errorf("graph schema version %d is newer than this orchestrator supports (%d)", version, CurrentGraphSchemaVersion)
+	}
+	if version == CurrentGraphSchemaVersion {
+		return data, version, nil
+	}
+	for v := version; v < CurrentGraphSchemaVersion; v++ {
+		if err := graphMigrations[v].Migrate(graph); err != nil {
+			return nil, version, fmt.Errorf("migrating graph from schema version %d: %w", v, err)
+		}
+		graph["schema_version"] = v + 1
+	}
+	migrated, err := json.Marshal(graph)
+	if err != nil {
+		return nil, version, err
+	}
+	return migrated, version, nil
+}
+
+func createGraphMigrateCli() *cli.Command {
+	action := func(ctx context.Context, cmd *cli.Command) error {
+		logger := zerolog.Ctx(ctx)
+		paths := cmd.Args().Slice()
+		if len(paths) == 0 {
+			return errors.New("no graph files given")
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			_, version, err := migrateGraphJSON(data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if version == CurrentGraphSchemaVersion {
+				logger.Info().Msgf("%s is already at schema version %d", path, version)
+				continue
+			}
+			backupPath := fmt.Sprintf("%s.v%d-%s.bak", path, version, time.Now().UTC().Format(graphSnapshotTimeFormat))
+			if err := CopyFile(path, backupPath); err != nil {
+				return err
+			}
+			rg := &RepoGraph{}
+			if err := rg.LoadFromFile(path); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if err := rg.SaveToFile(path); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			logger.Info().Msgf("migrated %s from schema version %d to %d (backup at %s)", path, version, CurrentGraphSchemaVersion, backupPath)
+		}
+		return nil
+	}
+	return &cli.Command{
+		Name:      "migrate",
+		Usage:     "upgrade graph files to the current schema version in place (after backing them up)",
+		ArgsUsage: "<graph.json>...",
+		Action:    action,
+	}
+}
@@ -0,0 +1,135 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Every save of a graph is also kept (as a hard link when possible) in {graph}.snapshots/.
+// LoadFromFile falls back to the newest of these if the graph file is unreadable.
+const NumGraphSnapshotsToKeep = 5
+
+// sorts lexically in time order
+const graphSnapshotTimeFormat = "20060102T150405.000000000Z"
+
+func graphSnapshotDir(graphPath string) string {
+	return graphPath + ".snapshots"
+}
+
+// writeFileAtomic writes data to a temp file next to path, fsyncs it and renames it over path.
+// A crash leaves either the old file or the new one, never a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// make the rename itself durable
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
+
+// saveGraphSnapshot keeps a timestamped copy of the (just written) graph at path and prunes old copies.
+func saveGraphSnapshot(path string, data []byte) error {
+	dir := graphSnapshotDir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	snapshotPath := filepath.Join(dir, fmt.Sprintf("graph-%s.json", time.Now().UTC().Format(graphSnapshotTimeFormat)))
+	// the graph file is never written in place (see writeFileAtomic), so a link is as good as a copy
+	if err := os.Link(path, snapshotPath); err != nil {
+		if err := writeFileAtomic(snapshotPath, data); err != nil {
+			return err
+		}
+	}
+	snapshots, err := graphSnapshots(path)
+	if err != nil {
+		return err
+	}
+	for len(snapshots) > NumGraphSnapshotsToKeep {
+		if err := os.Remove(snapshots[len(snapshots)-1]); err != nil {
+			return err
+		}
+		snapshots = snapshots[:len(snapshots)-1]
+	}
+	return nil
+}
+
+// graphSnapshots returns the snapshots of the graph at path, newest first.
+func graphSnapshots(path string) ([]string, error) {
+	entries, err := os.ReadDir(graphSnapshotDir(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), "graph-") || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		snapshots = append(snapshots, filepath.Join(graphSnapshotDir(path), entry.Name()))
+	}
+	slices.Sort(snapshots)
+	slices.Reverse(snapshots)
+	return snapshots, nil
+}
+
+func (rg *RepoGraph) loadSnapshot(path string) error {
+	str, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	str, _, err = migrateGraphJSON(str)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(str, rg)
+}
+
+// loadNewestGraphSnapshot loads the newest snapshot of the graph at path that parses.
+func (rg *RepoGraph) loadNewestGraphSnapshot(path string) (string, error) {
+	snapshots, err := graphSnapshots(path)
+	if err != nil {
+		return "", err
+	}
+	for _, snapshot := range snapshots {
+		*rg = RepoGraph{}
+		if err := rg.loadSnapshot(snapshot); err != nil {
+			log.Default().Printf("Skipping unreadable graph snapshot %s: %v\n", snapshot, err)
+			continue
+		}
+		return snapshot, nil
+	}
+	return "", errors.New("no readable snapshot")
+}
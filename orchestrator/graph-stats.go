@@ -0,0 +1,340 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// GraphStats summarizes a run. See RepoGraph.Stats.
+type GraphStats struct {
+	Goals          []GoalStats     `json:"goals"`
+	ResultsByDepth []DepthStats    `json:"results_by_depth"`
+	ResultsByModel []ModelStats    `json:"results_by_model"`
+	BranchTargets  BranchTreeStats `json:"branch_targets"`
+	// mean (over successful commit graphs) of the depth of the shallowest successful node
+	MeanStepsToSuccess float64              `json:"mean_steps_to_success"`
+	SyntaxFailures     []SyntaxFailureStats `json:"syntax_failures"`
+}
+
+// counts of commit graphs by outcome, over every branch target the goal was attempted on
+type GoalStats struct {
+	GoalID      GoalID `json:"goal_id"`
+	Name        string `json:"name"`
+	Success     int    `json:"success"`
+	Failed      int    `json:"failed"`
+	SetupFailed int    `json:"setup_failed"`
+	Unfinished  int    `json:"unfinished"`
+}
+
+type DepthStats struct {
+	Depth   int                `json:"depth"`
+	Results map[NodeResult]int `json:"results"`
+}
+
+// Only counts finished, non-root nodes (root nodes aren't generated by a model)
+type ModelStats struct {
+	ModelReference ModelReference     `json:"model_reference"`
+	Results        map[NodeResult]int `json:"results"`
+	SuccessRate    float64            `json:"success_rate"`
+}
+
+type BranchTreeStats struct {
+	Count    int `json:"count"`
+	MaxDepth int `json:"max_depth"`
+	// over branch targets that have been explored from (at least one child)
+	MeanFanOut float64 `json:"mean_fan_out"`
+	MaxFanOut  int     `json:"max_fan_out"`
+}
+
+// finished, non-root nodes created in [Start, Start+bucket)
+type SyntaxFailureStats struct {
+	Start          time.Time `json:"start"`
+	Nodes          int       `json:"nodes"`
+	SyntaxFailures int       `json:"syntax_failures"`
+	Rate           float64   `json:"rate"`
+}
+
+// Stats computes GraphStats. goalProvider is only used for goal names (& may not know every goal).
+// Syntax failures are bucketed by node creation time into buckets of the given size.
+func (rg *RepoGraph) Stats(goalProvider GoalProvider, bucket time.Duration) *GraphStats {
+	stats := &GraphStats{}
+	goals := map[GoalID]*GoalStats{}
+	byDepth := map[int]*DepthStats{}
+	byModel := map[ModelReference]*ModelStats{}
+	syntaxFailures := map[time.Time]*SyntaxFailureStats{}
+	successfulGraphs := 0
+	stepsToSuccess := 0
+
+	for _, branchTarget := range rg.BranchTargets {
+		for goalID, cg := range branchTarget.Subgraphs {
+			goal, ok := goals[goalID]
+			if !ok {
+				goal = &GoalStats{GoalID: goalID}
+				if goalI := goalProvider.GetGoal(goalID); goalI != nil {
+					goal.Name = goalI.Name()
+				}
+				goals[goalID] = goal
+			}
+			switch cg.State {
+			case GraphStateSuccess:
+				goal.Success++
+			case GraphStateFailed:
+				goal.Failed++
+			case GraphStateGoalSetupFailed:
+				goal.SetupFailed++
+			default:
+				goal.Unfinished++
+			}
+
+			shallowestSuccess := -1
+			for _, node := range cg.Nodes {
+				depth, ok := byDepth[node.Depth]
+				if !ok {
+					depth = &DepthStats{Depth: node.Depth, Results: map[NodeResult]int{}}
+					byDepth[node.Depth] = depth
+				}
+				depth.Results[node.Result]++
+				if node.Result == NodeResultSuccess && (shallowestSuccess == -1 || node.Depth < shallowestSuccess) {
+					shallowestSuccess = node.Depth
+				}
+
+				if node.Parent == nil || node.State != NodeStateDone {
+					continue
+				}
+				model, ok := byModel[node.ModelReference]
+				if !ok {
+					model = &ModelStats{ModelReference: node.ModelReference, Results: map[NodeResult]int{}}
+					byModel[node.ModelReference] = model
+				}
+				model.Results[node.Result]++
+				if node.CreatedAt.IsZero() {
+					continue
+				}
+				start := node.CreatedAt.UTC().Truncate(bucket)
+				syntax, ok := syntaxFailures[start]
+				if !ok {
+					syntax = &SyntaxFailureStats{Start: start}
+					syntaxFailures[start] = syntax
+				}
+				syntax.Nodes++
+				if node.Result == NodeResultSyntaxFailure {
+					syntax.SyntaxFailures++
+				}
+			}
+			if cg.State == GraphStateSuccess && shallowestSuccess != -1 {
+				successfulGraphs++
+				stepsToSuccess += shallowestSuccess
+			}
+		}
+	}
+
+	stats.Goals = []GoalStats{}
+	for _, goal := range goals {
+		stats.Goals = append(stats.Goals, *goal)
+	}
+	slices.SortFunc(stats.Goals, func(a, b GoalStats) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(string(a.GoalID), string(b.GoalID))
+	})
+	stats.ResultsByDepth = []DepthStats{}
+	for _, depth := range slices.Sorted(maps.Keys(byDepth)) {
+		stats.ResultsByDepth = append(stats.ResultsByDepth, *byDepth[depth])
+	}
+	stats.ResultsByModel = []ModelStats{}
+	for _, model := range byModel {
+		total := 0
+		for _, count := range model.Results {
+			total += count
+		}
+		model.SuccessRate = float64(model.Results[NodeResultSuccess]) / float64(total)
+		stats.ResultsByModel = append(stats.ResultsByModel, *model)
+	}
+	slices.SortFunc(stats.ResultsByModel, func(a, b ModelStats) int {
+		if c := strings.Compare(a.ModelReference.ModelName, b.ModelReference.ModelName); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ModelReference.Adapter, b.ModelReference.Adapter)
+	})
+	stats.SyntaxFailures = []SyntaxFailureStats{}
+	for _, start := range slices.SortedFunc(maps.Keys(syntaxFailures), time.Time.Compare) {
+		syntax := syntaxFailures[start]
+		syntax.Rate = float64(syntax.SyntaxFailures) / float64(syntax.Nodes)
+		stats.SyntaxFailures = append(stats.SyntaxFailures, *syntax)
+	}
+	if successfulGraphs > 0 {
+		stats.MeanStepsToSuccess = float64(stepsToSuccess) / float64(successfulGraphs)
+	}
+	stats.BranchTargets = rg.branchTreeStats()
+	return stats
+}
+
+func (rg *RepoGraph) branchTreeStats() BranchTreeStats {
+	stats := BranchTreeStats{Count: len(rg.BranchTargets)}
+	fanOut := map[BranchName]int{}
+	for _, branchTarget := range rg.BranchTargets {
+		if branchTarget.ParentBranchName != nil {
+			fanOut[*branchTarget.ParentBranchName]++
+		}
+		depth := 0
+		// bounded in case of a (corrupt) cycle
+		for parent := branchTarget.ParentBranchName; parent != nil && depth < len(rg.BranchTargets); depth++ {
+			parentTarget, ok := rg.BranchTargets[*parent]
+			if !ok {
+				break
+			}
+			parent = parentTarget.ParentBranchName
+		}
+		stats.MaxDepth = max(stats.MaxDepth, depth)
+	}
+	for _, children := range fanOut {
+		stats.MeanFanOut += float64(children)
+		stats.MaxFanOut = max(stats.MaxFanOut, children)
+	}
+	if len(fanOut) > 0 {
+		stats.MeanFanOut /= float64(len(fanOut))
+	}
+	return stats
+}
+
+func shortNodeResult(result NodeResult) string {
+	return strings.TrimPrefix(string(result), "node_result_")
+}
+
+// resultColumns returns every result in counts (in a stable order) for use as table columns.
+func resultColumns(counts ...map[NodeResult]int) []NodeResult {
+	columns := map[NodeResult]bool{}
+	for _, count := range counts {
+		for result := range count {
+			columns[result] = true
+		}
+	}
+	return slices.Sorted(maps.Keys(columns))
+}
+
+func (stats *GraphStats) WriteTable(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "GOAL\tID\tSUCCESS\tFAILED\tSETUP FAILED\tUNFINISHED")
+	for _, goal := range stats.Goals {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", goal.Name, goal.GoalID, goal.Success, goal.Failed, goal.SetupFailed, goal.Unfinished)
+	}
+	fmt.Fprintln(w)
+
+	depthResults := []map[NodeResult]int{}
+	for _, depth := range stats.ResultsByDepth {
+		depthResults = append(depthResults, depth.Results)
+	}
+	columns := resultColumns(depthResults...)
+	fmt.Fprint(w, "DEPTH")
+	for _, column := range columns {
+		fmt.Fprintf(w, "\t%s", strings.ToUpper(shortNodeResult(column)))
+	}
+	fmt.Fprintln(w)
+	for _, depth := range stats.ResultsByDepth {
+		fmt.Fprintf(w, "%d", depth.Depth)
+		for _, column := range columns {
+			fmt.Fprintf(w, "\t%d", depth.Results[column])
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w)
+
+	modelResults := []map[NodeResult]int{}
+	for _, model := range stats.ResultsByModel {
+		modelResults = append(modelResults, model.Results)
+	}
+	columns = resultColumns(modelResults...)
+	fmt.Fprint(w, "MODEL\tADAPTER\tSUCCESS RATE")
+	for _, column := range columns {
+		fmt.Fprintf(w, "\t%s", strings.ToUpper(shortNodeResult(column)))
+	}
+	fmt.Fprintln(w)
+	for _, model := range stats.ResultsByModel {
+		fmt.Fprintf(w, "%s\t%s\t%.3f", model.ModelReference.ModelName, model.ModelReference.Adapter, model.SuccessRate)
+		for _, column := range columns {
+			fmt.Fprintf(w, "\t%d", model.Results[column])
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "BUCKET START\tNODES\tSYNTAX FAILURES\tRATE")
+	for _, syntax := range stats.SyntaxFailures {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.3f\n", syntax.Start.Format(time.RFC3339), syntax.Nodes, syntax.SyntaxFailures, syntax.Rate)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "mean steps to success:\t%.2f\n", stats.MeanStepsToSuccess)
+	fmt.Fprintf(w, "branch targets:\t%d\n", stats.BranchTargets.Count)
+	fmt.Fprintf(w, "branch target tree depth:\t%d\n", stats.BranchTargets.MaxDepth)
+	fmt.Fprintf(w, "branch target fan-out:\tmean %.2f, max %d\n", stats.BranchTargets.MeanFanOut, stats.BranchTargets.MaxFanOut)
+	return w.Flush()
+}
+
+func createGraphStatsCli() *cli.Command {
+	goalFile := ""
+	format := ""
+	bucket := time.Duration(0)
+	action := func(ctx context.Context, cmd *cli.Command) error {
+		path := cmd.Args().First()
+		if path == "" {
+			return errors.New("no graph file given")
+		}
+		if bucket <= 0 {
+			return fmt.Errorf("invalid bucket size %s", bucket)
+		}
+		rg := &RepoGraph{}
+		if err := rg.LoadFromFile(path); err != nil {
+			return err
+		}
+		stats := rg.Stats(StaticGoalProviderFromFile(goalFile), bucket)
+		switch format {
+		case "table":
+			return stats.WriteTable(os.Stdout)
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(stats)
+		default:
+			return fmt.Errorf("unknown format %q (expected table or json)", format)
+		}
+	}
+	return &cli.Command{
+		Name:      "stats",
+		Usage:     "report how a run is going",
+		ArgsUsage: "<graph.json>",
+		Action:    action,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "goal",
+				Usage:       "path to goal file (for goal names)",
+				Destination: &goalFile,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "format",
+				Usage:       "table or json",
+				Value:       "table",
+				Destination: &format,
+			},
+			&cli.DurationFlag{
+				Name:        "bucket",
+				Usage:       "size of the time buckets for the syntax failure rate",
+				Value:       time.Hour,
+				Destination: &bucket,
+			},
+		},
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"log"
 	"math"
-	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -90,6 +90,8 @@ const (
 	NodeResultTerminated NodeResult = "node_result_terminated"
 	// was aborted by the model
 	NodeResultAborted NodeResult = "node_result_aborted"
+	// the engine gave up on the node's task (workers kept crashing or timing out). Not the model's fault.
+	NodeResultInfrastructureFailure NodeResult = "node_result_infrastructure_failure"
 )
 
 type GraphState string
@@ -105,11 +107,19 @@ const (
 )
 
 type RepoGraph struct {
+	// See CurrentGraphSchemaVersion. Files from before this field existed are version 0.
+	SchemaVersion       int                                   `json:"schema_version"`
 	ID                  RepoGraphID                           `json:"id"`
 	BranchTargets       map[BranchName]*RepoGraphBranchTarget `json:"branch_targets"`
 	ShouldAdvertiseChan chan CommitGraphLocator               `json:"-"`
 	// TODO: This should be passed through via func params.
 	Ctx context.Context `json:"-"`
+	// Seq of the last GraphEvent applied to this graph. See OpenEventLog.
+	EventSeq uint64 `json:"event_seq,omitempty"`
+	// graphs this one was built from by MergeRepoGraphs
+	MergedFrom []string `json:"merged_from,omitempty"`
+	// nil unless OpenEventLog was called
+	eventLog *GraphEventLog
 }
 
 type RepoGraphBranchTarget struct {
@@ -120,6 +130,8 @@ type RepoGraphBranchTarget struct {
 	// Goal that was used to create this branch target (nil if this is the root)
 	TraversalGoalID *GoalID                 `json:"traversal_goal_id,omitempty"`
 	Subgraphs       map[GoalID]*CommitGraph `json:"subgraphs"`
+	// set by MergeRepoGraphs: the graph this branch target was taken from
+	Source string `json:"source,omitempty"`
 }
 
 // See comment in BuildCompilationTasksForNode about git-commit
@@ -149,6 +161,8 @@ type CommitGraph struct {
 	State    GraphState                  `json:"state"`
 
 	Results []*CGResult `json:"results"`
+	// set by MergeRepoGraphs: the graph this commit graph was taken from
+	Source string `json:"source,omitempty"`
 }
 
 type CommitGraphNode struct {
@@ -171,6 +185,9 @@ type CommitGraphNode struct {
 	ActionOutputs []ActionOutput `json:"action_outputs"`
 	// The results of the compilation
 	CompilationResult *CompilationResult `json:"compilation_result"`
+	// Set (& InferenceOutput, ActionOutputs & CompilationResult cleared) once the node is moved into the GraphArchive.
+	// See RepoGraph.Compact.
+	ArchivedPayload string `json:"archived_payload,omitempty"`
 	// apply(parse(inference_output) @ parent.branch_name) is written to branch_name
 	// (unless this is the root, in which case, it is:
 	// apply(goals[goal_id].GoalStatement @ branch_target.branch_name))
@@ -219,7 +236,8 @@ func NewCommitGraph(goalID GoalID) *CommitGraph {
 
 func NewRepoGraph(rootBranchName BranchName) *RepoGraph {
 	rg := &RepoGraph{
-		ID: NewRepoGraphID(),
+		SchemaVersion: CurrentGraphSchemaVersion,
+		ID:            NewRepoGraphID(),
 		BranchTargets: map[BranchName]*RepoGraphBranchTarget{
 			rootBranchName: {
 				CreatedAt:        time.Now(),
@@ -235,21 +253,127 @@ func NewRepoGraph(rootBranchName BranchName) *RepoGraph {
 }
 
 func (rg *RepoGraph) SaveToFile(path string) error {
-	json, err := json.Marshal(rg)
+	write, err := rg.PrepareSave(path)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, json, 0644)
+	return write()
 }
 
+// PrepareSave copies the graph and returns a func that serializes the copy & writes it to path.
+// Only PrepareSave has to be called with the graph locked, so large graphs don't block mutations while they are
+// serialized & written (copying only touches pointers, never the node payloads).
+// If the event log is open for path, it is rotated here & the rotated log is dropped once the snapshot is written.
+// Otherwise, the snapshot replaces any events logged at path.
+func (rg *RepoGraph) PrepareSave(path string) (func() error, error) {
+	rg.SchemaVersion = CurrentGraphSchemaVersion
+	snapshot := rg.cloneForSave()
+	seq := rg.EventSeq
+	eventLog := rg.eventLog
+	if eventLog != nil && eventLog.graphPath == path {
+		if err := eventLog.rotate(seq); err != nil {
+			return nil, err
+		}
+	} else {
+		eventLog = nil
+	}
+	return func() error {
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			return err
+		}
+		if err := saveGraphSnapshot(path, data); err != nil {
+			// the graph itself is saved. Not worth failing over.
+			log.Default().Printf("Error saving snapshot of %s: %v\n", path, err)
+		}
+		if eventLog != nil {
+			return eventLog.dropRotated(seq)
+		}
+		// any events left at path belong to whatever graph used to be there
+		return removeGraphEventLogs(path)
+	}, nil
+}
+
+// cloneForSave deep copies everything that is serialized, so the copy can be marshalled without the graph's lock.
+// Strings are shared (they are immutable).
+func (rg *RepoGraph) cloneForSave() *RepoGraph {
+	clone := &RepoGraph{
+		SchemaVersion: rg.SchemaVersion,
+		ID:            rg.ID,
+		BranchTargets: make(map[BranchName]*RepoGraphBranchTarget, len(rg.BranchTargets)),
+		EventSeq:      rg.EventSeq,
+		MergedFrom:    slices.Clone(rg.MergedFrom),
+	}
+	for name, bt := range rg.BranchTargets {
+		btCopy := *bt
+		if bt.ParentBranchName != nil {
+			parent := *bt.ParentBranchName
+			btCopy.ParentBranchName = &parent
+		}
+		if bt.TraversalGoalID != nil {
+			goalID := *bt.TraversalGoalID
+			btCopy.TraversalGoalID = &goalID
+		}
+		btCopy.Subgraphs = make(map[GoalID]*CommitGraph, len(bt.Subgraphs))
+		for goalID, cg := range bt.Subgraphs {
+			btCopy.Subgraphs[goalID] = cg.cloneForSave()
+		}
+		clone.BranchTargets[name] = &btCopy
+	}
+	return clone
+}
+
+func (cg *CommitGraph) cloneForSave() *CommitGraph {
+	cgCopy := *cg
+	cgCopy.Nodes = make(map[NodeID]*CommitGraphNode, len(cg.Nodes))
+	for id, node := range cg.Nodes {
+		nodeCopy := *node
+		if node.Parent != nil {
+			parent := *node.Parent
+			nodeCopy.Parent = &parent
+		}
+		nodeCopy.Children = slices.Clone(node.Children)
+		nodeCopy.ActionOutputs = slices.Clone(node.ActionOutputs)
+		if node.CompilationResult != nil {
+			result := *node.CompilationResult
+			nodeCopy.CompilationResult = &result
+		}
+		cgCopy.Nodes[id] = &nodeCopy
+	}
+	if cg.Results != nil {
+		cgCopy.Results = make([]*CGResult, len(cg.Results))
+		for i, result := range cg.Results {
+			resultCopy := *result
+			resultCopy.GeneratingNodes = slices.Clone(result.GeneratingNodes)
+			cgCopy.Results[i] = &resultCopy
+		}
+	}
+	return &cgCopy
+}
+
+// LoadFromFile loads the snapshot at path and replays any events logged since it was taken.
+// If path can't be read, the newest readable snapshot in {path}.snapshots/ is loaded instead
+// (along with as much of the event log as still applies to it). If none of it applies, the event logs are moved aside.
 func (rg *RepoGraph) LoadFromFile(path string) error {
-	str, err := os.ReadFile(path)
-	if err != nil {
-		return err
+	err := rg.loadSnapshot(path)
+	if err == nil {
+		return rg.replayEventLogs(path)
 	}
-	err = json.Unmarshal(str, rg)
-	if err != nil {
-		return err
+	snapshot, snapshotErr := rg.loadNewestGraphSnapshot(path)
+	if snapshotErr != nil {
+		return fmt.Errorf("%w (and no snapshot to fall back to: %v)", err, snapshotErr)
+	}
+	log.Default().Printf("Graph %s is unreadable (%v). Falling back to snapshot %s\n", path, err, snapshot)
+	if replayErr := rg.replayEventLogs(path); replayErr != nil {
+		log.Default().Printf("Could not replay events onto snapshot %s (%v). Using it as is\n", snapshot, replayErr)
+		*rg = RepoGraph{}
+		if err := rg.loadSnapshot(snapshot); err != nil {
+			return err
+		}
+		return moveGraphEventLogsAside(path)
 	}
 	return nil
 }
@@ -259,6 +383,7 @@ func (rg *RepoGraph) ResetTransientStates() {
 			for _, node := range subgraph.Nodes {
 				if _, ok := TransientNodeStateResetMap[node.State]; ok {
 					node.State = TransientNodeStateResetMap[node.State]
+					rg.recordNodeState(NodeSlice{BranchTarget: branchTarget, CommitGraph: subgraph, CommitGraphNode: node})
 				}
 			}
 		}
@@ -276,6 +401,7 @@ func (rg *RepoGraph) CreateBranchTargetFromNode(slice NodeSlice, gitCommitDiffPa
 		if gitCommitDiffPatch == result.DiffPatch {
 			// this is a duplicate
 			result.GeneratingNodes = append(result.GeneratingNodes, slice.CommitGraphNode.ID)
+			rg.recordCommitGraphResults(slice.AsCommitGraphSlice())
 			return
 		}
 	}
@@ -285,6 +411,7 @@ func (rg *RepoGraph) CreateBranchTargetFromNode(slice NodeSlice, gitCommitDiffPa
 		DiffPatch:       gitCommitDiffPatch,
 		GeneratingNodes: []NodeID{slice.CommitGraphNode.ID},
 	})
+	rg.recordCommitGraphResults(slice.AsCommitGraphSlice())
 
 	rg.BranchTargets[newBranchName] = &RepoGraphBranchTarget{
 		CreatedAt:        time.Now(),
@@ -293,6 +420,7 @@ func (rg *RepoGraph) CreateBranchTargetFromNode(slice NodeSlice, gitCommitDiffPa
 		TraversalGoalID:  &traversalGoalID,
 		Subgraphs:        map[GoalID]*CommitGraph{},
 	}
+	rg.recordBranchTargetCreated(rg.BranchTargets[newBranchName])
 }
 
 func (rg *RepoGraph) HandleSetupCompilationOutput(logger *zerolog.Logger, locator NodeLocator, result *CompilationTaskResponse, goalProvider GoalProvider) error {
@@ -312,6 +440,7 @@ func (rg *RepoGraph) HandleSetupCompilationOutput(logger *zerolog.Logger, locato
 	if !ok {
 		logger.Error().Msgf("goal setup failed for %s on branch %s to branch %s", slice.CommitGraph.GoalID, slice.BranchTarget.BranchName, slice.CommitGraphNode.BranchName)
 		slice.CommitGraph.State = GraphStateGoalSetupFailed
+		rg.recordCommitGraphState(slice.AsCommitGraphSlice())
 		return nil
 	}
 
@@ -324,8 +453,10 @@ func (rg *RepoGraph) HandleSetupCompilationOutput(logger *zerolog.Logger, locato
 	}
 	// goal compilation result is expected to be fed into the root node
 	slice.CommitGraphNode.CompilationResult = &result.CompilationResult
+	rg.recordNodeOutputs(slice)
 	slice.CommitGraphNode.State = NodeStateAwaitingInference
 	slice.CommitGraphNode.Result = NodeResultNone
+	rg.recordNodeState(slice)
 	rg.tickUpdateCommitGraph(slice.AsCommitGraphSlice())
 	return nil
 }
@@ -348,6 +479,7 @@ func (rg *RepoGraph) HandleInferenceOutput(locator NodeLocator, result *Inferenc
 	node.State = NodeStateDone
 	// if we have children, we are (by definition) non-terminal
 	node.Result = NodeResultNone
+	rg.recordNodeState(slice)
 	for _, seq := range result.ReturnSequences {
 		if _, err := rg.AddNodeToCommitGraph(locator, seq, NodeMetadata{}); err != nil {
 			return err
@@ -389,6 +521,7 @@ func (rg *RepoGraph) AddNodeToCommitGraph(parentLocator NodeLocator, inferenceOu
 	}
 	parentSlice.CommitGraph.Nodes[newNode.ID] = newNode
 	parentNode.Children = append(parentNode.Children, newNode.ID)
+	rg.recordNodeAdded(NodeSlice{BranchTarget: parentSlice.BranchTarget, CommitGraph: parentSlice.CommitGraph, CommitGraphNode: newNode})
 	rg.tickUpdateCommitGraph(parentSlice.AsCommitGraphSlice())
 	return NodeLocatorFromTriplet(parentSlice.BranchTarget.BranchName, parentSlice.CommitGraph.GoalID, newNode.ID), nil
 }
@@ -425,6 +558,7 @@ func (rg *RepoGraph) HandleCompilationOutput(locator NodeLocator, result *Compil
 		}
 	}
 	node.CompilationResult = &result.CompilationResult
+	rg.recordNodeOutputs(slice)
 
 	if didAbort {
 		node.State = NodeStateDone
@@ -454,51 +588,85 @@ func (rg *RepoGraph) HandleCompilationOutput(locator NodeLocator, result *Compil
 			node.Result = NodeResultContextExhaustionFailure
 		}
 	}
+	rg.recordNodeState(slice)
 
 	rg.tickUpdateCommitGraph(slice.AsCommitGraphSlice())
 
 	return nil
 }
 
+// HandleInfrastructureFailure marks a running node as done when the engine gave up on its task.
+func (rg *RepoGraph) HandleInfrastructureFailure(locator NodeLocator) error {
+	slice, err := rg.GetNodeSlice(locator)
+	if err != nil {
+		return err
+	}
+	node := slice.CommitGraphNode
+	if node.State == NodeStateDone && node.Result == NodeResultTerminated {
+		return nil
+	}
+	if _, ok := TransientNodeStateResetMap[node.State]; !ok {
+		return fmt.Errorf("node %v is not in a running state", locator)
+	}
+	wasGoalSetup := node.State == NodeStateRunningGoalSetup
+	node.State = NodeStateDone
+	node.Result = NodeResultInfrastructureFailure
+	rg.recordNodeState(slice)
+	if wasGoalSetup {
+		// same as a failed goal setup. Don't tick or the graph will look like a normal failure.
+		slice.CommitGraph.State = GraphStateGoalSetupFailed
+		rg.recordCommitGraphState(slice.AsCommitGraphSlice())
+		return nil
+	}
+	rg.tickUpdateCommitGraph(slice.AsCommitGraphSlice())
+	return nil
+}
+
 // internal
 func (rg *RepoGraph) tickUpdateCommitGraph(slice CommitGraphSlice) {
+	previousState := slice.CommitGraph.State
+	defer func() {
+		if slice.CommitGraph.State != previousState {
+			rg.recordCommitGraphState(slice)
+		}
+	}()
+	state, ok := slice.CommitGraph.computedState()
+	if !ok {
+		panic(fmt.Sprintf("root node %v not found", slice.CommitGraph.RootNode))
+	}
+	slice.CommitGraph.State = state
+	if state == GraphStateSuccess && rg.ShouldAdvertiseChan != nil {
+		select {
+		case rg.ShouldAdvertiseChan <- CommitGraphLocator{
+			BranchTargetLocator: BranchTargetLocator{BranchName: slice.BranchTarget.BranchName},
+			GoalID:              slice.CommitGraph.GoalID,
+		}:
+		case <-rg.Ctx.Done():
+			return
+		}
+	}
+}
+
+// computedState is the state the graph should be in given its nodes. false if the root node is missing.
+// GraphStateGoalSetupFailed is never computed; it is set directly when goal setup fails.
+func (cg *CommitGraph) computedState() (GraphState, bool) {
 	// If all nodes are done, we can determine if the graph is successful
-	if len(slice.CommitGraph.Nodes) == len(slice.CommitGraph.AllNodesInState(NodeStateDone)) {
-		hasSuccess := false
-		for _, node := range slice.CommitGraph.Nodes {
+	if len(cg.Nodes) == len(cg.AllNodesInState(NodeStateDone)) {
+		for _, node := range cg.Nodes {
 			if node.Result == NodeResultSuccess {
-				hasSuccess = true
+				return GraphStateSuccess, true
 			}
 		}
-		if hasSuccess {
-			slice.CommitGraph.State = GraphStateSuccess
-
-			if rg.ShouldAdvertiseChan != nil {
-				select {
-				case rg.ShouldAdvertiseChan <- CommitGraphLocator{
-					BranchTargetLocator: BranchTargetLocator{BranchName: slice.BranchTarget.BranchName},
-					GoalID:              slice.CommitGraph.GoalID,
-				}:
-				case <-rg.Ctx.Done():
-					return
-				}
-			}
-		} else {
-			slice.CommitGraph.State = GraphStateFailed
-		}
-	} else {
-		rootNode, ok := slice.CommitGraph.Nodes[slice.CommitGraph.RootNode]
-		if !ok {
-			panic(fmt.Sprintf("root node %v not found", slice.CommitGraph.RootNode))
-		}
-		rootStage := NodeStageFromState(rootNode.State)
-		if rootStage == NodeStageGoalSetup {
-			slice.CommitGraph.State = GraphStateAwaitingGoalSetup
-		} else {
-			slice.CommitGraph.State = GraphStateInProgress
-		}
+		return GraphStateFailed, true
 	}
-
+	rootNode, ok := cg.Nodes[cg.RootNode]
+	if !ok {
+		return "", false
+	}
+	if NodeStageFromState(rootNode.State) == NodeStageGoalSetup {
+		return GraphStateAwaitingGoalSetup, true
+	}
+	return GraphStateInProgress, true
 }
 
 func (rg *RepoGraph) UnfinishedGraphs() []CommitGraphLocator {
@@ -532,6 +700,7 @@ func (rg *RepoGraph) RequestNodeTerminationRecursively(nodeLocator NodeLocator,
 		node.State = NodeStateDone
 		node.Result = NodeResultTerminated
 	}
+	rg.recordNodeState(NodeSlice{BranchTarget: slice.BranchTarget, CommitGraph: slice.CommitGraph, CommitGraphNode: node})
 	for _, child := range node.Children {
 		if err := rg.RequestNodeTerminationRecursively(NodeLocator{
 			CommitGraphLocator: nodeLocator.CommitGraphLocator,
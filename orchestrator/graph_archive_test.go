@@ -0,0 +1,91 @@
+package orchestrator
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphArchive_CompactsFailedCommitGraphs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graph.json")
+	rg := NewRepoGraph(BranchName("test"))
+	rg.Ctx = context.Background()
+	bt := rg.BranchTargets[BranchName("test")]
+	failed := NewCommitGraph(GoalID("failed_goal"))
+	bt.Subgraphs[failed.GoalID] = failed
+	live := NewCommitGraph(GoalID("live_goal"))
+	bt.Subgraphs[live.GoalID] = live
+	for _, cg := range []*CommitGraph{failed, live} {
+		root := cg.Nodes[cg.RootNode]
+		root.ActionOutputs = []ActionOutput{{ActionName: "git-status", Text: "clean"}}
+		root.CompilationResult = &CompilationResult{Out: "lots of compiler output"}
+	}
+	failed.State = GraphStateFailed
+	require.NoError(t, rg.SaveToFile(path))
+	require.NoError(t, rg.OpenEventLog(path))
+	t.Cleanup(func() { rg.CloseEventLog() })
+	uncompacted := &RepoGraph{}
+	require.NoError(t, uncompacted.LoadFromFile(path))
+
+	archive := NewGraphArchive(path)
+	archived, err := rg.Compact(archive)
+	require.NoError(t, err)
+	require.Equal(t, 1, archived)
+	root := failed.Nodes[failed.RootNode]
+	require.NotEmpty(t, root.ArchivedPayload)
+	require.Nil(t, root.CompilationResult)
+	require.Empty(t, root.ActionOutputs)
+	require.NotNil(t, live.Nodes[live.RootNode].CompilationResult)
+	archived, err = rg.Compact(archive)
+	require.NoError(t, err)
+	require.Zero(t, archived)
+
+	// compaction is in the event log
+	loaded := &RepoGraph{}
+	require.NoError(t, loaded.LoadFromFile(path))
+	requireSameGraph(t, rg, loaded)
+
+	// reads see the payloads, but the graph itself stays compacted
+	hydrated, err := rg.HydratedCommitGraph(CommitGraphLocator{BranchTargetLocator: BranchTargetLocator{BranchName: bt.BranchName}, GoalID: failed.GoalID}, archive)
+	require.NoError(t, err)
+	hydratedRoot := hydrated.BranchTargets[bt.BranchName].Subgraphs[failed.GoalID].Nodes[failed.RootNode]
+	require.Equal(t, "lots of compiler output", hydratedRoot.CompilationResult.Out)
+	require.Nil(t, root.CompilationResult)
+
+	require.NoError(t, rg.RestoreArchivedCommitGraph(CommitGraphSlice{BranchTarget: bt, CommitGraph: failed}, archive))
+	require.Empty(t, root.ArchivedPayload)
+	uncompacted.EventSeq = rg.EventSeq
+	requireSameGraph(t, uncompacted, rg)
+	loaded = &RepoGraph{}
+	require.NoError(t, loaded.LoadFromFile(path))
+	requireSameGraph(t, rg, loaded)
+}
+
+func TestGraphArchive_CompactionSkipsChangedNodes(t *testing.T) {
+	rg := NewRepoGraph(BranchName("test"))
+	bt := rg.BranchTargets[BranchName("test")]
+	revived := NewCommitGraph(GoalID("revived_goal"))
+	bt.Subgraphs[revived.GoalID] = revived
+	rewritten := NewCommitGraph(GoalID("rewritten_goal"))
+	bt.Subgraphs[rewritten.GoalID] = rewritten
+	untouched := NewCommitGraph(GoalID("untouched_goal"))
+	bt.Subgraphs[untouched.GoalID] = untouched
+	for _, cg := range []*CommitGraph{revived, rewritten, untouched} {
+		cg.Nodes[cg.RootNode].CompilationResult = &CompilationResult{Out: "compiler output"}
+		cg.State = GraphStateFailed
+	}
+
+	// what the orchestrator's lock allows to happen while the archive is written
+	compaction := rg.PrepareCompaction()
+	revived.State = GraphStateInProgress
+	rewritten.Nodes[rewritten.RootNode].CompilationResult.Out = "new compiler output"
+	require.NoError(t, compaction.Write(NewGraphArchive(filepath.Join(t.TempDir(), "graph.json"))))
+	archived, err := rg.ApplyCompaction(compaction)
+	require.NoError(t, err)
+	require.Equal(t, 1, archived)
+	require.Empty(t, revived.Nodes[revived.RootNode].ArchivedPayload)
+	require.Equal(t, "new compiler output", rewritten.Nodes[rewritten.RootNode].CompilationResult.Out)
+	require.NotEmpty(t, untouched.Nodes[untouched.RootNode].ArchivedPayload)
+}
@@ -0,0 +1,46 @@
+package orchestrator
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphDiff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graph.json")
+	rg, bt, cg, root, child := newTestCommitGraph(t)
+	removed := NewCommitGraph(GoalID("removed_goal"))
+	bt.Subgraphs[removed.GoalID] = removed
+	require.NoError(t, rg.SaveToFile(path))
+	before := &RepoGraph{}
+	require.NoError(t, before.LoadFromFile(path))
+
+	added, err := rg.AddNodeToCommitGraph(child, "also not parsable", NodeMetadata{})
+	require.NoError(t, err)
+	cg.Nodes[cg.RootNode].Metadata.IsFavorite = true
+	cg.Results = append(cg.Results, &CGResult{BranchTarget: BranchName("new_branch"), DiffPatch: "patch", GeneratingNodes: []NodeID{added.NodeID}})
+	delete(bt.Subgraphs, removed.GoalID)
+	parent := bt.BranchName
+	rg.BranchTargets[BranchName("new_branch")] = &RepoGraphBranchTarget{
+		BranchName:       BranchName("new_branch"),
+		ParentBranchName: &parent,
+		Subgraphs:        map[GoalID]*CommitGraph{},
+	}
+
+	diff, err := DiffRepoGraphs(before, rg)
+	require.NoError(t, err)
+	// node ids are random, so the order of the two node entries isn't fixed
+	require.ElementsMatch(t, []GraphDiffEntry{
+		{Kind: GraphDiffBranchTargetAdded, Locator: NodeLocatorFromTriplet(BranchName("new_branch"), "", "")},
+		{Kind: GraphDiffResultAdded, Locator: NodeLocatorFromTriplet(bt.BranchName, cg.GoalID, ""), To: "new_branch"},
+		{Kind: GraphDiffNodeMetadataEdit, Locator: root, From: `{}`, To: `{"is_favorite":true}`},
+		{Kind: GraphDiffNodeAdded, Locator: added},
+		{Kind: GraphDiffCommitGraphRemoved, Locator: NodeLocatorFromTriplet(bt.BranchName, removed.GoalID, "")},
+	}, diff)
+	require.Equal(t, GraphDiffBranchTargetAdded, diff[0].Kind)
+
+	diff, err = DiffRepoGraphs(rg, rg)
+	require.NoError(t, err)
+	require.Empty(t, diff)
+}
@@ -0,0 +1,73 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireSameGraph(t *testing.T, expected *RepoGraph, actual *RepoGraph) {
+	expectedJSON, err := json.Marshal(expected)
+	require.NoError(t, err)
+	actualJSON, err := json.Marshal(actual)
+	require.NoError(t, err)
+	require.JSONEq(t, string(expectedJSON), string(actualJSON))
+}
+
+func TestGraphEventLog_ReplaysMutationsSinceSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graph.json")
+	rg := NewRepoGraph(BranchName("test"))
+	require.NoError(t, rg.SaveToFile(path))
+	require.NoError(t, rg.OpenEventLog(path))
+	t.Cleanup(func() { rg.CloseEventLog() })
+
+	bt := rg.BranchTargets[BranchName("test")]
+	cg := NewCommitGraph(GoalID("goal_id"))
+	bt.Subgraphs[cg.GoalID] = cg
+	rg.recordCommitGraphCreated(CommitGraphSlice{BranchTarget: bt, CommitGraph: cg})
+	root := NodeLocatorFromTriplet(bt.BranchName, cg.GoalID, cg.RootNode)
+	_, err := rg.AddNodeToCommitGraph(root, "not parsable", NodeMetadata{})
+	require.NoError(t, err)
+
+	// a snapshot in the middle of the run
+	require.NoError(t, rg.SaveToFile(path))
+
+	child, err := rg.AddNodeToCommitGraph(root, "also not parsable", NodeMetadata{})
+	require.NoError(t, err)
+	slice, err := rg.GetNodeSlice(child)
+	require.NoError(t, err)
+	slice.CommitGraphNode.Metadata = NodeMetadata{IsFavorite: true, Label: "label"}
+	rg.recordNodeMetadata(slice)
+	require.NoError(t, rg.RequestNodeTerminationRecursively(root, 0))
+
+	// "crash" without saving
+	loaded := &RepoGraph{}
+	require.NoError(t, loaded.LoadFromFile(path))
+	requireSameGraph(t, rg, loaded)
+}
+
+func TestGraphEventLog_IgnoresPartialLastEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graph.json")
+	rg := NewRepoGraph(BranchName("test"))
+	require.NoError(t, rg.SaveToFile(path))
+	require.NoError(t, rg.OpenEventLog(path))
+	t.Cleanup(func() { rg.CloseEventLog() })
+
+	bt := rg.BranchTargets[BranchName("test")]
+	cg := NewCommitGraph(GoalID("goal_id"))
+	bt.Subgraphs[cg.GoalID] = cg
+	rg.recordCommitGraphCreated(CommitGraphSlice{BranchTarget: bt, CommitGraph: cg})
+
+	file, err := os.OpenFile(graphEventLogPath(path), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"seq":2,"type":"node_st`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	loaded := &RepoGraph{}
+	require.NoError(t, loaded.LoadFromFile(path))
+	requireSameGraph(t, rg, loaded)
+}
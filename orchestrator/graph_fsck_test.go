@@ -0,0 +1,88 @@
+package orchestrator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphFsck_RepairsDeletedNode(t *testing.T) {
+	rg, bt, cg, _, child := newTestCommitGraph(t)
+	_, err := rg.AddNodeToCommitGraph(child, "also not parsable", NodeMetadata{})
+	require.NoError(t, err)
+	cg.Results = append(cg.Results, &CGResult{BranchTarget: BranchName("other"), GeneratingNodes: []NodeID{child.NodeID}})
+	parent := bt.BranchName
+	rg.BranchTargets[BranchName("other")] = &RepoGraphBranchTarget{
+		BranchName:       BranchName("other"),
+		ParentBranchName: &parent,
+		Subgraphs:        map[GoalID]*CommitGraph{},
+	}
+	require.Empty(t, rg.Fsck(false))
+
+	// what /api/graph/delete-node does: the grandchild is orphaned & the result points nowhere
+	delete(cg.Nodes, child.NodeID)
+	cg.State = GraphStateSuccess
+	parent = BranchName("missing")
+
+	problems := rg.Fsck(false)
+	// parent branch, orphan, dangling child, dangling result, state
+	require.Len(t, problems, 5)
+	for _, problem := range problems {
+		require.False(t, problem.Repaired)
+	}
+	require.Len(t, cg.Nodes, 2)
+
+	problems = rg.Fsck(true)
+	require.Len(t, problems, 5)
+	for _, problem := range problems {
+		require.True(t, problem.Repaired, problem.String())
+	}
+	require.Len(t, cg.Nodes, 1)
+	require.Empty(t, cg.Nodes[cg.RootNode].Children)
+	require.Empty(t, cg.Results)
+	require.Equal(t, GraphStateAwaitingGoalSetup, cg.State)
+	require.Nil(t, rg.BranchTargets[BranchName("other")].ParentBranchName)
+	require.Empty(t, rg.Fsck(false))
+}
+
+func TestGraphFsck_RepairBacksUpLoadedGraph(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graph.json")
+	rg, _, cg, _, child := newTestCommitGraph(t)
+	// the child points at a node that doesn't exist
+	cg.Nodes[child.NodeID].Children = append(cg.Nodes[child.NodeID].Children, NodeID("missing"))
+	require.NoError(t, rg.SaveToFile(path))
+	require.NoError(t, rg.OpenEventLog(path))
+	_, err := rg.AddNodeToCommitGraph(child, "logged, not saved", NodeMetadata{})
+	require.NoError(t, err)
+	require.NoError(t, rg.CloseEventLog())
+
+	problems, backupPath, err := fsckGraphFile(path, true)
+	require.NoError(t, err)
+	require.Len(t, problems, 1)
+	require.True(t, problems[0].Repaired)
+	require.NotEmpty(t, backupPath)
+
+	backup := &RepoGraph{}
+	require.NoError(t, backup.loadSnapshot(backupPath))
+	require.Len(t, backup.Fsck(false), 1)
+	require.Len(t, backup.BranchTargets[BranchName("test")].Subgraphs[cg.GoalID].Nodes, 3)
+	repaired := &RepoGraph{}
+	require.NoError(t, repaired.LoadFromFile(path))
+	require.Empty(t, repaired.Fsck(false))
+
+	problems, backupPath, err = fsckGraphFile(path, true)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	require.Empty(t, backupPath)
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	numBackups := 0
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".bak" {
+			numBackups++
+		}
+	}
+	require.Equal(t, 1, numBackups)
+}
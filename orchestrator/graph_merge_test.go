@@ -0,0 +1,79 @@
+package orchestrator
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphMerge_CloneAndOriginal(t *testing.T) {
+	original, bt, _, _, child := newTestCommitGraph(t)
+	path := filepath.Join(t.TempDir(), "graph.json")
+	require.NoError(t, original.SaveToFile(path))
+	clone := &RepoGraph{}
+	require.NoError(t, clone.LoadFromFile(path))
+
+	// the clone grows the shared commit graph & explores a new goal
+	_, err := clone.AddNodeToCommitGraph(child, "also not parsable", NodeMetadata{})
+	require.NoError(t, err)
+	clone.BranchTargets[BranchName("test")].Subgraphs[GoalID("other_goal")] = NewCommitGraph(GoalID("other_goal"))
+	// the original explores yet another goal
+	bt.Subgraphs[GoalID("third_goal")] = NewCommitGraph(GoalID("third_goal"))
+
+	merged, conflicts, err := MergeRepoGraphs([]GraphMergeSource{
+		{Name: "original", Graph: original},
+		{Name: "clone", Graph: clone},
+	}, GraphMergePolicyLargest)
+	require.NoError(t, err)
+	require.Len(t, conflicts, 1)
+	require.Equal(t, []string{"original", "clone"}, merged.MergedFrom)
+	subgraphs := merged.BranchTargets[BranchName("test")].Subgraphs
+	require.Len(t, subgraphs, 3)
+	require.Len(t, subgraphs[GoalID("goal_id")].Nodes, 3)
+	require.Equal(t, "clone", subgraphs[GoalID("goal_id")].Source)
+	require.Equal(t, "clone", subgraphs[GoalID("other_goal")].Source)
+	require.Equal(t, "original", subgraphs[GoalID("third_goal")].Source)
+	require.Equal(t, "original", merged.BranchTargets[BranchName("test")].Source)
+	require.Empty(t, merged.Fsck(false))
+}
+
+func TestGraphMerge_ErrorPolicy(t *testing.T) {
+	a := NewRepoGraph(BranchName("test"))
+	b := NewRepoGraph(BranchName("test"))
+	_, _, err := MergeRepoGraphs([]GraphMergeSource{{Name: "a", Graph: a}, {Name: "b", Graph: b}}, GraphMergePolicyError)
+	require.Error(t, err)
+	_, conflicts, err := MergeRepoGraphs([]GraphMergeSource{{Name: "a", Graph: a}, {Name: "b", Graph: b}}, GraphMergePolicyFirst)
+	require.NoError(t, err)
+	require.Len(t, conflicts, 1)
+}
+
+func TestGraphMerge_LargestIgnoresSourceOrder(t *testing.T) {
+	// three unrelated versions of branch target "test" with 1, 2 & 3 goals of their own
+	newSource := func(name string, numGoals int) GraphMergeSource {
+		rg := NewRepoGraph(BranchName("test"))
+		bt := rg.BranchTargets[BranchName("test")]
+		bt.CreatedAt = time.Date(2025, 1, numGoals, 0, 0, 0, 0, time.UTC)
+		for i := range numGoals {
+			goalID := GoalID(fmt.Sprintf("%s_goal_%d", name, i))
+			bt.Subgraphs[goalID] = NewCommitGraph(goalID)
+		}
+		return GraphMergeSource{Name: name, Graph: rg}
+	}
+	for _, order := range [][]string{{"small", "medium", "large"}, {"large", "medium", "small"}, {"medium", "small", "large"}} {
+		sizes := map[string]int{"small": 1, "medium": 2, "large": 3}
+		sources := []GraphMergeSource{}
+		for _, name := range order {
+			sources = append(sources, newSource(name, sizes[name]))
+		}
+		merged, conflicts, err := MergeRepoGraphs(sources, GraphMergePolicyLargest)
+		require.NoError(t, err)
+		require.Len(t, conflicts, 2)
+		bt := merged.BranchTargets[BranchName("test")]
+		require.Equal(t, "large", bt.Source, "order %v", order)
+		require.Equal(t, time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC), bt.CreatedAt)
+		require.Len(t, bt.Subgraphs, 6)
+	}
+}
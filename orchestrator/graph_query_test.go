@@ -0,0 +1,65 @@
+package orchestrator
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphQuery(t *testing.T) {
+	rg, _, cg, root, syntaxFailure := newTestCommitGraph(t)
+	favorite, err := rg.AddNodeToCommitGraph(root, "not parsable either", NodeMetadata{IsFavorite: true, Label: "look at this"})
+	require.NoError(t, err)
+	cg.Nodes[cg.RootNode].CompilationResult = &CompilationResult{Out: "error: unknown identifier 'foo'"}
+	goalProvider := &StaticGoalProvider{goals: map[GoalID]GoalI{
+		cg.GoalID: &GoalAddExample{ID_: cg.GoalID, Name_: "goal name"},
+	}}
+
+	for query, expected := range map[string][]NodeID{
+		"":                                       {cg.RootNode, syntaxFailure.NodeID, favorite.NodeID},
+		"depth >= 1 and result = syntax_failure": {syntaxFailure.NodeID, favorite.NodeID},
+		"result = node_result_syntax_failure and favorite = true": {favorite.NodeID},
+		"not (favorite = true) and depth > 0":                     {syntaxFailure.NodeID},
+		`compilation ~ 'unknown identifier'`:                      {cg.RootNode},
+		`label = "look at this" or depth = 0`:                     {cg.RootNode, favorite.NodeID},
+		`output ~ '^not parsable$'`:                               {syntaxFailure.NodeID},
+		`goal = "goal name" and state != done`:                    {cg.RootNode},
+		"branch = other":                                          {},
+	} {
+		q, err := ParseNodeQuery(query)
+		require.NoError(t, err, query)
+		actual := []NodeID{}
+		matches, err := rg.Query(q, goalProvider, nil)
+		require.NoError(t, err, query)
+		for _, slice := range matches {
+			actual = append(actual, slice.CommitGraphNode.ID)
+		}
+		require.ElementsMatch(t, expected, actual, query)
+	}
+
+	for _, query := range []string{"depth", "nope = 1", "depth = x", "favorite ~ true", "(depth = 1", "depth = 1 depth = 2", "output ~ '('"} {
+		_, err := ParseNodeQuery(query)
+		require.Error(t, err, query)
+	}
+}
+
+func TestGraphQuery_ArchivedPayloads(t *testing.T) {
+	rg, _, cg, _, _ := newTestCommitGraph(t)
+	cg.Nodes[cg.RootNode].CompilationResult = &CompilationResult{Out: "error: unknown identifier 'foo'"}
+	cg.State = GraphStateFailed
+	archive := NewGraphArchive(filepath.Join(t.TempDir(), "graph.json"))
+	archived, err := rg.Compact(archive)
+	require.NoError(t, err)
+	require.Equal(t, 2, archived)
+
+	q, err := ParseNodeQuery(`compilation ~ 'unknown identifier'`)
+	require.NoError(t, err)
+	matches, err := rg.Query(q, nil, archive)
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	require.Equal(t, cg.RootNode, matches[0].CommitGraphNode.ID)
+	require.Equal(t, "error: unknown identifier 'foo'", matches[0].CommitGraphNode.CompilationResult.Out)
+	// the graph itself stays compacted
+	require.Nil(t, cg.Nodes[cg.RootNode].CompilationResult)
+}
@@ -0,0 +1,38 @@
+package orchestrator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphRender(t *testing.T) {
+	rg, bt, cg, root, child := newTestCommitGraph(t)
+	parent := bt.BranchName
+	traversalGoalID := cg.GoalID
+	rg.BranchTargets[BranchName("child")] = &RepoGraphBranchTarget{
+		BranchName:       BranchName("child"),
+		ParentBranchName: &parent,
+		TraversalGoalID:  &traversalGoalID,
+		Subgraphs:        map[GoalID]*CommitGraph{},
+	}
+	goalProvider := &StaticGoalProvider{goals: map[GoalID]GoalI{
+		cg.GoalID: &GoalAddExample{ID_: cg.GoalID, Name_: `the "goal"`},
+	}}
+
+	tree := rg.renderBranchTargetTree(goalProvider)
+	var dot strings.Builder
+	require.NoError(t, tree.WriteDOT(&dot))
+	require.Contains(t, dot.String(), `"test" -> "child" [label="the \"goal\""];`)
+
+	commitGraph, err := rg.renderCommitGraph(root.CommitGraphLocator, goalProvider)
+	require.NoError(t, err)
+	var mermaid strings.Builder
+	require.NoError(t, commitGraph.WriteMermaid(&mermaid))
+	require.True(t, strings.HasPrefix(mermaid.String(), "flowchart TD\n"))
+	require.Contains(t, mermaid.String(), "depth 1<br/>syntax_failure")
+	require.Contains(t, mermaid.String(), "fill:"+nodeResultColors[NodeResultSyntaxFailure])
+	require.Len(t, commitGraph.Edges, 1)
+	require.Equal(t, string(child.NodeID), commitGraph.Edges[0].To)
+}
@@ -0,0 +1,52 @@
+package orchestrator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphSchema_MigratesUnversionedGraph(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graph.json")
+	// written before schema_version, metadata, model_reference and results existed
+	unversioned := `{
+		"id": "repo_graph_id",
+		"branch_targets": {
+			"main": {
+				"branch_name": "main",
+				"subgraphs": {
+					"goal_id": {
+						"goal_id": "goal_id",
+						"root_node": "node_id",
+						"state": "graph_in_progress",
+						"nodes": {
+							"node_id": {"id": "node_id", "state": "node_done", "children": null}
+						}
+					}
+				}
+			}
+		}
+	}`
+	require.NoError(t, os.WriteFile(path, []byte(unversioned), 0644))
+
+	rg := &RepoGraph{}
+	require.NoError(t, rg.LoadFromFile(path))
+	require.Equal(t, CurrentGraphSchemaVersion, rg.SchemaVersion)
+	cg := rg.BranchTargets[BranchName("main")].Subgraphs[GoalID("goal_id")]
+	require.NotNil(t, cg.Results)
+	node := cg.Nodes[NodeID("node_id")]
+	require.NotNil(t, node.Children)
+	require.NotNil(t, node.ActionOutputs)
+
+	require.NoError(t, rg.SaveToFile(path))
+	reloaded := &RepoGraph{}
+	require.NoError(t, reloaded.LoadFromFile(path))
+	requireSameGraph(t, rg, reloaded)
+}
+
+func TestGraphSchema_RejectsNewerGraph(t *testing.T) {
+	_, _, err := migrateGraphJSON([]byte(`{"schema_version": 999, "branch_targets": {}}`))
+	require.Error(t, err)
+}
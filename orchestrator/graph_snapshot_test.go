@@ -0,0 +1,103 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphSnapshot_KeepsLastN(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graph.json")
+	rg := NewRepoGraph(BranchName("test"))
+	for i := 0; i < NumGraphSnapshotsToKeep+3; i++ {
+		require.NoError(t, rg.SaveToFile(path))
+	}
+	snapshots, err := graphSnapshots(path)
+	require.NoError(t, err)
+	require.Len(t, snapshots, NumGraphSnapshotsToKeep)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NotContains(t, entry.Name(), ".tmp-", "temp file left behind")
+	}
+}
+
+func TestGraphSnapshot_FallsBackWhenCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graph.json")
+	rg := NewRepoGraph(BranchName("test"))
+	require.NoError(t, rg.SaveToFile(path))
+	// a later snapshot that is also corrupt
+	require.NoError(t, rg.SaveToFile(path))
+	snapshots, err := graphSnapshots(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(snapshots[0]))
+	require.NoError(t, os.WriteFile(snapshots[0], []byte(`{"id": "trunc`), 0644))
+
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.WriteFile(path, []byte(`{"branch_targets": {`), 0644))
+
+	loaded := &RepoGraph{}
+	require.NoError(t, loaded.LoadFromFile(path))
+	requireSameGraph(t, rg, loaded)
+}
+
+func TestGraphSnapshot_FallbackMovesStaleEventsAside(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graph.json")
+	rg := NewRepoGraph(BranchName("test"))
+	require.NoError(t, rg.SaveToFile(path))
+	require.NoError(t, rg.OpenEventLog(path))
+	bt := rg.BranchTargets[BranchName("test")]
+	cg := NewCommitGraph(GoalID("goal_id"))
+	bt.Subgraphs[cg.GoalID] = cg
+	rg.recordCommitGraphCreated(CommitGraphSlice{BranchTarget: bt, CommitGraph: cg})
+	require.NoError(t, rg.SaveToFile(path))
+	root := NodeLocatorFromTriplet(bt.BranchName, cg.GoalID, cg.RootNode)
+	_, err := rg.AddNodeToCommitGraph(root, "not parsable", NodeMetadata{})
+	require.NoError(t, err)
+	require.NoError(t, rg.CloseEventLog())
+
+	// only the first snapshot survives, and the event log continues from the second
+	snapshots, err := graphSnapshots(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(snapshots[0], []byte(`{"id": "trunc`), 0644))
+	require.NoError(t, os.WriteFile(path, []byte(`{"branch_targets": {`), 0644))
+	loaded := &RepoGraph{}
+	require.NoError(t, loaded.LoadFromFile(path))
+	require.Empty(t, loaded.BranchTargets[BranchName("test")].Subgraphs)
+
+	// new events must not be mixed up with the stale ones
+	require.NoError(t, loaded.OpenEventLog(path))
+	t.Cleanup(func() { loaded.CloseEventLog() })
+	loadedBT := loaded.BranchTargets[BranchName("test")]
+	other := NewCommitGraph(GoalID("other_goal"))
+	loadedBT.Subgraphs[other.GoalID] = other
+	loaded.recordCommitGraphCreated(CommitGraphSlice{BranchTarget: loadedBT, CommitGraph: other})
+	reloaded := &RepoGraph{}
+	require.NoError(t, reloaded.LoadFromFile(path))
+	requireSameGraph(t, loaded, reloaded)
+}
+
+func TestGraphSnapshot_PrepareSaveWritesTheGraphAsPrepared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graph.json")
+	rg, _, cg, root, child := newTestCommitGraph(t)
+	cg.Results = append(cg.Results, &CGResult{BranchTarget: BranchName("result"), GeneratingNodes: []NodeID{child.NodeID}})
+	write, err := rg.PrepareSave(path)
+	require.NoError(t, err)
+	prepared, err := json.Marshal(rg)
+	require.NoError(t, err)
+
+	// mutations made after the lock is released must not leak into the save
+	_, err = rg.AddNodeToCommitGraph(root, "added after PrepareSave", NodeMetadata{})
+	require.NoError(t, err)
+	cg.Nodes[child.NodeID].Children = append(cg.Nodes[child.NodeID].Children, NodeID("grandchild"))
+	cg.Results[0].GeneratingNodes[0] = NodeID("changed")
+	require.NoError(t, write())
+
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.JSONEq(t, string(prepared), string(saved))
+}
@@ -0,0 +1,48 @@
+package orchestrator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphStats(t *testing.T) {
+	rg, bt, cg, root, syntaxFailure := newTestCommitGraph(t)
+	success, err := rg.AddNodeToCommitGraph(root, "not parsable either", NodeMetadata{})
+	require.NoError(t, err)
+	for _, locator := range []NodeLocator{root, syntaxFailure, success} {
+		slice, err := rg.GetNodeSlice(locator)
+		require.NoError(t, err)
+		slice.CommitGraphNode.State = NodeStateDone
+	}
+	cg.Nodes[success.NodeID].Result = NodeResultSuccess
+	cg.Nodes[success.NodeID].ModelReference = ModelReference{ModelName: "model"}
+	cg.State = GraphStateSuccess
+
+	parent := bt.BranchName
+	rg.BranchTargets[BranchName("child")] = &RepoGraphBranchTarget{
+		BranchName:       BranchName("child"),
+		ParentBranchName: &parent,
+		Subgraphs:        map[GoalID]*CommitGraph{GoalID("other_goal"): NewCommitGraph(GoalID("other_goal"))},
+	}
+	rg.BranchTargets[BranchName("child")].Subgraphs[GoalID("other_goal")].State = GraphStateGoalSetupFailed
+
+	stats := rg.Stats(&StaticGoalProvider{goals: map[GoalID]GoalI{
+		GoalID("goal_id"): &GoalAddExample{ID_: GoalID("goal_id"), Name_: "goal"},
+	}}, time.Hour)
+
+	require.Equal(t, []GoalStats{
+		{GoalID: GoalID("other_goal"), SetupFailed: 1},
+		{GoalID: GoalID("goal_id"), Name: "goal", Success: 1},
+	}, stats.Goals)
+	require.Len(t, stats.ResultsByDepth, 2)
+	require.Equal(t, map[NodeResult]int{NodeResultSyntaxFailure: 1, NodeResultSuccess: 1}, stats.ResultsByDepth[1].Results)
+	require.Equal(t, 1.0, stats.MeanStepsToSuccess)
+	require.Len(t, stats.ResultsByModel, 2)
+	require.Equal(t, "model", stats.ResultsByModel[1].ModelReference.ModelName)
+	require.Equal(t, 1.0, stats.ResultsByModel[1].SuccessRate)
+	require.Len(t, stats.SyntaxFailures, 1)
+	require.Equal(t, 0.5, stats.SyntaxFailures[0].Rate)
+	require.Equal(t, BranchTreeStats{Count: 2, MaxDepth: 1, MeanFanOut: 1, MaxFanOut: 1}, stats.BranchTargets)
+}
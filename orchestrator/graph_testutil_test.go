@@ -0,0 +1,20 @@
+package orchestrator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCommitGraph returns a graph whose branch target "test" has a single commit graph ("goal_id"),
+// in which the root has one (unparsable) child.
+func newTestCommitGraph(t *testing.T) (rg *RepoGraph, bt *RepoGraphBranchTarget, cg *CommitGraph, root NodeLocator, child NodeLocator) {
+	rg = NewRepoGraph(BranchName("test"))
+	bt = rg.BranchTargets[BranchName("test")]
+	cg = NewCommitGraph(GoalID("goal_id"))
+	bt.Subgraphs[cg.GoalID] = cg
+	root = NodeLocatorFromTriplet(bt.BranchName, cg.GoalID, cg.RootNode)
+	child, err := rg.AddNodeToCommitGraph(root, "not parsable", NodeMetadata{})
+	require.NoError(t, err)
+	return rg, bt, cg, root, child
+}
@@ -0,0 +1,244 @@
+package orchestrator
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Metrics are exposed on /metrics in the prometheus text exposition format.
+// It is written by hand to avoid pulling in the prometheus client for a handful of series.
+const metricsPrefix = "byb_"
+
+// buckets in seconds. Compilation takes ~seconds, inference ~minutes.
+var taskDurationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+type histogram struct {
+	bounds []float64
+	// counts[i] is the number of observations <= bounds[i] (not cumulative). The last entry is +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i, _ := slices.BinarySearch(h.bounds, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+func (h histogram) clone() histogram {
+	h.counts = slices.Clone(h.counts)
+	return h
+}
+
+// engineMetrics are cumulative since the engine started. Guarded by statsMu.
+type engineMetrics struct {
+	tasksEnqueued                   int
+	tasksFinished                   int
+	tasksRequeued                   int
+	tasksDead                       int
+	tasksCancelled                  int
+	workersLost                     int
+	camshaftBlockedFromBackpressure int
+	taskProcessingTime              histogram
+	taskTimeSpentInQueue            histogram
+}
+
+func newEngineMetrics() engineMetrics {
+	return engineMetrics{
+		taskProcessingTime:   newHistogram(taskDurationBuckets),
+		taskTimeSpentInQueue: newHistogram(taskDurationBuckets),
+	}
+}
+
+// must be called with statsMu held.
+func (m *engineMetrics) record(event EngineStatEvent) {
+	m.tasksEnqueued += event.tasksEnqueued
+	m.tasksFinished += event.tasksFinished
+	m.tasksRequeued += event.tasksRequeued
+	m.tasksDead += event.tasksDead
+	m.tasksCancelled += event.tasksCancelled
+	m.workersLost += event.workersLost
+	m.camshaftBlockedFromBackpressure += event.camshaftBlockedFromBackpressure
+	if event.tasksFinished > 0 {
+		m.taskProcessingTime.observe(event.taskFinishedInTime)
+	}
+	if event.taskTimeSpentInQueue > 0 {
+		m.taskTimeSpentInQueue.observe(event.taskTimeSpentInQueue)
+	}
+}
+
+func (e *Engine) metricsSnapshot() engineMetrics {
+	e.statsMu.Lock()
+	defer e.statsMu.Unlock()
+	snapshot := e.metrics
+	snapshot.taskProcessingTime = e.metrics.taskProcessingTime.clone()
+	snapshot.taskTimeSpentInQueue = e.metrics.taskTimeSpentInQueue.clone()
+	return snapshot
+}
+
+func (e *Engine) numQueuedTasks() int {
+	e.queuedTasksMu.Lock()
+	defer e.queuedTasksMu.Unlock()
+	return len(e.queuedTasks)
+}
+
+type metricsWriter struct {
+	w io.Writer
+}
+
+type metricLabel struct {
+	name  string
+	value string
+}
+
+func (m metricsWriter) header(name string, metricType string, help string) {
+	fmt.Fprintf(m.w, "# HELP %s%s %s\n", metricsPrefix, name, help)
+	fmt.Fprintf(m.w, "# TYPE %s%s %s\n", metricsPrefix, name, metricType)
+}
+
+func (m metricsWriter) sample(name string, value float64, labels ...metricLabel) {
+	fmt.Fprintf(m.w, "%s%s%s %s\n", metricsPrefix, name, formatMetricLabels(labels), formatMetricValue(value))
+}
+
+func (m metricsWriter) histogram(name string, h histogram, labels ...metricLabel) {
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		m.sample(name+"_bucket", float64(cumulative), append(labels, metricLabel{"le", formatMetricValue(bound)})...)
+	}
+	m.sample(name+"_bucket", float64(h.count), append(labels, metricLabel{"le", "+Inf"})...)
+	m.sample(name+"_sum", h.sum, labels...)
+	m.sample(name+"_count", float64(h.count), labels...)
+}
+
+func formatMetricLabels(labels []metricLabel) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels))
+	for _, label := range labels {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(label.value)
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, label.name, value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+func (o *Orchestrator) engines() []*Engine {
+	return []*Engine{o.GoalCompilationEngine, o.InferenceEngine, o.CompilationEngine}
+}
+
+// WriteMetrics writes every engine & graph metric in the prometheus text format.
+func (o *Orchestrator) WriteMetrics(w io.Writer) {
+	m := metricsWriter{w: w}
+	engines := o.engines()
+	snapshots := make([]engineMetrics, len(engines))
+	for i, engine := range engines {
+		snapshots[i] = engine.metricsSnapshot()
+	}
+	jobLabel := func(i int) metricLabel {
+		return metricLabel{"job", string(engines[i].job)}
+	}
+	counters := []struct {
+		name  string
+		help  string
+		value func(engineMetrics) int
+	}{
+		{"engine_tasks_enqueued_total", "Tasks pushed to the workers for the first time.", func(m engineMetrics) int { return m.tasksEnqueued }},
+		{"engine_tasks_finished_total", "Tasks whose result was received.", func(m engineMetrics) int { return m.tasksFinished }},
+		{"engine_tasks_requeued_total", "Tasks pushed again after timing out or being abandoned.", func(m engineMetrics) int { return m.tasksRequeued }},
+		{"engine_tasks_dead_total", "Tasks that ran out of attempts.", func(m engineMetrics) int { return m.tasksDead }},
+		{"engine_tasks_cancelled_total", "Tasks cancelled through Engine.Cancel.", func(m engineMetrics) int { return m.tasksCancelled }},
+		{"engine_workers_lost_total", "Workers whose heartbeat lapsed.", func(m engineMetrics) int { return m.workersLost }},
+		{"engine_camshaft_backpressure_blocks_total", "Camshaft ticks that skipped reading input because the consumer was behind.", func(m engineMetrics) int { return m.camshaftBlockedFromBackpressure }},
+	}
+	for _, counter := range counters {
+		m.header(counter.name, "counter", counter.help)
+		for i := range engines {
+			m.sample(counter.name, float64(counter.value(snapshots[i])), jobLabel(i))
+		}
+	}
+	m.header("engine_queued_tasks", "gauge", "Tasks the engine is waiting on a result for.")
+	for i, engine := range engines {
+		m.sample("engine_queued_tasks", float64(engine.numQueuedTasks()), jobLabel(i))
+	}
+	m.header("engine_max_task_queue_size", "gauge", "Current MaxTaskQueueSize (changes in adaptive mode).")
+	for i, engine := range engines {
+		_, maxSize := engine.QueueSizes()
+		m.sample("engine_max_task_queue_size", float64(maxSize), jobLabel(i))
+	}
+	m.header("engine_task_processing_seconds", "histogram", "Time from a worker picking up a task to its result arriving.")
+	for i := range engines {
+		m.histogram("engine_task_processing_seconds", snapshots[i].taskProcessingTime, jobLabel(i))
+	}
+	m.header("engine_task_queue_seconds", "histogram", "Time from a task being created to a worker picking it up.")
+	for i := range engines {
+		m.histogram("engine_task_queue_seconds", snapshots[i].taskTimeSpentInQueue, jobLabel(i))
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	graphStates := map[GraphState]int{}
+	nodeStates := map[NodeState]int{}
+	nodeResults := map[NodeResult]int{}
+	for _, bt := range o.RepoGraph.BranchTargets {
+		for _, cg := range bt.Subgraphs {
+			graphStates[cg.State]++
+			for _, node := range cg.Nodes {
+				nodeStates[node.State]++
+				nodeResults[node.Result]++
+			}
+		}
+	}
+	m.header("graph_branch_targets", "gauge", "Branch targets in the repo graph.")
+	m.sample("graph_branch_targets", float64(len(o.RepoGraph.BranchTargets)))
+	m.header("graph_unfinished_graphs", "gauge", "Commit graphs that are awaiting goal setup or in progress.")
+	m.sample("graph_unfinished_graphs", float64(len(o.RepoGraph.UnfinishedGraphs())))
+	m.header("graph_commit_graphs", "gauge", "Commit graphs by state.")
+	for _, state := range sortedKeys(graphStates) {
+		m.sample("graph_commit_graphs", float64(graphStates[state]), metricLabel{"state", string(state)})
+	}
+	m.header("graph_nodes", "gauge", "Commit graph nodes by state.")
+	for _, state := range sortedKeys(nodeStates) {
+		m.sample("graph_nodes", float64(nodeStates[state]), metricLabel{"state", string(state)})
+	}
+	m.header("graph_node_results", "gauge", "Commit graph nodes by result.")
+	for _, result := range sortedKeys(nodeResults) {
+		m.sample("graph_node_results", float64(nodeResults[result]), metricLabel{"result", string(result)})
+	}
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (o *Orchestrator) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	o.WriteMetrics(w)
+}
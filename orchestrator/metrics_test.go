@@ -0,0 +1,27 @@
+package orchestrator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsWriter_Histogram(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+	h.observe(500 * time.Millisecond)
+	h.observe(time.Second)
+	h.observe(time.Minute)
+
+	var sb strings.Builder
+	metricsWriter{w: &sb}.histogram("task_seconds", h, metricLabel{"job", "test"})
+	require.Equal(t, strings.Join([]string{
+		`byb_task_seconds_bucket{job="test",le="1"} 2`,
+		`byb_task_seconds_bucket{job="test",le="10"} 2`,
+		`byb_task_seconds_bucket{job="test",le="+Inf"} 3`,
+		`byb_task_seconds_sum{job="test"} 61.5`,
+		`byb_task_seconds_count{job="test"} 3`,
+		"",
+	}, "\n"), sb.String())
+}
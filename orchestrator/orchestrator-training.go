@@ -25,29 +25,30 @@ type TrainingDataGroup struct {
 	Outputs []GroupOutput   `json:"outputs"`
 }
 
+// Training chan names are relative to the run's RedisNamespace.
 const RedisTrainingTxChan = "training:data-chan"
 const RedisTrainingRxChan = "training:request-chan"
 const RedisTrainingAdvList = "training:advertisement-list"
 
-func ReadNextTrainingRequest(ctx context.Context, rdb *redis.Client) (TrainingGroupID, error) {
-	request, err := rdb.BRPop(ctx, 3*time.Second, RedisTrainingRxChan).Result()
+func ReadNextTrainingRequest(ctx context.Context, rdb *redis.Client, ns RedisNamespace) (TrainingGroupID, error) {
+	request, err := rdb.BRPop(ctx, 3*time.Second, ns.Key(RedisTrainingRxChan)).Result()
 	if err != nil {
 		return "", err
 	}
 	return TrainingGroupID(request[1]), nil
 }
 
-func DropTrainingChans(ctx context.Context, rdb *redis.Client) error {
+func DropTrainingChans(ctx context.Context, rdb *redis.Client, ns RedisNamespace) error {
 	fmt.Println("dropping training chans")
-	err := rdb.Del(ctx, RedisTrainingTxChan).Err()
+	err := rdb.Del(ctx, ns.Key(RedisTrainingTxChan)).Err()
 	if err != nil {
 		return err
 	}
-	err = rdb.Del(ctx, RedisTrainingRxChan).Err()
+	err = rdb.Del(ctx, ns.Key(RedisTrainingRxChan)).Err()
 	if err != nil {
 		return err
 	}
-	err = rdb.Del(ctx, RedisTrainingAdvList).Err()
+	err = rdb.Del(ctx, ns.Key(RedisTrainingAdvList)).Err()
 	if err != nil {
 		return err
 	}
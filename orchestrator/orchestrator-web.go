@@ -25,6 +25,37 @@ func (o *Orchestrator) RegisterHandlers(mux *http.ServeMux) {
 		w.Write([]byte("pong"))
 	})
 
+	mux.HandleFunc("/metrics", o.handleMetrics)
+
+	mux.HandleFunc("/api/engines/workers", func(w http.ResponseWriter, r *http.Request) {
+		setupHeader(&w, true)
+		type EngineWorkers struct {
+			Job      EngineJobName  `json:"job"`
+			NumAlive int            `json:"num_alive"`
+			Workers  []WorkerStatus `json:"workers"`
+		}
+		response := []EngineWorkers{}
+		for _, engine := range o.engines() {
+			workers, err := engine.Workers(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			numAlive := 0
+			for _, worker := range workers {
+				if worker.Alive {
+					numAlive++
+				}
+			}
+			response = append(response, EngineWorkers{
+				Job:      engine.job,
+				NumAlive: numAlive,
+				Workers:  workers,
+			})
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+
 	mux.HandleFunc("/api/graph/branch-target-graph-locators", func(w http.ResponseWriter, r *http.Request) {
 		setupHeader(&w, true)
 		o.mu.Lock()
@@ -230,7 +261,15 @@ func (o *Orchestrator) RegisterHandlers(mux *http.ServeMux) {
 			return
 		}
 		o.logger.Info().Msgf("setting commit graph state to %s from %s", request.State, slice.CommitGraph.State)
+		if !isArchivableGraphState(request.State) {
+			// it may be scheduled again, so its prompts need the archived payloads
+			if err := o.RepoGraph.RestoreArchivedCommitGraph(slice, NewGraphArchive(o.GraphPath)); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 		slice.CommitGraph.State = request.State
+		o.RepoGraph.recordCommitGraphState(slice)
 		w.Write([]byte("{}"))
 	})
 
@@ -256,12 +295,18 @@ func (o *Orchestrator) RegisterHandlers(mux *http.ServeMux) {
 			CompilationResult    *CompilationResult `json:"compilation_result,omitempty"`
 			Prompt               string             `json:"prompt,omitempty"`
 		}
-		slice, err := o.RepoGraph.GetNodeSlice(request)
+		// compacted nodes are loaded from the archive
+		rg, err := o.RepoGraph.HydratedCommitGraph(request.CommitGraphLocator, NewGraphArchive(o.GraphPath))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		prompt_task, err := o.RepoGraph.BuildInferenceTaskForNode(request, o.GoalProvider)
+		slice, err := rg.GetNodeSlice(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		prompt_task, err := rg.BuildInferenceTaskForNode(request, o.GoalProvider)
 		var prompt string
 		if err != nil {
 			prompt = fmt.Sprintf("Error building prompt: %s", err.Error())
@@ -293,7 +338,7 @@ func (o *Orchestrator) RegisterHandlers(mux *http.ServeMux) {
 		}
 		o.mu.Lock()
 		defer o.mu.Unlock()
-		err = o.RepoGraph.RequestNodeTerminationRecursively(request, 0)
+		err = o.TerminateNode(request)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -328,6 +373,7 @@ func (o *Orchestrator) RegisterHandlers(mux *http.ServeMux) {
 			}
 		}
 		delete(slice.CommitGraph.Nodes, request.NodeID)
+		o.RepoGraph.recordNodeDeleted(request)
 		w.Write([]byte("{}"))
 	})
 	mux.HandleFunc("/api/graph/create-node", func(w http.ResponseWriter, r *http.Request) {
@@ -347,6 +393,16 @@ func (o *Orchestrator) RegisterHandlers(mux *http.ServeMux) {
 		}
 		o.mu.Lock()
 		defer o.mu.Unlock()
+		parentSlice, err := o.RepoGraph.GetCommitGraphSlice(request.ParentNodeLocator.CommitGraphLocator)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the new node revives the commit graph
+		if err := o.RepoGraph.RestoreArchivedCommitGraph(parentSlice, NewGraphArchive(o.GraphPath)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		locator, err := o.RepoGraph.AddNodeToCommitGraph(
 			request.ParentNodeLocator,
 			request.InferenceOutput,
@@ -383,6 +439,7 @@ func (o *Orchestrator) RegisterHandlers(mux *http.ServeMux) {
 			return
 		}
 		slice.CommitGraphNode.Metadata = request.Metadata
+		o.RepoGraph.recordNodeMetadata(slice)
 		w.Write([]byte("{}"))
 	})
 	mux.HandleFunc("/api/graph/save-golden-sample", func(w http.ResponseWriter, r *http.Request) {
@@ -403,8 +460,19 @@ func (o *Orchestrator) RegisterHandlers(mux *http.ServeMux) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		// compacted nodes are loaded from the archive
+		hydrated, err := o.RepoGraph.HydratedCommitGraph(request.NodeLocator.CommitGraphLocator, NewGraphArchive(o.GraphPath))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hydratedSlice, err := hydrated.GetNodeSlice(request.NodeLocator)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		prompt_task, err := o.RepoGraph.BuildInferenceTaskForNode(request.NodeLocator, o.GoalProvider)
+		prompt_task, err := hydrated.BuildInferenceTaskForNode(request.NodeLocator, o.GoalProvider)
 		var prompt string
 		if err != nil {
 			prompt = fmt.Sprintf("Error building prompt: %s", err.Error())
@@ -418,7 +486,7 @@ func (o *Orchestrator) RegisterHandlers(mux *http.ServeMux) {
 			Type:        GoldenSampleTypeProofGeneration,
 			Timestamp:   time.Now(),
 			Prompt:      prompt,
-			Completion:  slice.CommitGraphNode.InferenceOutput,
+			Completion:  hydratedSlice.CommitGraphNode.InferenceOutput,
 		}
 		if err := goldenSample.Write(); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -2,10 +2,12 @@ package orchestrator
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
@@ -21,19 +23,27 @@ func createOrchestratorStartCli() *cli.Command {
 	var graphPath string
 	var goalFile string
 	var doTraining bool
+	var targetQueueLatency time.Duration
+	var redisNamespace string
+	var recordTapePath string
+	var replayTapePath string
+	var replayOutPath string
+	var payloadVersion int64
+	var autoCompact bool
 	action := func(ctx context.Context, _ *cli.Command) error {
 		logger := zerolog.Ctx(ctx)
 		logger.Info().Msg("starting orchestrator")
+		namespace := RedisNamespace(redisNamespace)
 		rdb, err := ConnectToRedis(ctx)
 		if err != nil {
 			return err
 		}
 		goalProvider := StaticGoalProviderFromFile(goalFile)
 		if !viewOnly {
-			if err := setRouterParam(ctx, rdb, RedisInferenceEnabled, "true"); err != nil {
+			if err := setRouterParam(ctx, rdb, namespace, RedisInferenceEnabled, "true"); err != nil {
 				return err
 			}
-			if err := DropTrainingChans(ctx, rdb); err != nil {
+			if err := DropTrainingChans(ctx, rdb, namespace); err != nil {
 				return err
 			}
 		}
@@ -41,6 +51,13 @@ func createOrchestratorStartCli() *cli.Command {
 		if err := rg.LoadFromFile(graphPath); err != nil {
 			return err
 		}
+		if replayTapePath != "" {
+			graphPath, err = copyGraphForReplay(rg, graphPath, replayOutPath)
+			if err != nil {
+				return err
+			}
+			logger.Info().Msgf("replaying into %s", graphPath)
+		}
 		rg.Ctx = ctx
 		if doTraining {
 			// otherwise, nil
@@ -50,30 +67,74 @@ func createOrchestratorStartCli() *cli.Command {
 		// At with a queue size of 24+4 with each task taking 36 seconds,
 		// we end up at 16.8 minutes of latency.
 		inferenceSchedulingParams := SchedulingParams{
-			MinTaskQueueSize:      16, // bs = 8, nodes = 2
-			MaxTaskQueueSize:      24,
-			TaskProcessingTimeout: 5 * time.Minute,
-			CamShaftInterval:      1 * time.Second,
-			CrankShaftInterval:    1 * time.Second,
-			TimingBeltInterval:    2 * time.Second,
-			ODBInterval:           10 * time.Second,
-			InputChanSize:         4,
-			OutputChanSize:        8,
+			MinTaskQueueSize:       16, // bs = 8, nodes = 2
+			MaxTaskQueueSize:       24,
+			WorkerBatchSize:        8,
+			TaskProcessingTimeout:  5 * time.Minute,
+			CamShaftInterval:       1 * time.Second,
+			CrankShaftInterval:     1 * time.Second,
+			TimingBeltInterval:     2 * time.Second,
+			ODBInterval:            10 * time.Second,
+			InputChanSize:          4,
+			OutputChanSize:         8,
+			WorkerHeartbeatTimeout: 30 * time.Second,
+			PriorityBufferSize:     64,
+			MaxAttempts:            3,
+			PersistInFlight:        true,
 		}
 		compilationSchedulingParams := SchedulingParams{
-			MinTaskQueueSize:      16,
-			MaxTaskQueueSize:      24,
-			TaskProcessingTimeout: 2 * time.Minute,
-			CamShaftInterval:      1 * time.Second,
-			CrankShaftInterval:    1 * time.Second,
-			TimingBeltInterval:    2 * time.Second,
-			ODBInterval:           10 * time.Second,
-			InputChanSize:         4,
-			OutputChanSize:        8,
-		}
-		inferenceEngine := NewEngine(ctx, EngineJobNameInference, rdb, inferenceSchedulingParams)
-		compilationEngine := NewEngine(ctx, EngineJobNameCompilation, rdb, compilationSchedulingParams)
-		goalCompilationEngine := NewEngine(ctx, EngineJobNameGoalCompilation, rdb, compilationSchedulingParams)
+			MinTaskQueueSize:       16,
+			MaxTaskQueueSize:       24,
+			TaskProcessingTimeout:  2 * time.Minute,
+			CamShaftInterval:       1 * time.Second,
+			CrankShaftInterval:     1 * time.Second,
+			TimingBeltInterval:     2 * time.Second,
+			ODBInterval:            10 * time.Second,
+			InputChanSize:          4,
+			OutputChanSize:         8,
+			WorkerHeartbeatTimeout: 30 * time.Second,
+			PriorityBufferSize:     64,
+			MaxAttempts:            3,
+			PersistInFlight:        true,
+		}
+		inferenceSchedulingParams.TargetQueueLatency = targetQueueLatency
+		compilationSchedulingParams.TargetQueueLatency = targetQueueLatency
+		if recordTapePath != "" && replayTapePath != "" {
+			return errors.New("cannot record and replay a tape at the same time")
+		}
+		var recorder *TapeRecorder
+		if recordTapePath != "" {
+			recorder, err = NewTapeRecorder(recordTapePath)
+			if err != nil {
+				return err
+			}
+			defer recorder.Close()
+		}
+		var tape *Tape
+		if replayTapePath != "" {
+			tape, err = LoadTape(replayTapePath)
+			if err != nil {
+				return err
+			}
+		}
+		newEngine := func(baseJob EngineJobName, params SchedulingParams) *Engine {
+			job := namespace.Job(baseJob)
+			if tape != nil {
+				// no workers, so nothing needs to be shared through redis
+				return NewEngineWithTransport(ctx, job, NewMemoryQueueBackend(), NewReplayTransport(baseJob, tape), params)
+			}
+			var transport EngineTransport = NewListTransport(job, NewRedisQueueBackend(rdb))
+			payloadParams := DefaultPayloadParams()
+			payloadParams.Version = int(payloadVersion)
+			transport = NewPayloadTransport(transport, job, NewRedisQueueBackend(rdb), payloadParams)
+			if recorder != nil {
+				transport = NewRecordingTransport(transport, baseJob, recorder)
+			}
+			return NewEngineWithTransport(ctx, job, NewRedisQueueBackend(rdb), transport, params)
+		}
+		inferenceEngine := newEngine(EngineJobNameInference, inferenceSchedulingParams)
+		compilationEngine := newEngine(EngineJobNameCompilation, compilationSchedulingParams)
+		goalCompilationEngine := newEngine(EngineJobNameGoalCompilation, compilationSchedulingParams)
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		ctx, cancel := context.WithCancel(ctx)
@@ -84,6 +145,10 @@ func createOrchestratorStartCli() *cli.Command {
 		}()
 
 		if !viewOnly {
+			if err := rg.OpenEventLog(graphPath); err != nil {
+				return err
+			}
+			defer rg.CloseEventLog()
 			// preserve transient states so I can debug crashes
 			rg.ResetTransientStates()
 			if err := inferenceEngine.Start(ctx); err != nil {
@@ -106,6 +171,8 @@ func createOrchestratorStartCli() *cli.Command {
 			CompilationEngine:     compilationEngine,
 			GoalCompilationEngine: goalCompilationEngine,
 			DoTraining:            doTraining,
+			Namespace:             namespace,
+			AutoCompact:           autoCompact,
 		}
 		orchestrator := NewOrchestrator(ctx, logger, orchestratorParams)
 
@@ -186,6 +253,40 @@ func createOrchestratorStartCli() *cli.Command {
 				Value:       false,
 				Destination: &doTraining,
 			},
+			&cli.DurationFlag{
+				Name:        "target-queue-latency",
+				Usage:       "resize the engine queues from measured throughput so tasks wait about this long for a worker (0 uses the static sizes)",
+				Value:       0,
+				Destination: &targetQueueLatency,
+			},
+			&cli.IntFlag{
+				Name:        "payload-version",
+				Usage:       "how task bodies are encoded for the workers (0 = plain, 1 = gzip with large bodies offloaded to their own keys)",
+				Value:       PayloadVersionGzip,
+				Destination: &payloadVersion,
+			},
+			&cli.StringFlag{
+				Name:        "record-tape",
+				Usage:       "append every task sent to (and result received from) the workers to this JSONL file",
+				Destination: &recordTapePath,
+			},
+			&cli.StringFlag{
+				Name:        "replay-tape",
+				Usage:       "answer tasks with the results recorded in this JSONL file instead of running workers",
+				Destination: &replayTapePath,
+			},
+			&cli.StringFlag{
+				Name:        "replay-out",
+				Usage:       "where the replay saves its copy of the graph (the graph itself is never modified). Defaults to a new file next to it",
+				Destination: &replayOutPath,
+			},
+			&cli.BoolFlag{
+				Name:        "auto-compact",
+				Usage:       "archive the payloads of failed commit graphs before every periodic save (see graph compact)",
+				Value:       false,
+				Destination: &autoCompact,
+			},
+			redisNamespaceFlag(&redisNamespace),
 		},
 	}
 }
@@ -213,9 +314,9 @@ type Orchestrator struct {
 	wg     *sync.WaitGroup
 
 	mu                               sync.Mutex
-	inferenceTaskToNodeLocator       map[EngineTaskID]NodeLocator
-	compilationTaskToNodeLocator     map[EngineTaskID]NodeLocator
-	goalCompilationTaskToNodeLocator map[EngineTaskID]NodeLocator
+	inferenceTaskToNodeLocator       *TaskLocatorTable
+	compilationTaskToNodeLocator     *TaskLocatorTable
+	goalCompilationTaskToNodeLocator *TaskLocatorTable
 	trainingDataMessageList          *MessageList
 }
 type OrchestratorParams struct {
@@ -227,6 +328,10 @@ type OrchestratorParams struct {
 	CompilationEngine     *Engine
 	GoalCompilationEngine *Engine
 	DoTraining            bool
+	// prefix of every redis key the orchestrator touches
+	Namespace RedisNamespace
+	// see RepoGraph.Compact
+	AutoCompact bool
 }
 
 func NewOrchestrator(ctx context.Context, logger *zerolog.Logger, params OrchestratorParams) *Orchestrator {
@@ -237,9 +342,9 @@ func NewOrchestrator(ctx context.Context, logger *zerolog.Logger, params Orchest
 		wg:                               &sync.WaitGroup{},
 		mu:                               sync.Mutex{},
 		trainingDataMessageList:          NewMessageList(),
-		inferenceTaskToNodeLocator:       map[EngineTaskID]NodeLocator{},
-		compilationTaskToNodeLocator:     map[EngineTaskID]NodeLocator{},
-		goalCompilationTaskToNodeLocator: map[EngineTaskID]NodeLocator{},
+		inferenceTaskToNodeLocator:       NewTaskLocatorTable(params.InferenceEngine),
+		compilationTaskToNodeLocator:     NewTaskLocatorTable(params.CompilationEngine),
+		goalCompilationTaskToNodeLocator: NewTaskLocatorTable(params.GoalCompilationEngine),
 	}
 }
 
@@ -248,6 +353,8 @@ func (o *Orchestrator) WaitForStop() {
 }
 
 func (o *Orchestrator) Start() {
+	o.restoreInFlightTasks()
+
 	o.wg.Add(7)
 	go o.startGoalCompilationTx()
 	go o.startGoalCompilationRx()
@@ -264,6 +371,112 @@ func (o *Orchestrator) Start() {
 	}
 }
 
+// restoreInFlightTasks matches tasks that were sent before a restart back to their nodes.
+// The engines must already be started (so they know which tasks survived).
+//
+// ResetTransientStates will have moved these nodes back to awaiting. We move them back to running
+// so they aren't scheduled a second time. Anything the engine doesn't know about stays awaiting & is rescheduled.
+// Tasks whose node can't be restored are cancelled.
+func (o *Orchestrator) restoreInFlightTasks() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	tables := []struct {
+		table        *TaskLocatorTable
+		engine       *Engine
+		runningState NodeState
+	}{
+		{o.goalCompilationTaskToNodeLocator, o.GoalCompilationEngine, NodeStateRunningGoalSetup},
+		{o.inferenceTaskToNodeLocator, o.InferenceEngine, NodeStateRunningInference},
+		{o.compilationTaskToNodeLocator, o.CompilationEngine, NodeStateRunningCompilation},
+	}
+	for _, t := range tables {
+		if err := t.table.Load(o.ctx); err != nil {
+			o.logger.Error().Err(err).Str("job", string(t.engine.job)).Msg("error loading task locator table")
+			continue
+		}
+		numRestored := 0
+		for id, locator := range t.table.All() {
+			if t.engine.HasTask(id) {
+				slice, err := o.RepoGraph.GetNodeSlice(locator)
+				if err == nil && slice.CommitGraphNode.State == TransientNodeStateResetMap[t.runningState] {
+					slice.CommitGraphNode.State = t.runningState
+					o.RepoGraph.recordNodeState(slice)
+					numRestored++
+					continue
+				}
+				// the node is gone or has moved on (e.g. after a snapshot fallback), so it will be rescheduled.
+				// The old task would only hold a worker & its result would be dropped as unmatched.
+				t.engine.Cancel(id)
+			}
+			if err := t.table.Delete(o.ctx, id); err != nil {
+				o.logger.Error().Err(err).Msg("error deleting stale task locator")
+			}
+		}
+		o.logger.Info().Str("job", string(t.engine.job)).Msgf("restored %d in-flight tasks", numRestored)
+	}
+}
+
+// TerminateNode terminates a node (and its descendants) and cancels any of their tasks that are still running.
+// Must be called with o.mu held.
+func (o *Orchestrator) TerminateNode(locator NodeLocator) error {
+	if err := o.RepoGraph.RequestNodeTerminationRecursively(locator, 0); err != nil {
+		return err
+	}
+	o.cancelTerminatedTasks()
+	return nil
+}
+
+// cancelTerminatedTasks cancels the engine tasks of every terminated node so they stop using workers.
+// Must be called with o.mu held.
+func (o *Orchestrator) cancelTerminatedTasks() {
+	tables := []struct {
+		table  *TaskLocatorTable
+		engine *Engine
+	}{
+		{o.goalCompilationTaskToNodeLocator, o.GoalCompilationEngine},
+		{o.inferenceTaskToNodeLocator, o.InferenceEngine},
+		{o.compilationTaskToNodeLocator, o.CompilationEngine},
+	}
+	numCancelled := 0
+	for _, t := range tables {
+		for id, locator := range t.table.All() {
+			slice, err := o.RepoGraph.GetNodeSlice(locator)
+			if err != nil {
+				continue
+			}
+			if slice.CommitGraphNode.State != NodeStateDone || slice.CommitGraphNode.Result != NodeResultTerminated {
+				continue
+			}
+			t.engine.Cancel(id)
+			if err := t.table.Delete(o.ctx, id); err != nil {
+				o.logger.Error().Err(err).Msg("error deleting cancelled task locator")
+			}
+			numCancelled++
+		}
+	}
+	o.logger.Info().Msgf("cancelled %d tasks of terminated nodes", numCancelled)
+}
+
+// Every level of depth outweighs this many minutes of graph age.
+const taskPriorityDepthWeight = 1000
+
+// taskPriorityForNode sends deeper nodes first because they are closest to finishing their graph
+// (and producing training data). Within a depth, older graphs go first so they don't starve.
+func taskPriorityForNode(slice CommitGraphSlice, node *CommitGraphNode) int {
+	ageMinutes := 0
+	if root, ok := slice.CommitGraph.Nodes[slice.CommitGraph.RootNode]; ok {
+		ageMinutes = int(time.Since(root.CreatedAt).Minutes())
+	}
+	return node.Depth*taskPriorityDepthWeight + min(ageMinutes, taskPriorityDepthWeight-1)
+}
+
+// sortByPriority sorts highest priority first (stable so equal priorities stay in order).
+func sortByPriority(msgs []EngineTaskMsg) {
+	slices.SortStableFunc(msgs, func(a, b EngineTaskMsg) int {
+		return b.Priority - a.Priority
+	})
+}
+
 // Due to architectural complexity I am using polling here
 // It would be better to have a channel that gets pushed to when a graph is finished
 func (o *Orchestrator) startGoalCompilationTx() {
@@ -313,6 +526,7 @@ func (o *Orchestrator) startGoalCompilationTx() {
 				cg := NewCommitGraph(goal.ID())
 				cg.Nodes[cg.RootNode].State = NodeStateRunningGoalSetup
 				bt.Subgraphs[goal.ID()] = cg
+				o.RepoGraph.recordCommitGraphCreated(CommitGraphSlice{BranchTarget: bt, CommitGraph: cg})
 				locator := NodeLocator{
 					CommitGraphLocator: CommitGraphLocator{
 						BranchTargetLocator: BranchTargetLocator{
@@ -327,7 +541,9 @@ func (o *Orchestrator) startGoalCompilationTx() {
 					ID:   NewEngineTaskID(),
 					Task: validation.ToJSON(),
 				}
-				o.goalCompilationTaskToNodeLocator[task.ID] = locator
+				if err := o.goalCompilationTaskToNodeLocator.Set(o.ctx, task.ID, locator); err != nil {
+					o.logger.Error().Err(err).Msg("error persisting goal compilation task locator")
+				}
 				return &task
 			}()
 			if toAdd != nil {
@@ -358,16 +574,26 @@ func (o *Orchestrator) startGoalCompilationRx() {
 			func() {
 				o.mu.Lock()
 				defer o.mu.Unlock()
-				locator, ok := o.goalCompilationTaskToNodeLocator[val.ID]
+				locator, ok := o.goalCompilationTaskToNodeLocator.Get(val.ID)
 				if !ok {
-					o.logger.Fatal().Msg("goal compilation output reader is missing locator for task ID")
+					// most likely a task from before a restart whose node was rescheduled
+					o.logger.Warn().Str("task_id", string(val.ID)).Msg("goal compilation output reader is missing locator for task ID. Dropping result")
+					return
+				}
+				var err error
+				if val.EngineError != "" {
+					o.logger.Error().Str("task_id", string(val.ID)).Msgf("goal compilation task failed in the engine: %s", val.EngineError)
+					err = o.RepoGraph.HandleInfrastructureFailure(locator)
+				} else {
+					response := CompilationTaskResponseFromJSON(val.Result)
+					err = o.RepoGraph.HandleSetupCompilationOutput(o.logger, locator, &response, o.GoalProvider)
 				}
-				response := CompilationTaskResponseFromJSON(val.Result)
-				err := o.RepoGraph.HandleSetupCompilationOutput(o.logger, locator, &response, o.GoalProvider)
 				if err != nil {
 					o.logger.Fatal().Err(err).Msg("error handling goal compilation output")
 				}
-				delete(o.goalCompilationTaskToNodeLocator, val.ID)
+				if err := o.goalCompilationTaskToNodeLocator.Delete(o.ctx, val.ID); err != nil {
+					o.logger.Error().Err(err).Msg("error deleting goal compilation task locator")
+				}
 			}()
 		}
 	}
@@ -411,14 +637,19 @@ func (o *Orchestrator) startInferenceTx() {
 							o.logger.Fatal().Err(err).Msg("error building inference task for node")
 						}
 						msg := EngineTaskMsg{
-							ID:   NewEngineTaskID(),
-							Task: inferenceTask.ToJSON(),
+							ID:       NewEngineTaskID(),
+							Task:     inferenceTask.ToJSON(),
+							Priority: taskPriorityForNode(slice, node),
+						}
+						if err := o.inferenceTaskToNodeLocator.Set(o.ctx, msg.ID, locator); err != nil {
+							o.logger.Error().Err(err).Msg("error persisting inference task locator")
 						}
-						o.inferenceTaskToNodeLocator[msg.ID] = locator
 						node.State = NodeStateRunningInference
+						o.RepoGraph.recordNodeState(NodeSlice{BranchTarget: slice.BranchTarget, CommitGraph: slice.CommitGraph, CommitGraphNode: node})
 						quickQueue = append(quickQueue, msg)
 					}
 				}
+				sortByPriority(quickQueue)
 			}()
 
 			// avoid busy-looping
@@ -451,16 +682,26 @@ func (o *Orchestrator) startInferenceRx() {
 			func() {
 				o.mu.Lock()
 				defer o.mu.Unlock()
-				locator, ok := o.inferenceTaskToNodeLocator[val.ID]
+				locator, ok := o.inferenceTaskToNodeLocator.Get(val.ID)
 				if !ok {
-					o.logger.Fatal().Msg("inference output reader is missing locator for task ID")
+					// most likely a task from before a restart whose node was rescheduled
+					o.logger.Warn().Str("task_id", string(val.ID)).Msg("inference output reader is missing locator for task ID. Dropping result")
+					return
+				}
+				var err error
+				if val.EngineError != "" {
+					o.logger.Error().Str("task_id", string(val.ID)).Msgf("inference task failed in the engine: %s", val.EngineError)
+					err = o.RepoGraph.HandleInfrastructureFailure(locator)
+				} else {
+					response := InferenceTaskResponseFromJSON(val.Result)
+					err = o.RepoGraph.HandleInferenceOutput(locator, response)
 				}
-				response := InferenceTaskResponseFromJSON(val.Result)
-				err := o.RepoGraph.HandleInferenceOutput(locator, response)
 				if err != nil {
 					o.logger.Fatal().Err(err).Msg("error handling inference output")
 				}
-				delete(o.inferenceTaskToNodeLocator, val.ID)
+				if err := o.inferenceTaskToNodeLocator.Delete(o.ctx, val.ID); err != nil {
+					o.logger.Error().Err(err).Msg("error deleting inference task locator")
+				}
 			}()
 		}
 	}
@@ -504,14 +745,19 @@ func (o *Orchestrator) startCompilationTx() {
 							o.logger.Fatal().Err(err).Msg("error building compilation tasks for node")
 						}
 						msg := EngineTaskMsg{
-							ID:   NewEngineTaskID(),
-							Task: compilationTask.ToJSON(),
+							ID:       NewEngineTaskID(),
+							Task:     compilationTask.ToJSON(),
+							Priority: taskPriorityForNode(slice, node),
+						}
+						if err := o.compilationTaskToNodeLocator.Set(o.ctx, msg.ID, locator); err != nil {
+							o.logger.Error().Err(err).Msg("error persisting compilation task locator")
 						}
-						o.compilationTaskToNodeLocator[msg.ID] = locator
 						node.State = NodeStateRunningCompilation
+						o.RepoGraph.recordNodeState(NodeSlice{BranchTarget: slice.BranchTarget, CommitGraph: slice.CommitGraph, CommitGraphNode: node})
 						quickQueue = append(quickQueue, msg)
 					}
 				}
+				sortByPriority(quickQueue)
 			}()
 
 			// avoid busy-looping
@@ -544,16 +790,26 @@ func (o *Orchestrator) startCompilationRx() {
 			func() {
 				o.mu.Lock()
 				defer o.mu.Unlock()
-				locator, ok := o.compilationTaskToNodeLocator[val.ID]
+				locator, ok := o.compilationTaskToNodeLocator.Get(val.ID)
 				if !ok {
-					o.logger.Fatal().Msg("compilation output reader is missing locator for task ID")
+					// most likely a task from before a restart whose node was rescheduled
+					o.logger.Warn().Str("task_id", string(val.ID)).Msg("compilation output reader is missing locator for task ID. Dropping result")
+					return
+				}
+				var err error
+				if val.EngineError != "" {
+					o.logger.Error().Str("task_id", string(val.ID)).Msgf("compilation task failed in the engine: %s", val.EngineError)
+					err = o.RepoGraph.HandleInfrastructureFailure(locator)
+				} else {
+					response := CompilationTaskResponseFromJSON(val.Result)
+					err = o.RepoGraph.HandleCompilationOutput(locator, &response, MaxCommitGraphDepth, o.GoalProvider)
 				}
-				response := CompilationTaskResponseFromJSON(val.Result)
-				err := o.RepoGraph.HandleCompilationOutput(locator, &response, MaxCommitGraphDepth, o.GoalProvider)
 				if err != nil {
 					o.logger.Fatal().Err(err).Msg("error handling compilation output")
 				}
-				delete(o.compilationTaskToNodeLocator, val.ID)
+				if err := o.compilationTaskToNodeLocator.Delete(o.ctx, val.ID); err != nil {
+					o.logger.Error().Err(err).Msg("error deleting compilation task locator")
+				}
 			}()
 		}
 	}
@@ -600,7 +856,7 @@ func (o *Orchestrator) startTrainingTx() {
 					Advantage: output.Advantage,
 				})
 			}
-			err = o.trainingDataMessageList.AddAdvertisement(o.ctx, o.Rdb, RedisTrainingAdvList, string(tgid), group)
+			err = o.trainingDataMessageList.AddAdvertisement(o.ctx, o.Rdb, o.Namespace.Key(RedisTrainingAdvList), string(tgid), group)
 			if err != nil {
 				// maybe this shouldn't be fatal
 				o.logger.Fatal().Err(err).Msg("error adding advertisement")
@@ -641,7 +897,7 @@ func (o *Orchestrator) startTrainingRx() {
 			return
 		default:
 		}
-		request, err := ReadNextTrainingRequest(o.ctx, o.Rdb)
+		request, err := ReadNextTrainingRequest(o.ctx, o.Rdb, o.Namespace)
 		if err != nil {
 			o.logger.Error().Err(err).Msg("error reading next training request")
 			continue
@@ -651,23 +907,52 @@ func (o *Orchestrator) startTrainingRx() {
 			o.logger.Error().Str("request", string(request)).Msg("error getting training data group")
 			continue
 		}
-		err = o.Rdb.LPush(o.ctx, RedisTrainingTxChan, group).Err()
+		err = o.Rdb.LPush(o.ctx, o.Namespace.Key(RedisTrainingTxChan), group).Err()
 		if err != nil {
 			o.logger.Fatal().Err(err).Msg("error sending training data group")
 		}
 	}
 }
 
+// compactGraph archives the payloads of failed commit graphs (see RepoGraph.Compact).
+// The archive is written without holding the lock.
+func (o *Orchestrator) compactGraph() {
+	o.mu.Lock()
+	compaction := o.RepoGraph.PrepareCompaction()
+	o.mu.Unlock()
+	writeErr := compaction.Write(NewGraphArchive(o.GraphPath))
+	o.mu.Lock()
+	archived, err := o.RepoGraph.ApplyCompaction(compaction)
+	o.mu.Unlock()
+	if err := errors.Join(writeErr, err); err != nil {
+		o.logger.Error().Err(err).Msg("error compacting graph")
+	}
+	if archived > 0 {
+		o.logger.Info().Msgf("archived the payloads of %d nodes", archived)
+	}
+}
+
 func (o *Orchestrator) startGraphPeriodicSave() {
 	defer o.wg.Done()
 	for {
 		select {
 		case <-o.ctx.Done():
 			return
-		case <-time.After(1 * time.Minute):
+		// crashes lose nothing (see GraphEventLog). Snapshots just keep the log short.
+		case <-time.After(10 * time.Minute):
 		}
 		o.logger.Info().Msg("periodic saving graph to file")
-		if err := o.RepoGraph.SaveToFile(o.GraphPath); err != nil {
+		if o.AutoCompact {
+			o.compactGraph()
+		}
+		// only copying the graph has to hold the lock. Every mutation in between is in the event log.
+		o.mu.Lock()
+		write, err := o.RepoGraph.PrepareSave(o.GraphPath)
+		o.mu.Unlock()
+		if err == nil {
+			err = write()
+		}
+		if err != nil {
 			o.logger.Error().Err(err).Msg("error saving graph to file")
 		}
 	}
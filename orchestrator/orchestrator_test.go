@@ -0,0 +1,164 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestOrchestrator starts the engines of an orchestrator over queue. Its loops are left to the test.
+// stop stops the engines (like a restart would).
+func startTestOrchestrator(t *testing.T, queue QueueBackend, rg *RepoGraph, params SchedulingParams) (o *Orchestrator, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	engines := []*Engine{}
+	for _, job := range []EngineJobName{EngineJobNameGoalCompilation, EngineJobNameInference, EngineJobNameCompilation} {
+		engine := NewEngine(ctx, job, queue, params)
+		require.NoError(t, engine.Start(ctx))
+		engines = append(engines, engine)
+	}
+	logger := zerolog.Nop()
+	o = NewOrchestrator(ctx, &logger, OrchestratorParams{
+		RepoGraph:             rg,
+		GoalCompilationEngine: engines[0],
+		InferenceEngine:       engines[1],
+		CompilationEngine:     engines[2],
+	})
+	stop = func() {
+		cancel()
+		o.WaitForStop()
+		for _, engine := range engines {
+			engine.TriggerStop()
+			engine.WaitForStop()
+		}
+	}
+	return o, stop
+}
+
+// newTestInferenceTask sends an inference task for node like startInferenceTx does.
+func newTestInferenceTask(t *testing.T, o *Orchestrator, node NodeLocator) EngineTaskID {
+	o.mu.Lock()
+	slice, err := o.RepoGraph.GetNodeSlice(node)
+	require.NoError(t, err)
+	slice.CommitGraphNode.State = NodeStateRunningInference
+	msg := EngineTaskMsg{ID: NewEngineTaskID(), Task: "inference task"}
+	require.NoError(t, o.inferenceTaskToNodeLocator.Set(o.ctx, msg.ID, node))
+	o.mu.Unlock()
+	o.InferenceEngine.GetInput() <- msg
+	return msg.ID
+}
+
+func testInferenceResult(t *testing.T, sequences ...string) string {
+	result, err := json.Marshal(InferenceTaskResponse{ReturnSequences: sequences})
+	require.NoError(t, err)
+	return string(result)
+}
+
+func TestOrchestrator_RestoresInFlightTasksAfterRestart(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	params := testSchedulingParams(time.Hour)
+	params.PersistInFlight = true
+	rg, _, cg, _, child := newTestCommitGraph(t)
+	cg.State = GraphStateInProgress
+
+	first, stopFirst := startTestOrchestrator(t, queue, rg, params)
+	id := newTestInferenceTask(t, first, child)
+	require.Equal(t, id, testWorkerPop(t, first.InferenceEngine, queue).ID)
+	stopFirst()
+	rg.ResetTransientStates()
+	require.Equal(t, NodeStateAwaitingInference, cg.Nodes[child.NodeID].State)
+
+	second, stopSecond := startTestOrchestrator(t, queue, rg, params)
+	t.Cleanup(stopSecond)
+	second.restoreInFlightTasks()
+	require.Equal(t, NodeStateRunningInference, cg.Nodes[child.NodeID].State)
+	locator, ok := second.inferenceTaskToNodeLocator.Get(id)
+	require.True(t, ok)
+	require.Equal(t, child, locator)
+
+	second.wg.Add(1)
+	go second.startInferenceRx()
+	testWorkerPushResult(t, second.InferenceEngine, queue, id, testInferenceResult(t, "after the restart"))
+	require.Eventually(t, func() bool {
+		second.mu.Lock()
+		defer second.mu.Unlock()
+		_, ok := second.inferenceTaskToNodeLocator.Get(id)
+		return !ok
+	}, 2*time.Second, 5*time.Millisecond)
+	second.mu.Lock()
+	defer second.mu.Unlock()
+	require.Equal(t, NodeStateDone, cg.Nodes[child.NodeID].State)
+	require.Len(t, cg.Nodes[child.NodeID].Children, 1)
+}
+
+func TestOrchestrator_DropsLocatorsWithoutPersistInFlight(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	params := testSchedulingParams(time.Hour)
+	rg, _, cg, _, child := newTestCommitGraph(t)
+	cg.State = GraphStateInProgress
+
+	first, stopFirst := startTestOrchestrator(t, queue, rg, params)
+	id := newTestInferenceTask(t, first, child)
+	testWorkerPop(t, first.InferenceEngine, queue)
+	stopFirst()
+	rg.ResetTransientStates()
+
+	second, stopSecond := startTestOrchestrator(t, queue, rg, params)
+	t.Cleanup(stopSecond)
+	locators, err := queue.HGetAll(context.Background(), EngineJobNameInference.LocatorTableName())
+	require.NoError(t, err)
+	require.Empty(t, locators)
+	second.restoreInFlightTasks()
+	_, ok := second.inferenceTaskToNodeLocator.Get(id)
+	require.False(t, ok)
+	// rescheduled by startInferenceTx
+	require.Equal(t, NodeStateAwaitingInference, cg.Nodes[child.NodeID].State)
+}
+
+func TestOrchestrator_TerminateNodeCancelsItsTasks(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	rg, _, cg, root, child := newTestCommitGraph(t)
+	cg.State = GraphStateInProgress
+	sibling, err := rg.AddNodeToCommitGraph(root, "also not parsable", NodeMetadata{})
+	require.NoError(t, err)
+	o, stop := startTestOrchestrator(t, queue, rg, testSchedulingParams(time.Hour))
+	t.Cleanup(stop)
+	ctx := context.Background()
+
+	pickedUp := newTestInferenceTask(t, o, child)
+	require.Equal(t, pickedUp, testWorkerPop(t, o.InferenceEngine, queue).ID)
+	queued := newTestInferenceTask(t, o, sibling)
+	require.Eventually(t, func() bool {
+		n, err := queue.PriorityLen(ctx, o.InferenceEngine.TasksQueueName())
+		return err == nil && n == 1
+	}, 2*time.Second, 5*time.Millisecond)
+
+	o.mu.Lock()
+	require.NoError(t, o.TerminateNode(root))
+	require.Empty(t, o.inferenceTaskToNodeLocator.All())
+	o.mu.Unlock()
+	require.Eventually(t, func() bool {
+		return !o.InferenceEngine.HasTask(pickedUp) && !o.InferenceEngine.HasTask(queued)
+	}, 2*time.Second, 5*time.Millisecond)
+
+	n, err := queue.PriorityLen(ctx, o.InferenceEngine.TasksQueueName())
+	require.NoError(t, err)
+	require.Zero(t, n)
+	cancelled, err := queue.HExists(ctx, o.InferenceEngine.CancelledTableName(), string(pickedUp))
+	require.NoError(t, err)
+	require.True(t, cancelled)
+
+	// a worker that finishes anyway (instead of dropping the task) must not reach the graph
+	testWorkerPushResult(t, o.InferenceEngine, queue, pickedUp, testInferenceResult(t, "too late"))
+	select {
+	case result := <-o.InferenceEngine.GetOutput():
+		t.Fatalf("unexpected result for cancelled task %s", result.ID)
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.Equal(t, NodeResultTerminated, cg.Nodes[child.NodeID].Result)
+	require.Equal(t, NodeResultTerminated, cg.Nodes[sibling.NodeID].Result)
+	require.Empty(t, cg.Nodes[child.NodeID].Children)
+}
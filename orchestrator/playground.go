@@ -76,6 +76,7 @@ func playgroundEngineStartupTestCli() *cli.Command {
 		if err != nil {
 			return err
 		}
+		ns := RedisNamespaceFromEnv()
 		schedulingParams := SchedulingParams{
 			MinTaskQueueSize:      10,
 			MaxTaskQueueSize:      100,
@@ -87,7 +88,7 @@ func playgroundEngineStartupTestCli() *cli.Command {
 			InputChanSize:         100,
 			OutputChanSize:        100,
 		}
-		engine := NewEngine(c, EngineJobNameTest, rdb, schedulingParams)
+		engine := NewEngine(c, ns.Job(EngineJobNameTest), NewRedisQueueBackend(rdb), schedulingParams)
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		go func() {
@@ -116,13 +117,14 @@ func playgroundEngineSimpleInferenceTestCli() *cli.Command {
 		if err != nil {
 			return err
 		}
-		if err := setRouterParam(c, rdb, RedisInferenceEnabled, "true"); err != nil {
+		ns := RedisNamespaceFromEnv()
+		if err := setRouterParam(c, rdb, ns, RedisInferenceEnabled, "true"); err != nil {
 			return err
 		}
-		if err := setRouterParam(c, rdb, RedisInferenceBaseModel, "meta-llama/Llama-3.1-8B-Instruct"); err != nil {
+		if err := setRouterParam(c, rdb, ns, RedisInferenceBaseModel, "meta-llama/Llama-3.1-8B-Instruct"); err != nil {
 			return err
 		}
-		if err := setRouterParam(c, rdb, RedisInferenceAdapter, ""); err != nil {
+		if err := setRouterParam(c, rdb, ns, RedisInferenceAdapter, ""); err != nil {
 			return err
 		}
 		schedulingParams := SchedulingParams{
@@ -136,7 +138,7 @@ func playgroundEngineSimpleInferenceTestCli() *cli.Command {
 			InputChanSize:         10,
 			OutputChanSize:        10,
 		}
-		engine := NewEngine(c, EngineJobNameInference, rdb, schedulingParams)
+		engine := NewEngine(c, ns.Job(EngineJobNameInference), NewRedisQueueBackend(rdb), schedulingParams)
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		go func() {
@@ -205,6 +207,7 @@ func playgroundEngineSimpleCompilationTestCli() *cli.Command {
 		if err != nil {
 			return err
 		}
+		ns := RedisNamespaceFromEnv()
 		schedulingParams := SchedulingParams{
 			MinTaskQueueSize:      10,
 			MaxTaskQueueSize:      100,
@@ -216,7 +219,7 @@ func playgroundEngineSimpleCompilationTestCli() *cli.Command {
 			InputChanSize:         10,
 			OutputChanSize:        10,
 		}
-		engine := NewEngine(c, EngineJobNameCompilation, rdb, schedulingParams)
+		engine := NewEngine(c, ns.Job(EngineJobNameCompilation), NewRedisQueueBackend(rdb), schedulingParams)
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		go func() {
@@ -312,10 +315,11 @@ func playgroundGRPOLoopTestCli() *cli.Command {
 		if err != nil {
 			return err
 		}
-		rdb.Del(c, RedisTrainingAdvList)
-		rdb.Set(c, string(RedisInferenceAdapter), "pissa_init", 0)
-		rdb.Set(c, string(RedisInferenceEnabled), "true", 0)
-		rdb.Set(c, string(RedisTrainingAdapter), "pissa_init", 0)
+		ns := RedisNamespaceFromEnv()
+		rdb.Del(c, ns.Key(RedisTrainingAdvList))
+		rdb.Set(c, ns.RouterKey(RedisInferenceAdapter), "pissa_init", 0)
+		rdb.Set(c, ns.RouterKey(RedisInferenceEnabled), "true", 0)
+		rdb.Set(c, ns.RouterKey(RedisTrainingAdapter), "pissa_init", 0)
 		inferenceSchedulingParams := SchedulingParams{
 			MinTaskQueueSize:      4,
 			MaxTaskQueueSize:      8,
@@ -328,23 +332,23 @@ func playgroundGRPOLoopTestCli() *cli.Command {
 			OutputChanSize:        8,
 			DisableBackpressure:   true,
 		}
-		err = rdb.Set(c, string(RedisInferenceEnabled), "true", 0).Err()
+		err = rdb.Set(c, ns.RouterKey(RedisInferenceEnabled), "true", 0).Err()
 		if err != nil {
 			return err
 		}
-		err = rdb.Set(c, string(RedisTrainingAdapter), "pissa_init", 0).Err()
+		err = rdb.Set(c, ns.RouterKey(RedisTrainingAdapter), "pissa_init", 0).Err()
 		if err != nil {
 			return err
 		}
-		err = rdb.Set(c, string(RedisInferenceAdapter), "pissa_init", 0).Err()
+		err = rdb.Set(c, ns.RouterKey(RedisInferenceAdapter), "pissa_init", 0).Err()
 		if err != nil {
 			return err
 		}
-		err = DropTrainingChans(c, rdb)
+		err = DropTrainingChans(c, rdb, ns)
 		if err != nil {
 			return err
 		}
-		inferenceEngine := NewEngine(c, EngineJobNameInference, rdb, inferenceSchedulingParams)
+		inferenceEngine := NewEngine(c, ns.Job(EngineJobNameInference), NewRedisQueueBackend(rdb), inferenceSchedulingParams)
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		go func() {
@@ -450,12 +454,12 @@ func playgroundGRPOLoopTestCli() *cli.Command {
 					})
 				}
 				logger.Info().Msgf("training data: %+v", data)
-				err = messageList.AddAdvertisement(c, rdb, RedisTrainingAdvList, string(groupID), data)
+				err = messageList.AddAdvertisement(c, rdb, ns.Key(RedisTrainingAdvList), string(groupID), data)
 				if err != nil {
 					return err
 				}
 			}
-			err = rdb.Set(c, string(RedisInferenceEnabled), "false", 0).Err()
+			err = rdb.Set(c, ns.RouterKey(RedisInferenceEnabled), "false", 0).Err()
 			if err != nil {
 				return err
 			}
@@ -467,7 +471,7 @@ func playgroundGRPOLoopTestCli() *cli.Command {
 					return nil
 				default:
 				}
-				request, err := ReadNextTrainingRequest(c, rdb)
+				request, err := ReadNextTrainingRequest(c, rdb, ns)
 				if err != nil {
 					logger.Warn().Err(err).Msg("error reading next training request")
 					continue
@@ -478,7 +482,7 @@ func playgroundGRPOLoopTestCli() *cli.Command {
 					return fmt.Errorf("group not found")
 				}
 				logger.Info().Msgf("group: %+v", group)
-				err = rdb.LPush(c, RedisTrainingTxChan, group).Err()
+				err = rdb.LPush(c, ns.Key(RedisTrainingTxChan), group).Err()
 				if err != nil {
 					return err
 				}
@@ -494,7 +498,7 @@ func playgroundGRPOLoopTestCli() *cli.Command {
 					return nil
 				default:
 				}
-				enabled, err := rdb.Get(c, string(RedisInferenceEnabled)).Result()
+				enabled, err := rdb.Get(c, ns.RouterKey(RedisInferenceEnabled)).Result()
 				if err != nil {
 					return err
 				}
@@ -0,0 +1,508 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrQueueEmpty is returned by a QueueBackend when a pop finds nothing to return
+// (or a blocking pop times out).
+var ErrQueueEmpty = errors.New("queue empty")
+
+// QueueBackend is the minimal set of list (& hash & key) operations the engine (and its workers) need.
+// Lists are pushed on the left and popped from the right (FIFO), mirroring the redis commands of the same name.
+type QueueBackend interface {
+	// LPush returns the length of the queue after the push.
+	LPush(ctx context.Context, queue string, value string) (int64, error)
+	// RPop returns ErrQueueEmpty if the queue is empty.
+	RPop(ctx context.Context, queue string) (string, error)
+	LLen(ctx context.Context, queue string) (int64, error)
+	Del(ctx context.Context, queues ...string) error
+	// LRem removes every element of queue equal to value and returns how many were removed.
+	LRem(ctx context.Context, queue string, value string) (int64, error)
+
+	// Priority queues are split into one list per priority (see PriorityBandName). Each band is FIFO
+	// and higher priority bands are always popped first.
+	//
+	// PriorityPush returns the number of elements across all bands after the push.
+	PriorityPush(ctx context.Context, queue string, priority int, value string) (int64, error)
+	PriorityLen(ctx context.Context, queue string) (int64, error)
+	// PriorityRem removes every element of the band equal to value and returns how many were removed.
+	PriorityRem(ctx context.Context, queue string, priority int, value string) (int64, error)
+	PriorityDel(ctx context.Context, queue string) error
+	// BPriorityPopLPush atomically moves the oldest element of the highest priority band of source onto destination and returns it.
+	// Blocks for up to timeout and returns ErrQueueEmpty if nothing arrived.
+	BPriorityPopLPush(ctx context.Context, source string, destination string, timeout time.Duration) (string, error)
+
+	HSet(ctx context.Context, key string, field string, value string) error
+	HDel(ctx context.Context, key string, fields ...string) error
+	HGetAll(ctx context.Context, key string) (map[string]string, error)
+	HExists(ctx context.Context, key string, field string) (bool, error)
+
+	// Get returns ErrQueueEmpty if the key doesn't exist (or has expired).
+	Get(ctx context.Context, key string) (string, error)
+	// SetNX sets key to value with a ttl only if it doesn't exist. Returns true if it was set.
+	SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error)
+	// CompareAndExpire resets the ttl of key only if it is still set to value. Returns true if it was.
+	CompareAndExpire(ctx context.Context, key string, value string, ttl time.Duration) (bool, error)
+	// CompareAndDelete deletes key only if it is still set to value. Returns true if it was.
+	CompareAndDelete(ctx context.Context, key string, value string) (bool, error)
+}
+
+// PriorityBandName is the list holding the elements of queue pushed with priority.
+// In redis, queue itself is a sorted set of the priorities that may have a non-empty band (member & score are the priority).
+func PriorityBandName(queue string, priority int) string {
+	return fmt.Sprintf("%s:%d", queue, priority)
+}
+
+type RedisQueueBackend struct {
+	rdb *redis.Client
+}
+
+var _ QueueBackend = &RedisQueueBackend{}
+
+func NewRedisQueueBackend(rdb *redis.Client) *RedisQueueBackend {
+	return &RedisQueueBackend{rdb: rdb}
+}
+
+func (b *RedisQueueBackend) LPush(ctx context.Context, queue string, value string) (int64, error) {
+	return b.rdb.LPush(ctx, queue, value).Result()
+}
+
+func (b *RedisQueueBackend) RPop(ctx context.Context, queue string) (string, error) {
+	val, err := b.rdb.RPop(ctx, queue).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrQueueEmpty
+	}
+	return val, err
+}
+
+func (b *RedisQueueBackend) LLen(ctx context.Context, queue string) (int64, error) {
+	return b.rdb.LLen(ctx, queue).Result()
+}
+
+func (b *RedisQueueBackend) Del(ctx context.Context, queues ...string) error {
+	return b.rdb.Del(ctx, queues...).Err()
+}
+
+func (b *RedisQueueBackend) LRem(ctx context.Context, queue string, value string) (int64, error) {
+	return b.rdb.LRem(ctx, queue, 0, value).Result()
+}
+
+// keep in sync with PriorityBandName
+const priorityLenLua = `
+local total = 0
+for _, band in ipairs(redis.call("ZRANGE", KEYS[1], 0, -1)) do
+	total = total + redis.call("LLEN", KEYS[1] .. ":" .. band)
+end
+return total`
+
+var priorityPushScript = redis.NewScript(`
+redis.call("LPUSH", KEYS[1] .. ":" .. ARGV[1], ARGV[2])
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[1])` + priorityLenLua)
+
+var priorityLenScript = redis.NewScript(priorityLenLua)
+
+var priorityRemScript = redis.NewScript(`
+local band = KEYS[1] .. ":" .. ARGV[1]
+local removed = redis.call("LREM", band, 0, ARGV[2])
+if redis.call("LLEN", band) == 0 then
+	redis.call("ZREM", KEYS[1], ARGV[1])
+end
+return removed`)
+
+var priorityDelScript = redis.NewScript(`
+for _, band in ipairs(redis.call("ZRANGE", KEYS[1], 0, -1)) do
+	redis.call("DEL", KEYS[1] .. ":" .. band)
+end
+return redis.call("DEL", KEYS[1])`)
+
+// The workers in compilation/ & inference/ run a copy of this script.
+var priorityPopLPushScript = redis.NewScript(`
+while true do
+	local top = redis.call("ZREVRANGE", KEYS[1], 0, 0)
+	if not top[1] then
+		return false
+	end
+	local band = KEYS[1] .. ":" .. top[1]
+	local val = redis.call("RPOPLPUSH", band, KEYS[2])
+	if redis.call("LLEN", band) == 0 then
+		redis.call("ZREM", KEYS[1], top[1])
+	end
+	if val then
+		return val
+	end
+end`)
+
+// redis can't block inside a script, so BPriorityPopLPush polls this often until its timeout.
+const priorityPopPollInterval = 100 * time.Millisecond
+
+func (b *RedisQueueBackend) PriorityPush(ctx context.Context, queue string, priority int, value string) (int64, error) {
+	return priorityPushScript.Run(ctx, b.rdb, []string{queue}, priority, value).Int64()
+}
+
+func (b *RedisQueueBackend) PriorityLen(ctx context.Context, queue string) (int64, error) {
+	return priorityLenScript.Run(ctx, b.rdb, []string{queue}).Int64()
+}
+
+func (b *RedisQueueBackend) PriorityRem(ctx context.Context, queue string, priority int, value string) (int64, error) {
+	return priorityRemScript.Run(ctx, b.rdb, []string{queue}, priority, value).Int64()
+}
+
+func (b *RedisQueueBackend) PriorityDel(ctx context.Context, queue string) error {
+	return priorityDelScript.Run(ctx, b.rdb, []string{queue}).Err()
+}
+
+func (b *RedisQueueBackend) BPriorityPopLPush(ctx context.Context, source string, destination string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		val, err := priorityPopLPushScript.Run(ctx, b.rdb, []string{source, destination}).Text()
+		if err == nil {
+			return val, nil
+		}
+		if !errors.Is(err, redis.Nil) {
+			return "", err
+		}
+		if !time.Now().Before(deadline) {
+			return "", ErrQueueEmpty
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(min(priorityPopPollInterval, time.Until(deadline))):
+		}
+	}
+}
+
+func (b *RedisQueueBackend) HSet(ctx context.Context, key string, field string, value string) error {
+	return b.rdb.HSet(ctx, key, field, value).Err()
+}
+
+func (b *RedisQueueBackend) HDel(ctx context.Context, key string, fields ...string) error {
+	return b.rdb.HDel(ctx, key, fields...).Err()
+}
+
+func (b *RedisQueueBackend) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return b.rdb.HGetAll(ctx, key).Result()
+}
+
+func (b *RedisQueueBackend) HExists(ctx context.Context, key string, field string) (bool, error) {
+	return b.rdb.HExists(ctx, key, field).Result()
+}
+
+func (b *RedisQueueBackend) Get(ctx context.Context, key string) (string, error) {
+	val, err := b.rdb.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrQueueEmpty
+	}
+	return val, err
+}
+
+func (b *RedisQueueBackend) SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	return b.rdb.SetNX(ctx, key, value, ttl).Result()
+}
+
+var compareAndExpireScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+func (b *RedisQueueBackend) CompareAndExpire(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	res, err := compareAndExpireScript.Run(ctx, b.rdb, []string{key}, value, ttl.Milliseconds()).Int()
+	return res == 1, err
+}
+
+var compareAndDeleteScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+func (b *RedisQueueBackend) CompareAndDelete(ctx context.Context, key string, value string) (bool, error) {
+	res, err := compareAndDeleteScript.Run(ctx, b.rdb, []string{key}, value).Int()
+	return res == 1, err
+}
+
+// MemoryQueueBackend is an in-process QueueBackend.
+// It is useful for tests & for running the engine without a redis server.
+type MemoryQueueBackend struct {
+	mu sync.Mutex
+	// index 0 is the left (most recently pushed) end
+	queues map[string][]string
+	// queue -> priority -> band (index 0 is the left end)
+	priorities map[string]map[int][]string
+	hashes     map[string]map[string]string
+	values     map[string]memoryValue
+	// closed & replaced on every push to wake up blocked poppers
+	pushed chan struct{}
+}
+
+var _ QueueBackend = &MemoryQueueBackend{}
+
+func NewMemoryQueueBackend() *MemoryQueueBackend {
+	return &MemoryQueueBackend{
+		queues:     map[string][]string{},
+		priorities: map[string]map[int][]string{},
+		hashes:     map[string]map[string]string{},
+		values:     map[string]memoryValue{},
+		pushed:     make(chan struct{}),
+	}
+}
+
+func (b *MemoryQueueBackend) LPush(ctx context.Context, queue string, value string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queues[queue] = append([]string{value}, b.queues[queue]...)
+	close(b.pushed)
+	b.pushed = make(chan struct{})
+	return int64(len(b.queues[queue])), nil
+}
+
+func (b *MemoryQueueBackend) RPop(ctx context.Context, queue string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rpopLocked(queue)
+}
+
+func (b *MemoryQueueBackend) rpopLocked(queue string) (string, error) {
+	q := b.queues[queue]
+	if len(q) == 0 {
+		return "", ErrQueueEmpty
+	}
+	val := q[len(q)-1]
+	b.queues[queue] = q[:len(q)-1]
+	return val, nil
+}
+
+func (b *MemoryQueueBackend) LLen(ctx context.Context, queue string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(len(b.queues[queue])), nil
+}
+
+func (b *MemoryQueueBackend) Del(ctx context.Context, queues ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, queue := range queues {
+		delete(b.queues, queue)
+		delete(b.hashes, queue)
+		delete(b.values, queue)
+	}
+	return nil
+}
+
+func (b *MemoryQueueBackend) LRem(ctx context.Context, queue string, value string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := make([]string, 0, len(b.queues[queue]))
+	for _, val := range b.queues[queue] {
+		if val != value {
+			kept = append(kept, val)
+		}
+	}
+	numRemoved := int64(len(b.queues[queue]) - len(kept))
+	b.queues[queue] = kept
+	return numRemoved, nil
+}
+
+func (b *MemoryQueueBackend) PriorityPush(ctx context.Context, queue string, priority int, value string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.priorities[queue]; !ok {
+		b.priorities[queue] = map[int][]string{}
+	}
+	bands := b.priorities[queue]
+	bands[priority] = append([]string{value}, bands[priority]...)
+	close(b.pushed)
+	b.pushed = make(chan struct{})
+	return b.priorityLenLocked(queue), nil
+}
+
+func (b *MemoryQueueBackend) priorityLenLocked(queue string) int64 {
+	total := 0
+	for _, band := range b.priorities[queue] {
+		total += len(band)
+	}
+	return int64(total)
+}
+
+func (b *MemoryQueueBackend) PriorityLen(ctx context.Context, queue string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.priorityLenLocked(queue), nil
+}
+
+func (b *MemoryQueueBackend) PriorityRem(ctx context.Context, queue string, priority int, value string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	band := b.priorities[queue][priority]
+	kept := make([]string, 0, len(band))
+	for _, val := range band {
+		if val != value {
+			kept = append(kept, val)
+		}
+	}
+	numRemoved := int64(len(band) - len(kept))
+	if len(kept) == 0 {
+		delete(b.priorities[queue], priority)
+	} else {
+		b.priorities[queue][priority] = kept
+	}
+	return numRemoved, nil
+}
+
+func (b *MemoryQueueBackend) PriorityDel(ctx context.Context, queue string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.priorities, queue)
+	return nil
+}
+
+// must be called with mu held.
+func (b *MemoryQueueBackend) priorityPopLocked(queue string) (string, error) {
+	bands := b.priorities[queue]
+	if len(bands) == 0 {
+		return "", ErrQueueEmpty
+	}
+	top := 0
+	first := true
+	for priority := range bands {
+		if first || priority > top {
+			top = priority
+			first = false
+		}
+	}
+	band := bands[top]
+	val := band[len(band)-1]
+	if len(band) == 1 {
+		delete(bands, top)
+	} else {
+		bands[top] = band[:len(band)-1]
+	}
+	return val, nil
+}
+
+func (b *MemoryQueueBackend) BPriorityPopLPush(ctx context.Context, source string, destination string, timeout time.Duration) (string, error) {
+	deadline := time.After(timeout)
+	for {
+		b.mu.Lock()
+		val, err := b.priorityPopLocked(source)
+		if err == nil {
+			b.queues[destination] = append([]string{val}, b.queues[destination]...)
+			close(b.pushed)
+			b.pushed = make(chan struct{})
+			b.mu.Unlock()
+			return val, nil
+		}
+		pushed := b.pushed
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-deadline:
+			return "", ErrQueueEmpty
+		case <-pushed:
+		}
+	}
+}
+
+func (b *MemoryQueueBackend) HSet(ctx context.Context, key string, field string, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.hashes[key]; !ok {
+		b.hashes[key] = map[string]string{}
+	}
+	b.hashes[key][field] = value
+	return nil
+}
+
+func (b *MemoryQueueBackend) HDel(ctx context.Context, key string, fields ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, field := range fields {
+		delete(b.hashes[key], field)
+	}
+	return nil
+}
+
+func (b *MemoryQueueBackend) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	all := make(map[string]string, len(b.hashes[key]))
+	for field, value := range b.hashes[key] {
+		all[field] = value
+	}
+	return all, nil
+}
+
+func (b *MemoryQueueBackend) HExists(ctx context.Context, key string, field string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.hashes[key][field]
+	return ok, nil
+}
+
+type memoryValue struct {
+	value     string
+	expiresAt time.Time
+}
+
+// must be called with mu held. Returns false if the key doesn't exist or has expired.
+func (b *MemoryQueueBackend) getLocked(key string) (string, bool) {
+	val, ok := b.values[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(val.expiresAt) {
+		delete(b.values, key)
+		return "", false
+	}
+	return val.value, true
+}
+
+func (b *MemoryQueueBackend) Get(ctx context.Context, key string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	val, ok := b.getLocked(key)
+	if !ok {
+		return "", ErrQueueEmpty
+	}
+	return val, nil
+}
+
+func (b *MemoryQueueBackend) SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.getLocked(key); ok {
+		return false, nil
+	}
+	b.values[key] = memoryValue{value: value, expiresAt: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (b *MemoryQueueBackend) CompareAndExpire(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if current, ok := b.getLocked(key); !ok || current != value {
+		return false, nil
+	}
+	b.values[key] = memoryValue{value: value, expiresAt: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (b *MemoryQueueBackend) CompareAndDelete(ctx context.Context, key string, value string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if current, ok := b.getLocked(key); !ok || current != value {
+		return false, nil
+	}
+	delete(b.values, key)
+	return true, nil
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/urfave/cli/v3"
 )
 
 func ConnectToRedis(ctx context.Context) (*redis.Client, error) {
@@ -28,3 +29,40 @@ func ConnectToRedis(ctx context.Context) (*redis.Client, error) {
 	}
 	return rdb, nil
 }
+
+// RedisNamespace prefixes every key a run touches (engine queues, router params, training chans)
+// so that several runs can share one redis. The empty namespace is the unprefixed keyspace.
+// Workers read the same REDIS_NAMESPACE env var.
+type RedisNamespace string
+
+const RedisNamespaceEnvVar = "REDIS_NAMESPACE"
+
+func RedisNamespaceFromEnv() RedisNamespace {
+	return RedisNamespace(os.Getenv(RedisNamespaceEnvVar))
+}
+
+func (n RedisNamespace) Key(key string) string {
+	if n == "" {
+		return key
+	}
+	return fmt.Sprintf("%s:%s", n, key)
+}
+
+func (n RedisNamespace) RouterKey(key RedisKey) string {
+	return n.Key(string(key))
+}
+
+// Job namespaces an engine. All of the engine's queues & tables are derived from its job name.
+func (n RedisNamespace) Job(job EngineJobName) EngineJobName {
+	return EngineJobName(n.Key(string(job)))
+}
+
+// redisNamespaceFlag lets a command override REDIS_NAMESPACE.
+func redisNamespaceFlag(destination *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "namespace",
+		Usage:       "prefix for every redis key used by this run (empty shares the global keys)",
+		Sources:     cli.EnvVars(RedisNamespaceEnvVar),
+		Destination: destination,
+	}
+}
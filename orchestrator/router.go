@@ -57,8 +57,8 @@ var AllRouterKeys = []RedisKey{
 	RedisExecutionRepoUrl,
 }
 
-func setRouterParam(ctx context.Context, rdb *redis.Client, key RedisKey, val string) error {
-	return rdb.Set(ctx, string(key), val, 0).Err()
+func setRouterParam(ctx context.Context, rdb *redis.Client, ns RedisNamespace, key RedisKey, val string) error {
+	return rdb.Set(ctx, ns.RouterKey(key), val, 0).Err()
 }
 
 func createRouterParamsCli() *cli.Command {
@@ -66,8 +66,10 @@ func createRouterParamsCli() *cli.Command {
 	read := false
 	toSet := ""
 	valToSet := ""
+	redisNamespace := ""
 	action := func(ctx context.Context, _ *cli.Command) error {
 		logger := zerolog.Ctx(ctx)
+		namespace := RedisNamespace(redisNamespace)
 		rdb, err := ConnectToRedis(ctx)
 		if err != nil {
 			return err
@@ -86,7 +88,7 @@ func createRouterParamsCli() *cli.Command {
 			var statusCmd *redis.StatusCmd
 			for _, key := range AllRouterKeys {
 				if string(key) == toSet {
-					statusCmd = rdb.Set(ctx, string(key), valToSet, 0)
+					statusCmd = rdb.Set(ctx, namespace.RouterKey(key), valToSet, 0)
 					break
 				}
 			}
@@ -102,7 +104,7 @@ func createRouterParamsCli() *cli.Command {
 				return errors.New("list with key is not supported")
 			}
 			for _, key := range AllRouterKeys {
-				val, err := rdb.Get(ctx, string(key)).Result()
+				val, err := rdb.Get(ctx, namespace.RouterKey(key)).Result()
 				if err != nil {
 					return fmt.Errorf("error getting %s: %w", key, err)
 				}
@@ -131,6 +133,7 @@ func createRouterParamsCli() *cli.Command {
 				Usage:       "list router params",
 				Destination: &read,
 			},
+			redisNamespaceFlag(&redisNamespace),
 		},
 		ArgsUsage: "[key] [value]",
 		Aliases:   []string{"p"},
@@ -158,7 +161,9 @@ func askForConfirmation(ctx context.Context, msg string) bool {
 }
 
 func createInitializeRouterParamsCli() *cli.Command {
+	redisNamespace := ""
 	action := func(ctx context.Context, _ *cli.Command) error {
+		namespace := RedisNamespace(redisNamespace)
 		if !askForConfirmation(ctx, "Are you sure you want to initialize the params? This will overwrite all existing params.") {
 			return nil
 		}
@@ -188,7 +193,7 @@ func createInitializeRouterParamsCli() *cli.Command {
 			RedisExecutionRepoUrl: os.Getenv("HOSTED_GIT_CONNECTION_STRING") + "zaporter/byb-v1.git",
 		}
 		for key, val := range valsMap {
-			statusCmd := rdb.Set(ctx, string(key), val, 0)
+			statusCmd := rdb.Set(ctx, namespace.RouterKey(key), val, 0)
 			if statusCmd.Err() != nil {
 				return statusCmd.Err()
 			}
@@ -200,6 +205,9 @@ func createInitializeRouterParamsCli() *cli.Command {
 		Name:   "init",
 		Usage:  "initialize router params",
 		Action: action,
+		Flags: []cli.Flag{
+			redisNamespaceFlag(&redisNamespace),
+		},
 	}
 }
 
@@ -0,0 +1,70 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// TaskLocatorTable maps in-flight engine tasks back to the node that produced them.
+// Every write goes through to a hash in the engine's QueueBackend ({job}:locators)
+// so a restarted orchestrator can match results for tasks it sent before the restart.
+//
+// Not thread-safe. The orchestrator guards it with o.mu.
+type TaskLocatorTable struct {
+	queue    QueueBackend
+	key      string
+	locators map[EngineTaskID]NodeLocator
+}
+
+func NewTaskLocatorTable(engine *Engine) *TaskLocatorTable {
+	return &TaskLocatorTable{
+		queue:    engine.Queue(),
+		key:      engine.job.LocatorTableName(),
+		locators: map[EngineTaskID]NodeLocator{},
+	}
+}
+
+// Load replaces the in-memory table with the persisted one.
+func (t *TaskLocatorTable) Load(ctx context.Context) error {
+	persisted, err := t.queue.HGetAll(ctx, t.key)
+	if err != nil {
+		return err
+	}
+	t.locators = make(map[EngineTaskID]NodeLocator, len(persisted))
+	for id, raw := range persisted {
+		var locator NodeLocator
+		if err := json.Unmarshal([]byte(raw), &locator); err != nil {
+			return err
+		}
+		t.locators[EngineTaskID(id)] = locator
+	}
+	return nil
+}
+
+func (t *TaskLocatorTable) Set(ctx context.Context, id EngineTaskID, locator NodeLocator) error {
+	t.locators[id] = locator
+	raw, err := json.Marshal(locator)
+	if err != nil {
+		return err
+	}
+	return t.queue.HSet(ctx, t.key, string(id), string(raw))
+}
+
+func (t *TaskLocatorTable) Get(id EngineTaskID) (NodeLocator, bool) {
+	locator, ok := t.locators[id]
+	return locator, ok
+}
+
+func (t *TaskLocatorTable) Delete(ctx context.Context, id EngineTaskID) error {
+	delete(t.locators, id)
+	return t.queue.HDel(ctx, t.key, string(id))
+}
+
+// All returns a copy of the table.
+func (t *TaskLocatorTable) All() map[EngineTaskID]NodeLocator {
+	all := make(map[EngineTaskID]NodeLocator, len(t.locators))
+	for id, locator := range t.locators {
+		all[id] = locator
+	}
+	return all
+}
@@ -0,0 +1,31 @@
+package orchestrator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskLocatorTable_RoundTrip(t *testing.T) {
+	queue := NewMemoryQueueBackend()
+	engine := newTestEngine(t, queue, time.Hour)
+	ctx := context.Background()
+
+	table := NewTaskLocatorTable(engine)
+	kept := NodeLocatorFromTriplet(BranchName("test"), GoalID("goal_id"), NodeID("kept"))
+	deleted := NodeLocatorFromTriplet(BranchName("test"), GoalID("goal_id"), NodeID("deleted"))
+	require.NoError(t, table.Set(ctx, EngineTaskID("kept"), kept))
+	require.NoError(t, table.Set(ctx, EngineTaskID("deleted"), deleted))
+	require.NoError(t, table.Delete(ctx, EngineTaskID("deleted")))
+
+	loaded := NewTaskLocatorTable(engine)
+	require.NoError(t, loaded.Load(ctx))
+	require.Equal(t, map[EngineTaskID]NodeLocator{EngineTaskID("kept"): kept}, loaded.All())
+	locator, ok := loaded.Get(EngineTaskID("kept"))
+	require.True(t, ok)
+	require.Equal(t, kept, locator)
+	_, ok = loaded.Get(EngineTaskID("deleted"))
+	require.False(t, ok)
+}
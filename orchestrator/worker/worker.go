@@ -0,0 +1,256 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/zaporter/branch-by-branch/orchestrator"
+)
+
+// Handler processes a single task and returns its result.
+//
+// Returning an error gives the task back to the engine (it is pushed to {job}:abandoned and requeued,
+// up to SchedulingParams.MaxAttempts). Task-level failures that should reach the consumer (ex: a failed compilation)
+// must be encoded in the result instead.
+//
+// ctx is cancelled if the worker is shutting down or the task is cancelled through Engine.Cancel.
+type Handler func(ctx context.Context, task string) (string, error)
+
+type Params struct {
+	// Name in {job}:workers. Defaults to hostname-pid.
+	Name string
+	// How often the worker rewrites its WorkerHeartbeat. Defaults to 5s.
+	HeartbeatInterval time.Duration
+	// How often {job}:cancelled is checked while a task is running. Defaults to 5s.
+	CancelCheckInterval time.Duration
+	// How long each BPriorityPopLPush blocks for. Defaults to 5s.
+	PollTimeout time.Duration
+}
+
+// Worker implements the worker side of the engine's list protocol (see orchestrator.Engine):
+//   - tasks are received highest priority first with BPriorityPopLPush({job}:tasks, {job}:processing)
+//   - exactly one result is pushed to {job}:results for every task that the handler finishes
+//   - tasks that are not finished (handler error or shutdown) are pushed to {job}:abandoned
+//   - cancelled tasks are dropped without a result
+//   - the worker registers itself in {job}:workers and heartbeats while it runs
+//   - task bodies of any payload version are decoded & results are encoded in the version of their task
+//
+// A Worker processes one task at a time. Run several to process tasks in parallel.
+type Worker struct {
+	job     orchestrator.EngineJobName
+	queue   orchestrator.QueueBackend
+	handler Handler
+	params  Params
+	codec   *orchestrator.PayloadCodec
+
+	mu      sync.Mutex
+	heldID  orchestrator.EngineTaskID
+	holding bool
+}
+
+func NewWorker(job orchestrator.EngineJobName, queue orchestrator.QueueBackend, handler Handler, params Params) *Worker {
+	if params.Name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown-host"
+		}
+		params.Name = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if params.HeartbeatInterval == 0 {
+		params.HeartbeatInterval = 5 * time.Second
+	}
+	if params.CancelCheckInterval == 0 {
+		params.CancelCheckInterval = 5 * time.Second
+	}
+	if params.PollTimeout == 0 {
+		params.PollTimeout = 5 * time.Second
+	}
+	return &Worker{
+		job:     job,
+		queue:   queue,
+		handler: handler,
+		params:  params,
+		codec:   orchestrator.NewPayloadCodec(job, queue, orchestrator.DefaultPayloadParams()),
+	}
+}
+
+func (w *Worker) Name() string {
+	return w.params.Name
+}
+
+// Run processes tasks until ctx is cancelled. The task in progress (if any) is abandoned
+// unless its handler returns a result anyway. Returns nil on a clean shutdown.
+func (w *Worker) Run(ctx context.Context) error {
+	logger := zerolog.Ctx(ctx).With().Str("worker", w.params.Name).Logger()
+	ctx = logger.WithContext(ctx)
+	// cleanup must still reach the queues after ctx is cancelled
+	cleanupCtx := context.WithoutCancel(ctx)
+
+	heartbeatDone := make(chan struct{})
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	go func() {
+		defer close(heartbeatDone)
+		w.heartbeatLoop(heartbeatCtx)
+	}()
+	defer func() {
+		stopHeartbeat()
+		<-heartbeatDone
+		if err := w.queue.HDel(cleanupCtx, w.job.WorkersTableName(), w.params.Name); err != nil {
+			logger.Error().Err(err).Msg("Error unregistering worker")
+		}
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		raw, err := w.queue.BPriorityPopLPush(ctx, w.job.TasksQueueName(), w.job.ProcessingQueueName(), w.params.PollTimeout)
+		if errors.Is(err, orchestrator.ErrQueueEmpty) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		var msg orchestrator.EngineTaskMsg
+		if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+			// without an id there is nothing to push. The engine will time it out.
+			logger.Error().Err(err).Msgf("Dropping unparsable task %q", raw)
+			continue
+		}
+		if err := w.process(ctx, cleanupCtx, msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *Worker) process(ctx context.Context, cleanupCtx context.Context, msg orchestrator.EngineTaskMsg) error {
+	logger := zerolog.Ctx(ctx)
+	cancelled, err := w.isCancelled(cleanupCtx, msg.ID)
+	if err != nil {
+		return err
+	}
+	if cancelled {
+		logger.Debug().Msgf("Skipping cancelled task %s", msg.ID)
+		return nil
+	}
+	w.hold(msg.ID)
+	w.heartbeat(cleanupCtx)
+	defer w.heartbeat(cleanupCtx)
+	defer w.release()
+
+	task, err := w.codec.DecodeTask(cleanupCtx, msg)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Abandoning undecodable task %s", msg.ID)
+		_, err := w.queue.LPush(cleanupCtx, w.job.AbandonedQueueName(), string(msg.ID))
+		return err
+	}
+
+	taskCtx, cancelTask := context.WithCancel(ctx)
+	defer cancelTask()
+	watcherDone := make(chan struct{})
+	wasCancelled := false
+	go func() {
+		defer close(watcherDone)
+		ticker := time.NewTicker(w.params.CancelCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-taskCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			cancelled, err := w.isCancelled(taskCtx, msg.ID)
+			if err != nil {
+				logger.Error().Err(err).Msgf("Error checking whether task %s was cancelled", msg.ID)
+				continue
+			}
+			if cancelled {
+				wasCancelled = true
+				cancelTask()
+				return
+			}
+		}
+	}()
+	result, handlerErr := w.handler(taskCtx, task.Task)
+	cancelTask()
+	<-watcherDone
+
+	switch {
+	case wasCancelled:
+		logger.Debug().Msgf("Dropping cancelled task %s", msg.ID)
+		return nil
+	case handlerErr != nil:
+		logger.Warn().Err(handlerErr).Msgf("Abandoning task %s", msg.ID)
+		_, err := w.queue.LPush(cleanupCtx, w.job.AbandonedQueueName(), string(msg.ID))
+		return err
+	}
+	encoded, err := w.codec.EncodeResult(cleanupCtx, orchestrator.EngineTaskResultMsg{ID: msg.ID, Result: result}, msg.PayloadVersion)
+	if err != nil {
+		return err
+	}
+	resultMsg, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	_, err = w.queue.LPush(cleanupCtx, w.job.ResultsQueueName(), string(resultMsg))
+	return err
+}
+
+func (w *Worker) isCancelled(ctx context.Context, id orchestrator.EngineTaskID) (bool, error) {
+	return w.queue.HExists(ctx, w.job.CancelledTableName(), string(id))
+}
+
+func (w *Worker) hold(id orchestrator.EngineTaskID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.heldID, w.holding = id, true
+}
+
+func (w *Worker) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.heldID, w.holding = "", false
+}
+
+func (w *Worker) heartbeatLoop(ctx context.Context) {
+	ticker := time.NewTicker(w.params.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		w.heartbeat(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Worker) heartbeat(ctx context.Context) {
+	w.mu.Lock()
+	heartbeat := orchestrator.WorkerHeartbeat{
+		Name:          w.params.Name,
+		LastHeartbeat: time.Now(),
+		TaskIDs:       []orchestrator.EngineTaskID{},
+	}
+	if w.holding {
+		heartbeat.TaskIDs = append(heartbeat.TaskIDs, w.heldID)
+	}
+	w.mu.Unlock()
+	raw, err := json.Marshal(heartbeat)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Error encoding heartbeat")
+		return
+	}
+	if err := w.queue.HSet(ctx, w.job.WorkersTableName(), w.params.Name, string(raw)); err != nil && ctx.Err() == nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Error sending heartbeat")
+	}
+}
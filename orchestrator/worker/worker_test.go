@@ -0,0 +1,218 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zaporter/branch-by-branch/orchestrator"
+)
+
+// These tests run Workers against a real Engine (on the in-memory backend) to check that
+// the worker side of the protocol is followed.
+
+func testSchedulingParams() orchestrator.SchedulingParams {
+	return orchestrator.SchedulingParams{
+		MinTaskQueueSize: 4,
+		MaxTaskQueueSize: 8,
+		// long enough that only abandonment can requeue a task
+		TaskProcessingTimeout: time.Hour,
+		CamShaftInterval:      5 * time.Millisecond,
+		CrankShaftInterval:    5 * time.Millisecond,
+		TimingBeltInterval:    5 * time.Millisecond,
+		ODBInterval:           time.Second,
+		InputChanSize:         4,
+		OutputChanSize:        4,
+	}
+}
+
+func testParams(name string) Params {
+	return Params{
+		Name:                name,
+		HeartbeatInterval:   10 * time.Millisecond,
+		CancelCheckInterval: 5 * time.Millisecond,
+		PollTimeout:         10 * time.Millisecond,
+	}
+}
+
+func startTestEngine(t *testing.T, queue orchestrator.QueueBackend) *orchestrator.Engine {
+	ctx := context.Background()
+	engine := orchestrator.NewEngine(ctx, orchestrator.EngineJobNameTest, queue, testSchedulingParams())
+	require.NoError(t, engine.Start(ctx))
+	t.Cleanup(func() {
+		engine.TriggerStop()
+		engine.WaitForStop()
+	})
+	return engine
+}
+
+// startTestWorker runs w until the returned stop func is called (or the test ends).
+func startTestWorker(t *testing.T, w *Worker) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.NoError(t, w.Run(ctx))
+	}()
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func requireEngineOutput(t *testing.T, engine *orchestrator.Engine) orchestrator.EngineTaskResultMsg {
+	select {
+	case result := <-engine.GetOutput():
+		return result
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "timed out waiting for engine output")
+	}
+	return orchestrator.EngineTaskResultMsg{}
+}
+
+func TestWorker_ExactlyOneResultPerTask(t *testing.T) {
+	queue := orchestrator.NewMemoryQueueBackend()
+	engine := startTestEngine(t, queue)
+	handler := func(ctx context.Context, task string) (string, error) {
+		return "done " + task, nil
+	}
+	for i := 0; i < 3; i++ {
+		startTestWorker(t, NewWorker(orchestrator.EngineJobNameTest, queue, handler, testParams(fmt.Sprintf("worker-%d", i))))
+	}
+
+	const numTasks = 20
+	go func() {
+		for i := 0; i < numTasks; i++ {
+			engine.GetInput() <- orchestrator.EngineTaskMsg{Task: fmt.Sprintf("%d", i)}
+		}
+	}()
+	seen := map[string]bool{}
+	for i := 0; i < numTasks; i++ {
+		result := requireEngineOutput(t, engine)
+		require.Empty(t, result.EngineError)
+		require.False(t, seen[result.Result], "duplicate result %q", result.Result)
+		seen[result.Result] = true
+	}
+	for i := 0; i < numTasks; i++ {
+		require.True(t, seen[fmt.Sprintf("done %d", i)])
+	}
+	select {
+	case result := <-engine.GetOutput():
+		require.FailNow(t, "unexpected extra result", "%+v", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWorker_HandlerErrorAbandons(t *testing.T) {
+	queue := orchestrator.NewMemoryQueueBackend()
+	engine := startTestEngine(t, queue)
+	var attempts atomic.Int32
+	handler := func(ctx context.Context, task string) (string, error) {
+		if attempts.Add(1) == 1 {
+			return "", errors.New("transient failure")
+		}
+		return "ok", nil
+	}
+	startTestWorker(t, NewWorker(orchestrator.EngineJobNameTest, queue, handler, testParams("worker-1")))
+
+	engine.GetInput() <- orchestrator.EngineTaskMsg{Task: "flaky"}
+	result := requireEngineOutput(t, engine)
+	require.Equal(t, "ok", result.Result)
+	require.Equal(t, int32(2), attempts.Load())
+}
+
+func TestWorker_ShutdownAbandonsTaskInProgress(t *testing.T) {
+	queue := orchestrator.NewMemoryQueueBackend()
+	engine := startTestEngine(t, queue)
+	started := make(chan struct{})
+	blocking := func(ctx context.Context, task string) (string, error) {
+		close(started)
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	stopFirst := startTestWorker(t, NewWorker(orchestrator.EngineJobNameTest, queue, blocking, testParams("worker-1")))
+
+	engine.GetInput() <- orchestrator.EngineTaskMsg{Task: "interrupted"}
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "first worker never received the task")
+	}
+	stopFirst()
+
+	handler := func(ctx context.Context, task string) (string, error) {
+		return "finished " + task, nil
+	}
+	startTestWorker(t, NewWorker(orchestrator.EngineJobNameTest, queue, handler, testParams("worker-2")))
+	result := requireEngineOutput(t, engine)
+	require.Equal(t, "finished interrupted", result.Result)
+}
+
+func TestWorker_HeartbeatsWhileRunning(t *testing.T) {
+	queue := orchestrator.NewMemoryQueueBackend()
+	engine := startTestEngine(t, queue)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := func(ctx context.Context, task string) (string, error) {
+		close(started)
+		<-release
+		return "done", nil
+	}
+	stop := startTestWorker(t, NewWorker(orchestrator.EngineJobNameTest, queue, handler, testParams("worker-1")))
+
+	engine.GetInput() <- orchestrator.EngineTaskMsg{Task: "held"}
+	<-started
+	require.Eventually(t, func() bool {
+		workers, err := engine.Workers(context.Background())
+		return err == nil && len(workers) == 1 && workers[0].Name == "worker-1" && len(workers[0].TaskIDs) == 1
+	}, 2*time.Second, 5*time.Millisecond)
+	close(release)
+	requireEngineOutput(t, engine)
+
+	stop()
+	workers, err := engine.Workers(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, workers)
+}
+
+func TestWorker_CancelStopsHandler(t *testing.T) {
+	queue := orchestrator.NewMemoryQueueBackend()
+	engine := startTestEngine(t, queue)
+	started := make(chan orchestrator.EngineTaskID, 1)
+	handlerCancelled := make(chan struct{})
+	var w *Worker
+	handler := func(ctx context.Context, task string) (string, error) {
+		w.mu.Lock()
+		started <- w.heldID
+		w.mu.Unlock()
+		<-ctx.Done()
+		close(handlerCancelled)
+		return "too late", nil
+	}
+	w = NewWorker(orchestrator.EngineJobNameTest, queue, handler, testParams("worker-1"))
+	startTestWorker(t, w)
+
+	engine.GetInput() <- orchestrator.EngineTaskMsg{Task: "cancel me"}
+	id := <-started
+	engine.Cancel(id)
+	select {
+	case <-handlerCancelled:
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "handler context was never cancelled")
+	}
+	select {
+	case result := <-engine.GetOutput():
+		require.FailNow(t, "cancelled task produced a result", "%+v", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -28,13 +28,17 @@ args = parser.parse_args()
 redisHost = os.getenv('REDIS_ADDRESS') or 'err no host'
 redisPassword = os.getenv('REDIS_PASSWORD') or 'err no pw'
 redisPort = os.getenv('REDIS_PORT') or 'err no port'
+# See RedisNamespace in orchestrator/redis.go
+redisNamespace = os.getenv('REDIS_NAMESPACE') or ''
+def key(name: str) -> str:
+    return f"{redisNamespace}:{name}" if redisNamespace else name
 r = redis.Redis(host=redisHost, port=int(redisPort), password=redisPassword, decode_responses=True)
 
 print("started")
 
-redis_training_recv_chan = "training:data-chan"
-redis_training_req_chan = "training:request-chan"
-redis_training_adv_list = "training:advertisement-list"
+redis_training_recv_chan = key("training:data-chan")
+redis_training_req_chan = key("training:request-chan")
+redis_training_adv_list = key("training:advertisement-list")
 
 params=None
 
@@ -78,10 +82,10 @@ def download_model(model_name:str):
 def update_params():
     global params
     params = {
-        "training_base_model": r.get("training:base_model"),
-        "training_adapter": r.get("training:adapter"),
-        "training_do_update_adapter": r.get("training:do_update_adapter") == "true",
-        "training_autogroup_tokens": int(r.get("training:autogroup_tokens")),
+        "training_base_model": r.get(key("training:base_model")),
+        "training_adapter": r.get(key("training:adapter")),
+        "training_do_update_adapter": r.get(key("training:do_update_adapter")) == "true",
+        "training_autogroup_tokens": int(r.get(key("training:autogroup_tokens"))),
     }
 
 def batch_generator():
@@ -379,7 +383,7 @@ class Trainer:
             update_params()
             
             if len(batch) >= args.batch_size:
-                r.set("inference:enabled", "false")
+                r.set(key("inference:enabled"), "false")
 
                 batchLosses = self.train_step_microbatch(batch, scale=2/3)
                 historyBatch = random.sample(list(all_data.values()), k=args.batch_size)
@@ -432,10 +436,10 @@ class Trainer:
             raise Exception(f"Failed to upload model {adapter_name}")
 
     def swap_adapter(self, adapter_name: str):
-        r.set("inference:base_model", params["training_base_model"])
-        r.set("inference:adapter", adapter_name)
-        r.set("inference:enabled", "true")
-        r.set("training:adapter", adapter_name)
+        r.set(key("inference:base_model"), params["training_base_model"])
+        r.set(key("inference:adapter"), adapter_name)
+        r.set(key("inference:enabled"), "true")
+        r.set(key("training:adapter"), adapter_name)
 
 
 def main():
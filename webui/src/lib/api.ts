@@ -67,6 +67,7 @@ export const nodeResultSchema = z.enum([
     'node_result_context_exhaustion',
     'node_result_terminated',
     'node_result_aborted',
+    'node_result_infrastructure_failure',
 ]);
 export type NodeResult = z.infer<typeof nodeResultSchema>;
 export const graphStateSchema = z.enum([